@@ -0,0 +1,459 @@
+package bitcoin
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"log"
+	mrand "math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AddressEntry is what the AddressBook knows of a peer address. Source is
+// the address of the peer that told us about it, Failures the number of
+// connection attempts since the last success.
+type AddressEntry struct {
+	Address     string
+	Source      string
+	LastSeen    uint32
+	LastAttempt uint32
+	LastSuccess uint32
+	Failures    uint32
+	Tried       bool
+}
+
+// terrible tells whether e is not worth keeping: not heard of for too long,
+// never reached in several attempts or failing ever since its last success.
+func (e *AddressEntry) terrible(now int64) bool {
+	if now-int64(e.LastAttempt) < ADDRESS_RETRY_INTERVAL {
+		return false
+	}
+	if now-int64(e.LastSeen) > ADDRESS_MAX_AGE {
+		return true
+	}
+	if e.LastSuccess == 0 && e.Failures >= ADDRESS_MAX_RETRIES {
+		return true
+	}
+	return e.Failures >= ADDRESS_MAX_FAILURES
+}
+
+// chance is the relative probability of e being picked for a connection.
+func (e *AddressEntry) chance(now int64) float64 {
+	c := 1.0
+	if now-int64(e.LastAttempt) < ADDRESS_RETRY_INTERVAL {
+		c *= 0.01
+	}
+	for i := uint32(0); i < e.Failures && i < 8; i++ {
+		c *= 0.66
+	}
+	return c
+}
+
+// AddressBook keeps the addresses of peers across restarts and picks the
+// ones to connect to. Like the address manager of Bitcoin, it sorts them in
+// buckets by a secret hash so that a single network can't fill the book:
+// new addresses land in one of a few buckets chosen by the group of the peer
+// that sent them, and addresses we connected to move to a table where each
+// group only gets a few buckets. A full bucket evicts its worst entry.
+type AddressBook struct {
+	lock    sync.Mutex
+	path    string
+	key     []byte
+	entries map[string]*AddressEntry
+	new     [][]string
+	tried   [][]string
+}
+
+// OpenAddressBook reads the book at path. A missing or damaged file gives an
+// empty book.
+func OpenAddressBook(path string) *AddressBook {
+	b := &AddressBook{path: path}
+	b.reset()
+
+	d, err := os.ReadFile(path)
+	if err == nil {
+		err = b.UnMarshalBinary(d)
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Fail to read address book", err)
+		}
+		b.reset()
+	}
+	return b
+}
+
+func (b *AddressBook) reset() {
+	b.key = make([]byte, 32)
+	rand.Read(b.key)
+	b.entries = map[string]*AddressEntry{}
+	b.new = make([][]string, ADDRESS_NEW_BUCKETS)
+	b.tried = make([][]string, ADDRESS_TRIED_BUCKETS)
+}
+
+// addressGroup is the network an address belongs to: its /16 for IPv4 and
+// /32 for IPv6.
+func addressGroup(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(16, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
+
+// routable tells whether address can be reached from the internet.
+func routable(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() && !ip.IsLinkLocalUnicast()
+}
+
+func (b *AddressBook) hash(n int, parts ...string) int {
+	h := sha256.New()
+	h.Write(b.key)
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return int(binary.LittleEndian.Uint64(h.Sum(nil)) % uint64(n))
+}
+
+func (b *AddressBook) newBucket(e *AddressEntry) int {
+	source := addressGroup(e.Source)
+	slot := b.hash(ADDRESS_BUCKETS_PER_GROUP, addressGroup(e.Address), source)
+	return b.hash(ADDRESS_NEW_BUCKETS, source, strconv.Itoa(slot))
+}
+
+func (b *AddressBook) triedBucket(e *AddressEntry) int {
+	slot := b.hash(ADDRESS_BUCKETS_PER_GROUP, e.Address)
+	return b.hash(ADDRESS_TRIED_BUCKETS, addressGroup(e.Address), strconv.Itoa(slot))
+}
+
+func removeAddress(bucket []string, address string) []string {
+	for i, a := range bucket {
+		if a == address {
+			return append(bucket[:i], bucket[i+1:]...)
+		}
+	}
+	return bucket
+}
+
+// worst is the entry of bucket to evict: a terrible one, or else the one
+// least recently seen.
+func (b *AddressBook) worst(bucket []string, now int64) string {
+	victim := bucket[0]
+	for _, a := range bucket {
+		e := b.entries[a]
+		if e.terrible(now) {
+			return a
+		}
+		if e.LastSeen < b.entries[victim].LastSeen {
+			victim = a
+		}
+	}
+	return victim
+}
+
+func (b *AddressBook) placeNew(e *AddressEntry, now int64) {
+	i := b.newBucket(e)
+	if len(b.new[i]) >= ADDRESS_BUCKET_SIZE {
+		victim := b.worst(b.new[i], now)
+		b.new[i] = removeAddress(b.new[i], victim)
+		delete(b.entries, victim)
+	}
+	e.Tried = false
+	b.new[i] = append(b.new[i], e.Address)
+	b.entries[e.Address] = e
+}
+
+// placeTried moves e from the new table to the tried one. The entry it
+// evicts from a full bucket goes back to the new table.
+func (b *AddressBook) placeTried(e *AddressEntry, now int64) {
+	i := b.newBucket(e)
+	b.new[i] = removeAddress(b.new[i], e.Address)
+
+	i = b.triedBucket(e)
+	if len(b.tried[i]) >= ADDRESS_BUCKET_SIZE {
+		victim := b.tried[i][0]
+		for _, a := range b.tried[i] {
+			if b.entries[a].LastSuccess < b.entries[victim].LastSuccess {
+				victim = a
+			}
+		}
+		b.tried[i] = removeAddress(b.tried[i], victim)
+		b.placeNew(b.entries[victim], now)
+	}
+	e.Tried = true
+	b.tried[i] = append(b.tried[i], e.Address)
+	b.entries[e.Address] = e
+}
+
+// Add records address as heard of from source. Like Attempt and Good, it
+// ignores addresses longer than IP_SIZE, which the file can't hold.
+func (b *AddressBook) Add(address, source string) {
+	if len(address) > IP_SIZE || len(source) > IP_SIZE {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now().Unix()
+	if e, ok := b.entries[address]; ok {
+		e.LastSeen = uint32(now)
+		return
+	}
+	b.placeNew(&AddressEntry{Address: address, Source: source, LastSeen: uint32(now)}, now)
+}
+
+// Attempt records a connection attempt to address. It counts as a failure
+// until Good is called.
+func (b *AddressBook) Attempt(address string) {
+	if len(address) > IP_SIZE {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now().Unix()
+	e, ok := b.entries[address]
+	if !ok {
+		e = &AddressEntry{Address: address, Source: address, LastSeen: uint32(now)}
+		b.placeNew(e, now)
+	}
+	e.LastAttempt = uint32(now)
+	e.Failures++
+}
+
+// Good records a successful connection to address.
+func (b *AddressBook) Good(address string) {
+	if len(address) > IP_SIZE {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now().Unix()
+	e, ok := b.entries[address]
+	if !ok {
+		e = &AddressEntry{Address: address, Source: address}
+		b.placeNew(e, now)
+	}
+	e.LastSeen, e.LastSuccess, e.Failures = uint32(now), uint32(now), 0
+	if !e.Tried {
+		b.placeTried(e, now)
+	}
+}
+
+// Seen records that the peer at address was alive.
+func (b *AddressBook) Seen(address string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if e, ok := b.entries[address]; ok {
+		e.LastSeen = uint32(time.Now().Unix())
+	}
+}
+
+// Select picks an address to connect to, from the new or the tried table
+// with even odds, favouring entries that didn't fail lately. Addresses for
+// which skip returns true are left out. It returns "" when none fits.
+func (b *AddressBook) Select(skip func(address string) bool) string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now().Unix()
+	tables := [][][]string{}
+	for _, table := range [][][]string{b.new, b.tried} {
+		for _, bucket := range table {
+			if len(bucket) > 0 {
+				tables = append(tables, table)
+				break
+			}
+		}
+	}
+	if len(tables) == 0 {
+		return ""
+	}
+
+	for i := 0; i < ADDRESS_SELECT_TRIES; i++ {
+		table := tables[mrand.Intn(len(tables))]
+		bucket := table[mrand.Intn(len(table))]
+		if len(bucket) == 0 {
+			continue
+		}
+		e := b.entries[bucket[mrand.Intn(len(bucket))]]
+		if skip(e.Address) || e.terrible(now) {
+			continue
+		}
+		if mrand.Float64() < e.chance(now) {
+			return e.Address
+		}
+	}
+	return ""
+}
+
+// Best lists up to n tried addresses, the latest reached first.
+func (b *AddressBook) Best(n int) []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now().Unix()
+	tried := []*AddressEntry{}
+	for _, e := range b.entries {
+		if e.Tried && !e.terrible(now) {
+			tried = append(tried, e)
+		}
+	}
+	sort.Slice(tried, func(i, j int) bool { return tried[i].LastSuccess > tried[j].LastSuccess })
+
+	addresses := []string{}
+	for i := 0; i < len(tried) && i < n; i++ {
+		addresses = append(addresses, tried[i].Address)
+	}
+	return addresses
+}
+
+// Addresses lists up to n addresses worth sharing with peers, at random.
+func (b *AddressBook) Addresses(n int) []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now().Unix()
+	addresses := []string{}
+	for a, e := range b.entries {
+		if !e.terrible(now) {
+			addresses = append(addresses, a)
+		}
+	}
+	mrand.Shuffle(len(addresses), func(i, j int) { addresses[i], addresses[j] = addresses[j], addresses[i] })
+	if len(addresses) > n {
+		addresses = addresses[:n]
+	}
+	return addresses
+}
+
+// Entries lists the whole book, tried addresses first.
+func (b *AddressBook) Entries() []AddressEntry {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	entries := []AddressEntry{}
+	for _, e := range b.entries {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Tried != entries[j].Tried {
+			return entries[i].Tried
+		}
+		return entries[i].LastSeen > entries[j].LastSeen
+	})
+	return entries
+}
+
+// Save replaces the book file atomically, dropping terrible entries.
+func (b *AddressBook) Save() error {
+	b.lock.Lock()
+	d, err := b.MarshalBinary()
+	b.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, d, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+func (b *AddressBook) MarshalBinary() ([]byte, error) {
+	bs := &bytes.Buffer{}
+
+	now := time.Now().Unix()
+	entries := []*AddressEntry{}
+	for _, e := range b.entries {
+		if !e.terrible(now) {
+			entries = append(entries, e)
+		}
+	}
+
+	binary.Write(bs, binary.LittleEndian, uint32(PEERS_MAGIC))
+	bs.Write(FitBytes(b.key, 32))
+	binary.Write(bs, binary.LittleEndian, uint32(len(entries)))
+	for _, e := range entries {
+		if len(e.Address) > IP_SIZE || len(e.Source) > IP_SIZE {
+			return nil, errors.New("Address too long")
+		}
+		bs.Write(FitBytes([]byte(e.Address), IP_SIZE))
+		bs.Write(FitBytes([]byte(e.Source), IP_SIZE))
+		binary.Write(bs, binary.LittleEndian, e.LastSeen)
+		binary.Write(bs, binary.LittleEndian, e.LastAttempt)
+		binary.Write(bs, binary.LittleEndian, e.LastSuccess)
+		binary.Write(bs, binary.LittleEndian, e.Failures)
+		if e.Tried {
+			bs.WriteByte(1)
+		} else {
+			bs.WriteByte(0)
+		}
+	}
+
+	return bs.Bytes(), nil
+}
+
+// UnMarshalBinary places the entries read back in the buckets, which depend
+// only on the key.
+func (b *AddressBook) UnMarshalBinary(d []byte) error {
+	if len(d) < 4+32+4 {
+		return errors.New("Insuficient address book size")
+	}
+	buf := bytes.NewBuffer(d)
+
+	var magic, count uint32
+	binary.Read(buf, binary.LittleEndian, &magic)
+	if magic != PEERS_MAGIC {
+		return errors.New("Not an address book")
+	}
+	b.key = buf.Next(32)
+	binary.Read(buf, binary.LittleEndian, &count)
+	if int(count)*ADDRESS_ENTRY_SIZE != buf.Len() {
+		return errors.New("Wrong address book size")
+	}
+
+	now := time.Now().Unix()
+	for i := 0; i < int(count); i++ {
+		e := &AddressEntry{}
+		e.Address = string(bytes.TrimLeft(buf.Next(IP_SIZE), "\x00"))
+		e.Source = string(bytes.TrimLeft(buf.Next(IP_SIZE), "\x00"))
+		binary.Read(buf, binary.LittleEndian, &e.LastSeen)
+		binary.Read(buf, binary.LittleEndian, &e.LastAttempt)
+		binary.Read(buf, binary.LittleEndian, &e.LastSuccess)
+		binary.Read(buf, binary.LittleEndian, &e.Failures)
+		tried, _ := buf.ReadByte()
+
+		if _, ok := b.entries[e.Address]; ok {
+			continue
+		}
+		b.placeNew(e, now)
+		if tried == 1 {
+			b.placeTried(e, now)
+		}
+	}
+	return nil
+}
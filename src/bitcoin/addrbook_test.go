@@ -0,0 +1,33 @@
+package bitcoin
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAddressBookRejectsLongAddresses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), PEERS_FILE)
+	b := OpenAddressBook(path)
+
+	short := "192.0.2.1:9200"
+	long := "[2001:db8::1234:5678]:9200"
+	b.Add(short, short)
+	b.Add(long, short)
+	b.Add(short+"0", long)
+	b.Attempt(long)
+	b.Good(long)
+	b.Good(short)
+
+	entries := b.Entries()
+	if len(entries) != 1 || entries[0].Address != short {
+		t.Fatalf("entries %+v, want only %s", entries, short)
+	}
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries = OpenAddressBook(path).Entries()
+	if len(entries) != 1 || entries[0].Address != short || !entries[0].Tried {
+		t.Errorf("entries read back %+v", entries)
+	}
+}
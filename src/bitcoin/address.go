@@ -0,0 +1,104 @@
+package bitcoin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// KeyHash is the hash outputs are locked to. Keys are padded to
+// NETWORK_KEY_SIZE first, as they are on the wire, so a key hashes the same
+// before and after a round trip.
+func KeyHash(public []byte) []byte {
+	first := sha256.Sum256(FitBytes(public, NETWORK_KEY_SIZE))
+	second := sha256.Sum256(first[:])
+	return second[:ADDRESS_HASH_SIZE]
+}
+
+// EncodeAddress writes a key hash as Base58Check: a version byte, the hash
+// and the first 4 bytes of the double sha256 of both.
+func EncodeAddress(hash []byte) string {
+	d := append([]byte{Params.AddressVersion}, FitBytes(hash, ADDRESS_HASH_SIZE)...)
+	return Base58Encode(append(d, addressChecksum(d)...))
+}
+
+func AddressFromKey(public []byte) string {
+	return EncodeAddress(KeyHash(public))
+}
+
+// DecodeAddress returns the key hash of address, checking its version and
+// checksum.
+func DecodeAddress(address string) ([]byte, error) {
+	d, err := Base58Decode(address)
+	if err != nil {
+		return nil, err
+	}
+	if len(d) != 1+ADDRESS_HASH_SIZE+4 {
+		return nil, errors.New("Invalid address length")
+	}
+
+	payload, checksum := d[:len(d)-4], d[len(d)-4:]
+	if !bytes.Equal(addressChecksum(payload), checksum) {
+		return nil, errors.New("Invalid address checksum")
+	}
+	if payload[0] != Params.AddressVersion {
+		return nil, errors.New("Unknown address version")
+	}
+	return payload[1:], nil
+}
+
+func ValidateAddress(address string) bool {
+	_, err := DecodeAddress(address)
+	return err == nil
+}
+
+func addressChecksum(d []byte) []byte {
+	first := sha256.Sum256(d)
+	second := sha256.Sum256(first[:])
+	return second[:4]
+}
+
+// Base58Encode writes d in base 58, each leading zero byte as a '1'.
+func Base58Encode(d []byte) string {
+	n := new(big.Int).SetBytes(d)
+	base, mod := big.NewInt(58), new(big.Int)
+
+	out := []byte{}
+	for n.Sign() > 0 {
+		n.DivMod(n, base, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, b := range d {
+		if b != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func Base58Decode(s string) ([]byte, error) {
+	n, base := new(big.Int), big.NewInt(58)
+
+	zeros := 0
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+	for _, c := range []byte(s) {
+		digit := bytes.IndexByte([]byte(base58Alphabet), c)
+		if digit < 0 {
+			return nil, errors.New("Invalid base58 character")
+		}
+		n.Mul(n, base)
+		n.Add(n, big.NewInt(int64(digit)))
+	}
+
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
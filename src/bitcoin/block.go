@@ -4,40 +4,53 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"log"
-	"math"
+	"math/big"
 	"reflect"
 )
 
 type BlockHeader struct {
+	Version    uint32
 	Origin     []byte
 	PrevBlock  []byte
 	MerkelRoot []byte
 	Timestamp  uint32
+	Bits       uint32
 	Nonce      uint32
 }
 
 func (bh *BlockHeader) MarshalBinary() ([]byte, error) {
 	bs := &bytes.Buffer{}
 
+	binary.Write(bs, binary.LittleEndian, bh.Version)
 	bs.Write(FitBytes(bh.Origin, NETWORK_KEY_SIZE))
 	bs.Write(FitBytes(bh.PrevBlock, 32))
 	bs.Write(FitBytes(bh.MerkelRoot, 32))
 	binary.Write(bs, binary.LittleEndian, bh.Timestamp)
+	binary.Write(bs, binary.LittleEndian, bh.Bits)
 	binary.Write(bs, binary.LittleEndian, bh.Nonce)
 
 	return bs.Bytes(), nil
 }
 
 func (bh *BlockHeader) UnMarshalBinary(d []byte) error {
+	if len(d) != BLOCK_HEADER_SIZE {
+		return errors.New("Wrong block header size")
+	}
 	bf := bytes.NewBuffer(d)
 
+	binary.Read(bytes.NewBuffer(bf.Next(4)), binary.LittleEndian, &bh.Version)
 	bh.Origin = bf.Next(NETWORK_KEY_SIZE)
 	bh.PrevBlock = bf.Next(32)
-	bh.PrevBlock = bf.Next(32)
+	bh.MerkelRoot = bf.Next(32)
 	binary.Read(bytes.NewBuffer(bf.Next(4)), binary.LittleEndian, &bh.Timestamp)
+	binary.Read(bytes.NewBuffer(bf.Next(4)), binary.LittleEndian, &bh.Bits)
 	binary.Read(bytes.NewBuffer(bf.Next(4)), binary.LittleEndian, &bh.Nonce)
 
+	if _, err := GetSignatureScheme(bh.Version); err != nil {
+		return errors.New("Unknown block version")
+	}
 	return nil
 }
 
@@ -70,11 +83,12 @@ type Block struct {
 	Signature []byte
 	*TransactionSlice
 	From []byte
+	Peer *Node
 }
 
 func NewBlock(previousBlock []byte) Block {
-	header := &BlockHeader{PrevBlock: previousBlock}
-	return Block{header, nil, new(TransactionSlice), nil}
+	header := &BlockHeader{Version: CONSENSUS_VERSION, PrevBlock: previousBlock}
+	return Block{BlockHeader: header, TransactionSlice: new(TransactionSlice)}
 }
 
 func (b *Block) AddTransaction(tr Transaction) {
@@ -94,7 +108,14 @@ func (b *Block) Sign(keypair *Keypair) []byte {
 	return s
 }
 
-func (b *Block) VerifyBlock(prefix []byte) bool {
+func (b *Block) Target() *big.Int {
+	return CompactToBig(b.BlockHeader.Bits)
+}
+
+// VerifyBlock checks the block on its own, its transactions included as the
+// mempool checks them. Its target may not be easier than limit; whether Bits
+// is right for its place in the chain is checked by the BlockChain.
+func (b *Block) VerifyBlock(limit *big.Int) bool {
 	headerHash := b.Hash()
 	merkel := b.GenerateMerkelRoot()
 
@@ -103,18 +124,42 @@ func (b *Block) VerifyBlock(prefix []byte) bool {
 		return false
 	}
 
-	if !CheckProofOfWork(prefix, headerHash) {
+	d, err := b.MarshalBinary()
+	if err != nil || len(d) > BLOCK_MAX_SIZE {
+		log.Println("Block too large")
+		return false
+	}
+
+	for i, t := range *b.TransactionSlice {
+		if t.IsCoinbase() != (i == 0) {
+			log.Println("Coinbase must be the first transaction")
+			return false
+		}
+		if i > 0 && !t.VerifyTransaction(TRANSACTION_POW) {
+			log.Println("Transaction verification fails")
+			return false
+		}
+	}
+
+	target := b.Target()
+	if target.Sign() <= 0 || target.Cmp(limit) > 0 {
+		log.Println("Target out of range")
+		return false
+	}
+
+	if !CheckProofOfWork(target, headerHash) {
 		log.Println("Fail to check proof of work")
 		return false
 	}
 
-	if !SignatureVerify(b.BlockHeader.Origin, b.Signature, headerHash) {
+	if !SignatureVerify(b.BlockHeader.Version, b.BlockHeader.Origin, b.Signature, headerHash) {
 		log.Println("Signature verfication fail")
 		return false
 	}
 	return true
 }
 
+// GenerateMerkelRoot commits to the transactions by their WitnessHash.
 func (b *Block) GenerateMerkelRoot() []byte {
 	var merkell func(hashes [][]byte) []byte
 	merkell = func(hashes [][]byte) []byte {
@@ -141,16 +186,17 @@ func (b *Block) GenerateMerkelRoot() []byte {
 
 	var ts [][]byte
 	for _, v := range *b.TransactionSlice {
-		ts = append(ts, v.Hash())
+		ts = append(ts, v.WitnessHash())
 	}
 
 	return merkell(ts)
 }
 
-func (b Block) GenerateNounce(prefix []byte) uint32 {
+func (b Block) GenerateNounce() uint32 {
 
+	target := b.Target()
 	for {
-		if CheckProofOfWork(prefix, b.Hash()) {
+		if CheckProofOfWork(target, b.Hash()) {
 			break
 		}
 		b.BlockHeader.Nonce++
@@ -158,6 +204,8 @@ func (b Block) GenerateNounce(prefix []byte) uint32 {
 	return b.BlockHeader.Nonce
 }
 
+// MarshalBinary writes the header, the signature and the transactions. From
+// and Peer only concern the peer the block came from and are left out.
 func (b *Block) MarshalBinary() ([]byte, error) {
 
 	bs := bytes.Buffer{}
@@ -173,14 +221,15 @@ func (b *Block) MarshalBinary() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	bs.Write(FitBytes(b.From, IP_SIZE))
 	bs.Write(tsb)
 
 	return bs.Bytes(), nil
 }
 
 func (b *Block) UnMarshalBinary(d []byte) error {
-
+	if len(d) < BLOCK_HEADER_SIZE+NETWORK_KEY_SIZE {
+		return errors.New("Insuficient block size")
+	}
 	buf := bytes.NewBuffer(d)
 
 	header := new(BlockHeader)
@@ -191,10 +240,9 @@ func (b *Block) UnMarshalBinary(d []byte) error {
 
 	b.BlockHeader = header
 	b.Signature = buf.Next(NETWORK_KEY_SIZE)
-	b.From = buf.Next(IP_SIZE)
 
 	ts := new(TransactionSlice)
-	err = ts.UnMarshalBinary(buf.Next(math.MaxInt64))
+	err = ts.UnMarshalBinary(buf.Bytes())
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,313 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden compares d with the hex encoding stored in testdata/name,
+// rewriting the file with -update.
+func checkGolden(t *testing.T, name string, d []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+
+	if *update {
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(d)+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	golden := readGolden(t, name)
+	if !bytes.Equal(d, golden) {
+		t.Errorf("encoding differs from %s:\n got %x\nwant %x", path, d, golden)
+	}
+}
+
+func readGolden(t testing.TB, name string) []byte {
+	t.Helper()
+	s, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := hex.DecodeString(strings.TrimSpace(string(s)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func testBlock() Block {
+	b := NewBlock(bytes.Repeat([]byte{0x11}, 32))
+	b.Origin = bytes.Repeat([]byte{0x22}, NETWORK_KEY_SIZE)
+	b.Timestamp, b.Bits, b.Nonce = 1514764800, 0x2100ffff, 42
+	b.Signature = bytes.Repeat([]byte{0x33}, NETWORK_KEY_SIZE)
+
+	coinbase := Transaction{Header: TransactionHeader{Version: CONSENSUS_VERSION, Timestamp: 1514764800}}
+	coinbase.SetPayload(coinbasePayload(7))
+	coinbase.AddOutput(50*COIN, PayToKeyHash(bytes.Repeat([]byte{0x44}, ADDRESS_HASH_SIZE)))
+
+	b.AddTransaction(coinbase)
+	b.AddTransaction(testTransaction())
+	b.MerkelRoot = b.GenerateMerkelRoot()
+	return b
+}
+
+// roundTripBlock decodes the encoding of b and encodes the result again.
+func roundTripBlock(t *testing.T, b Block) {
+	t.Helper()
+	d, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := Block{}
+	if err := decoded.UnMarshalBinary(d); err != nil {
+		t.Fatal(err)
+	}
+	again, err := decoded.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(again, d) {
+		t.Errorf("encoding does not round trip:\n got %x\nwant %x", again, d)
+	}
+	if !bytes.Equal(decoded.Hash(), b.Hash()) {
+		t.Errorf("hash changes in the round trip")
+	}
+	if !bytes.Equal(decoded.GenerateMerkelRoot(), b.GenerateMerkelRoot()) {
+		t.Errorf("merkel root changes in the round trip")
+	}
+}
+
+// The genesis blocks pin down the encoding of blocks and transactions: a
+// change to the codec changes their hashes or breaks their round trip.
+func TestGenesisBlocks(t *testing.T) {
+	for _, p := range networks {
+		t.Run(p.Name, func(t *testing.T) {
+			if !bytes.Equal(p.Genesis.Hash(), p.GenesisHash) {
+				t.Errorf("genesis hash %x, want %x", p.Genesis.Hash(), p.GenesisHash)
+			}
+			if p.Genesis.Bits != p.InitialBits() {
+				t.Errorf("genesis bits %x, want %x", p.Genesis.Bits, p.InitialBits())
+			}
+			if !CheckProofOfWork(p.Genesis.Target(), p.Genesis.Hash()) {
+				t.Errorf("genesis proof of work fails")
+			}
+			roundTripBlock(t, p.Genesis)
+		})
+	}
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	empty := NewBlock(make([]byte, 32))
+	empty.Origin = bytes.Repeat([]byte{0x01}, NETWORK_KEY_SIZE)
+
+	single := testBlock()
+	ts := (*single.TransactionSlice)[:1]
+	single.TransactionSlice = &ts
+
+	many := testBlock()
+	for i := 0; i < 10; i++ {
+		tr := testTransaction()
+		tr.Header.Nonce = uint32(i)
+		many.AddTransaction(tr)
+	}
+
+	tests := []struct {
+		name  string
+		block Block
+	}{
+		{"no transactions", empty},
+		{"coinbase only", single},
+		{"coinbase and payment", testBlock()},
+		{"many transactions", many},
+		{"p224 version", func() Block { b := testBlock(); b.Version = SCHEME_P224; return b }()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roundTripBlock(t, tt.block)
+		})
+	}
+}
+
+func TestBlockUnMarshalRejects(t *testing.T) {
+	b := testBlock()
+	d, _ := b.MarshalBinary()
+
+	unknownVersion := append([]byte{}, d...)
+	unknownVersion[0] = 0xff
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated header", d[:BLOCK_HEADER_SIZE-1]},
+		{"truncated signature", d[:BLOCK_HEADER_SIZE+NETWORK_KEY_SIZE-1]},
+		{"truncated transaction", d[:len(d)-1]},
+		{"trailing byte", append(append([]byte{}, d...), 0)},
+		{"unknown version", unknownVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := new(Block).UnMarshalBinary(tt.data); err == nil {
+				t.Errorf("decoding succeeds")
+			}
+		})
+	}
+}
+
+// TestMerkelRootCoversScripts checks that a relay can't change the unlocking
+// scripts of a block without changing its hash.
+func TestMerkelRootCoversScripts(t *testing.T) {
+	b := testBlock()
+	root := b.GenerateMerkelRoot()
+
+	ts := append(TransactionSlice{}, *b.TransactionSlice...)
+	tr := ts[1]
+	tr.Inputs = append([]TransactionInput{}, tr.Inputs...)
+	tr.Inputs[0].Script = []byte{OP_1}
+	ts[1] = tr
+	b.TransactionSlice = &ts
+
+	original := testTransaction()
+	if !bytes.Equal(tr.Hash(), original.Hash()) {
+		t.Errorf("transaction hash covers the unlocking scripts")
+	}
+	if bytes.Equal(b.GenerateMerkelRoot(), root) {
+		t.Errorf("merkel root does not cover the unlocking scripts")
+	}
+}
+
+func TestVerifyBlockSize(t *testing.T) {
+	keypair := GenerateNewKeypair()
+	b := testMinedBlock(keypair)
+	d, _ := b.MarshalBinary()
+	room := BLOCK_MAX_SIZE - len(d)
+
+	payload := func(n int) Transaction {
+		return testSignedTransaction(keypair, keypair, func(tr *Transaction) { tr.SetPayload(make([]byte, n)) })
+	}
+	tr := payload(0)
+	td, _ := tr.MarshalBinary()
+	largest := room - len(td)
+
+	if b := testMinedBlock(keypair, payload(largest)); !b.VerifyBlock(RegTestParams.PowLimit) {
+		t.Errorf("block of BLOCK_MAX_SIZE bytes is refused")
+	}
+	if b := testMinedBlock(keypair, payload(largest+1)); b.VerifyBlock(RegTestParams.PowLimit) {
+		t.Errorf("block over BLOCK_MAX_SIZE bytes is accepted")
+	}
+}
+
+func TestBlockGolden(t *testing.T) {
+	b := testBlock()
+	d, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "block.golden", d)
+
+	decoded := Block{}
+	if err := decoded.UnMarshalBinary(readGolden(t, "block.golden")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Hash(), b.Hash()) {
+		t.Errorf("golden block hash %x, want %x", decoded.Hash(), b.Hash())
+	}
+}
+
+// FuzzBlockUnMarshal checks that decoding never panics and that whatever
+// decodes is the canonical encoding of the result.
+func FuzzBlockUnMarshal(f *testing.F) {
+	f.Add(readGolden(f, "block.golden"))
+	for _, p := range networks {
+		d, _ := p.Genesis.MarshalBinary()
+		f.Add(d)
+	}
+
+	f.Fuzz(func(t *testing.T, d []byte) {
+		b := Block{}
+		if err := b.UnMarshalBinary(d); err != nil {
+			return
+		}
+		again, err := b.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again, d) {
+			t.Errorf("decoded block encodes to\n%x\nnot\n%x", again, d)
+		}
+	})
+}
+
+// testMinedBlock is a regtest block of keypair holding a coinbase and txs,
+// ready to pass VerifyBlock.
+func testMinedBlock(keypair *Keypair, txs ...Transaction) Block {
+	b := NewBlock(bytes.Repeat([]byte{0x11}, 32))
+	b.Origin = keypair.Public
+	b.Timestamp, b.Bits = 1514764800, RegTestParams.InitialBits()
+
+	b.AddTransaction(*NewCoinbase(keypair, 1, 50*COIN, PayToKeyHash(KeyHash(keypair.Public))))
+	for _, t := range txs {
+		b.AddTransaction(t)
+	}
+	b.MerkelRoot = b.GenerateMerkelRoot()
+	b.Nonce = b.GenerateNounce()
+	b.Signature = b.Sign(keypair)
+	return b
+}
+
+// testSignedTransaction is a transaction of keypair, edited before signer
+// signs it.
+func testSignedTransaction(keypair, signer *Keypair, edit func(tr *Transaction)) Transaction {
+	tr := NewTransaction(keypair.Public, nil, []byte("payload"))
+	tr.Header.Version = keypair.Scheme
+	tr.AddInput(bytes.Repeat([]byte{0x77}, 32), 0)
+	tr.AddOutput(COIN, PayToKeyHash(KeyHash(keypair.Public)))
+	edit(tr)
+	tr.Header.Nonce = tr.GenerateNonce(TRANSACTION_POW)
+	tr.Signature = tr.Sign(signer)
+	return *tr
+}
+
+func TestVerifyBlockTransactions(t *testing.T) {
+	keypair := GenerateNewKeypair()
+	signed := func(signer *Keypair, edit func(tr *Transaction)) Transaction {
+		return testSignedTransaction(keypair, signer, edit)
+	}
+
+	tests := []struct {
+		name string
+		tr   Transaction
+		ok   bool
+	}{
+		{"valid", signed(keypair, func(tr *Transaction) {}), true},
+		{"unparseable output script", signed(keypair, func(tr *Transaction) { tr.Outputs[0].Script = []byte{OP_PUSHDATA1, 5} }), false},
+		{"payload hash", signed(keypair, func(tr *Transaction) { tr.Header.PayloadHash = make([]byte, 32) }), false},
+		{"forged from", signed(GenerateNewKeypair(), func(tr *Transaction) {}), false},
+		{"no proof of work", func() Transaction {
+			tr := signed(keypair, func(tr *Transaction) {})
+			for tr.Header.Nonce++; CheckProofOfWork(TRANSACTION_POW, tr.Hash()); tr.Header.Nonce++ {
+			}
+			tr.Signature = tr.Sign(keypair)
+			return tr
+		}(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testMinedBlock(keypair, tt.tr)
+			if b.VerifyBlock(RegTestParams.PowLimit) != tt.ok {
+				t.Errorf("VerifyBlock = %v, want %v", !tt.ok, tt.ok)
+			}
+		})
+	}
+}
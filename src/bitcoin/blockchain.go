@@ -1,8 +1,10 @@
 package bitcoin
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"log"
-	"reflect"
 	"time"
 )
 
@@ -11,161 +13,487 @@ type BlockChannel chan *Block
 type BlockChain struct {
 	CurrentBlock Block
 	BlockSlice
+	Store   *BlockStore
+	Tree    BlockTree
+	Tip     *BlockNode
+	UTXO    *UTXOSet
+	Mempool *Mempool
+	Miner   *Miner
 
 	TransactionChannel
 	BlockChannel
+	RequestChannel chan Message
+	QueryChannel   chan func()
+
+	orphans      map[string]*Block
+	orphanKids   map[string][]string
+	transactions map[string]int
+	undo         map[string][]UnspentOutput
+
+	interruptBlockGen chan Block
 }
 
-func SetupBlockChain() *BlockChain {
+func SetupBlockChain(dataDir string, workers int) *BlockChain {
 
 	bl := new(BlockChain)
 	bl.TransactionChannel, bl.BlockChannel = make(TransactionChannel), make(BlockChannel)
-
-	//Read blockchain from file and stuff...
-
-	bl.CurrentBlock = bl.CreateNewBlock()
+	bl.RequestChannel, bl.QueryChannel = make(chan Message), make(chan func())
+	bl.Tree = BlockTree{}
+	bl.orphans, bl.orphanKids = map[string]*Block{}, map[string][]string{}
+	bl.transactions = map[string]int{}
+	bl.UTXO, bl.undo = NewUTXOSet(), map[string][]UnspentOutput{}
+	bl.Mempool = NewMempool()
+	bl.Miner = NewMiner(workers)
+	bl.Miner.SetEnabled(!Params.OnDemandMining)
+
+	store, err := OpenBlockStore(dataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bl.Store = store
+	bl.LoadBlocks()
 
 	return bl
 }
 
 func (bl *BlockChain) CreateNewBlock() Block {
-	prevBlock := bl.BlockSlice.PreviousBlock()
-	prevBlockHash := []byte{}
+	b := NewBlock(bl.TipHash())
+	b.BlockHeader.Version = Core.Keypair.Scheme
+	b.BlockHeader.Origin = Core.Keypair.Public
+	b.BlockHeader.Bits = NextBits(bl.Tip)
+	// The earliest valid time, miners move it on to the current one
+	b.BlockHeader.Timestamp = MedianTimePast(bl.Tip) + 1
+
+	return b
+}
+
+// LoadBlocks replays the stored chain, dropping everything from the first
+// block that doesn't verify or doesn't link to its predecessor. A chain that
+// doesn't start with the genesis block of the network is dropped entirely,
+// and an empty chain gets the genesis block.
+func (bl *BlockChain) LoadBlocks() {
+
+	for i := 0; i < bl.Store.Height(); i++ {
+		b, err := bl.Store.Get(i)
+		if err != nil {
+			log.Println("Fail to read block", i, err)
+			break
+		}
+
+		if i == 0 && !bytes.Equal(b.Hash(), Params.GenesisHash) {
+			log.Println("Stored chain does not start with the", Params.Name, "genesis block")
+			break
+		}
+		if i > 0 && (!bl.Connects(*b) || !b.VerifyBlock(Params.PowLimit) || !CheckBlockContext(*b, bl.Tip)) {
+			log.Println("Stored block verification fails at height", i)
+			break
+		}
+
+		undo, err := bl.UTXO.ConnectBlock(*b, i)
+		if err != nil {
+			log.Println("Stored block transactions fail at height", i, err)
+			break
+		}
 
-	if prevBlock != nil {
-		prevBlockHash = prevBlock.Hash()
+		bl.BlockSlice = append(bl.BlockSlice, *b)
+		bl.indexTransactions(*b)
+		bl.Tip = bl.Tree.Add(*b)
+		bl.undo[string(bl.Tip.Hash)] = undo
 	}
 
-	b := NewBlock(prevBlockHash)
-	b.BlockHeader.Origin = Core.Keypair.Public
+	// New blocks are written after the loaded ones, so the store must not
+	// keep any block past them
+	if err := bl.Store.Truncate(len(bl.BlockSlice)); err != nil {
+		log.Fatal("Fail to truncate block store ", err)
+	}
 
-	return b
+	if len(bl.BlockSlice) == 0 {
+		if err := bl.AddBlock(Params.Genesis); err != nil {
+			log.Fatal(err)
+		}
+		bl.Tip = bl.Tree.Add(Params.Genesis)
+	}
+
+	log.Println("Loaded blocks:", len(bl.BlockSlice))
+}
+
+// CheckBlockContext checks the parts of b that depend on its parent.
+func CheckBlockContext(b Block, parent *BlockNode) bool {
+	if b.Bits != NextBits(parent) {
+		log.Println("Wrong block difficulty")
+		return false
+	}
+	if int64(b.Timestamp) > time.Now().Unix()+BLOCK_MAX_FUTURE_TIME {
+		log.Println("Block timestamp too far in the future")
+		return false
+	}
+	if parent != nil && b.Timestamp <= MedianTimePast(parent) {
+		log.Println("Block timestamp not after the median time of the past blocks")
+		return false
+	}
+	return true
+}
+
+// TipHash returns the hash of the last block.
+func (bl *BlockChain) TipHash() []byte {
+	return bl.Tip.Hash
+}
+
+func (bl *BlockChain) Connects(b Block) bool {
+	return bytes.Equal(FitBytes(b.PrevBlock, 32), bl.TipHash())
+}
+
+func (bl *BlockChain) indexTransactions(b Block) {
+	height := len(bl.BlockSlice) - 1
+	for _, t := range *b.TransactionSlice {
+		bl.transactions[string(t.Hash())] = height
+	}
+}
+
+// FindTransaction looks a transaction up in the mempool and the chain.
+func (bl *BlockChain) FindTransaction(hash []byte) *Transaction {
+	if t := bl.Mempool.Get(hash); t != nil {
+		return t
+	}
+
+	height, ok := bl.transactions[string(hash)]
+	if !ok {
+		return nil
+	}
+	return bl.BlockSlice[height].TransactionSlice.Find(hash)
 }
 
-func (bl *BlockChain) AddBlock(b Block) {
+// AddBlock applies the transactions of b to the UTXO set and appends it to
+// the active chain.
+func (bl *BlockChain) AddBlock(b Block) error {
+	undo, err := bl.UTXO.ConnectBlock(b, len(bl.BlockSlice))
+	if err != nil {
+		return err
+	}
+	bl.undo[string(FitBytes(b.Hash(), 32))] = undo
+
 	bl.BlockSlice = append(bl.BlockSlice, b)
+	bl.indexTransactions(b)
+
+	err = bl.Store.Put(b)
+	if err != nil {
+		log.Println("Fail to store block", err)
+	}
+	return nil
 }
 
-func (bl *BlockChain) Run() {
+// DisconnectBlock removes the last block of the active chain and returns it.
+func (bl *BlockChain) DisconnectBlock() Block {
+	l := len(bl.BlockSlice)
+	b := bl.BlockSlice[l-1]
+	bl.BlockSlice = bl.BlockSlice[:l-1]
 
-	interruptBlockGen := bl.GenerateBlocks()
+	hash := string(FitBytes(b.Hash(), 32))
+	bl.UTXO.DisconnectBlock(b, bl.undo[hash])
+	delete(bl.undo, hash)
 
-	for {
-		select {
-		case tr := <-bl.TransactionChannel:
-			if bl.CurrentBlock.TransactionSlice.Exists(*tr) {
-				continue
-			}
-			if !tr.VerifyTransaction(TRANSACTION_POW) {
-				log.Println("Received non valid transaction", tr)
-				continue
-			}
+	for _, t := range *b.TransactionSlice {
+		delete(bl.transactions, string(t.Hash()))
+	}
 
-			bl.CurrentBlock.AddTransaction(*tr)
-			interruptBlockGen <- bl.CurrentBlock
+	err := bl.Store.Truncate(l - 1)
+	if err != nil {
+		log.Println("Fail to truncate block store", err)
+	}
 
-			mes := NewMessage(MESSAGE_SEND_TRANSACTION)
-			mes.Data, _ = tr.MarshalBinary()
-			mes.From = tr.From
+	return b
+}
 
-			time.Sleep(300 * time.Millisecond)
-			Core.Network.BroadcastQueue <- *mes
+// IsActive reports whether node is part of the active chain.
+func (bl *BlockChain) IsActive(node *BlockNode) bool {
+	return node.Height < len(bl.BlockSlice) &&
+		bytes.Equal(FitBytes(bl.BlockSlice[node.Height].Hash(), 32), node.Hash)
+}
 
-		case b := <-bl.BlockChannel:
+// Reorganize makes the branch ending at node the active chain. Transactions
+// of disconnected blocks go back to the pending block unless the new branch
+// includes them. If a block of the branch doesn't apply, it is marked invalid
+// and the previous chain is restored. Only the transactions can fail to
+// apply, and the hash of the block commits to all of their bytes, so another
+// copy of the same block can't be valid.
+func (bl *BlockChain) Reorganize(node *BlockNode) bool {
+
+	branch := []*BlockNode{}
+	for n := node; n != nil && !bl.IsActive(n); n = n.Parent {
+		if n.Invalid {
+			node.Invalid = true
+			return false
+		}
+		branch = append(branch, n)
+	}
+	forkHeight := node.Height - len(branch)
 
-			if bl.BlockSlice.Exists(*b) {
-				log.Println("block exists")
-				continue
-			}
+	disconnected := BlockSlice{}
+	for len(bl.BlockSlice)-1 > forkHeight {
+		b := bl.DisconnectBlock()
+		log.Println("Disconnected block", b.Hash())
+		disconnected = append(disconnected, b)
+	}
+
+	for i := len(branch) - 1; i >= 0; i-- {
+		err := bl.AddBlock(branch[i].Block)
+		if err == nil {
+			continue
+		}
+
+		log.Println("Block transactions fail", branch[i].Hash, err)
+		for j := i; j >= 0; j-- {
+			branch[j].Invalid = true
+		}
+		for len(bl.BlockSlice)-1 > forkHeight {
+			bl.DisconnectBlock()
+		}
+		for j := len(disconnected) - 1; j >= 0; j-- {
+			bl.AddBlock(disconnected[j])
+		}
+		return false
+	}
 
-			if !b.VerifyBlock(BLOCK_POW) {
-				log.Println("block verification fails")
-				continue
+	for _, n := range branch {
+		bl.Mempool.RemoveBlock(n.Block)
+	}
+	for _, b := range disconnected {
+		for _, t := range (*b.TransactionSlice)[1:] {
+			fee, err := bl.UTXO.CheckTransaction(t, nil)
+			if err == nil {
+				bl.Mempool.Add(t, fee)
 			}
+		}
+	}
+	bl.Mempool.Revalidate(bl.UTXO)
+
+	bl.Tip = node
+	return true
+}
 
-			if reflect.DeepEqual(b.PrevBlock, bl.CurrentBlock.Hash()) {
-				log.Println("Missing blocks in between")
-			} else {
+// BlockTemplate builds the next block to mine from the mempool transactions
+// with the best fee rates and a coinbase paying the subsidy and their fees to
+// our key.
+func (bl *BlockChain) BlockTemplate() Block {
+	return bl.blockTemplate(PayToKeyHash(KeyHash(Core.Keypair.Public)))
+}
 
-				log.Println("New block!", b.Hash())
+func (bl *BlockChain) blockTemplate(script []byte) Block {
+	b := bl.CreateNewBlock()
 
-				transDiff := TransactionSlice{}
-				if !reflect.DeepEqual(b.BlockHeader.MerkelRoot, bl.CurrentBlock.MerkelRoot) {
-					// Transactions are different
-					log.Println("Transactions are different. finding diff")
-					transDiff = DiffTransactionSlices(*bl.CurrentBlock.TransactionSlice, *b.TransactionSlice)
-				}
+	height := len(bl.BlockSlice)
+	coinbase := NewCoinbase(Core.Keypair, height, 0, script)
+	cb, _ := coinbase.MarshalBinary()
+	header, _ := b.BlockHeader.MarshalBinary()
+
+	pending, fees := bl.Mempool.Select(BLOCK_MAX_SIZE - len(header) - NETWORK_KEY_SIZE - len(cb))
+	coinbase = NewCoinbase(Core.Keypair, height, BlockSubsidy(height)+fees, script)
+
+	ts := append(TransactionSlice{*coinbase}, pending...)
+	b.TransactionSlice = &ts
+	bl.CurrentBlock = b
 
-				bl.AddBlock(*b)
+	return b
+}
+
+func (bl *BlockChain) Run() {
 
-				mes := NewMessage(MESSAGE_SEND_BLOCK)
-				mes.Data, _ = b.MarshalBinary()
-				mes.From = b.From
-				Core.Network.BroadcastQueue <- *mes
+	interruptBlockGen := bl.GenerateBlocks()
+	bl.interruptBlockGen = interruptBlockGen
 
-				bl.CurrentBlock = bl.CreateNewBlock()
-				bl.CurrentBlock.TransactionSlice = &transDiff
+	for {
+		select {
+		case tr := <-bl.TransactionChannel:
+			if err := bl.ProcessTransaction(tr); err != nil {
+				log.Println("Received non valid transaction", err)
+			}
 
-				interruptBlockGen <- bl.CurrentBlock
+		case b := <-bl.BlockChannel:
+			bl.ProcessBlock(b)
+
+		case f := <-bl.QueryChannel:
+			f()
+
+		case msg := <-bl.RequestChannel:
+			switch msg.Identifier {
+			case MESSAGE_GET_BLOCK:
+				bl.HandleBlockRequest(msg)
+			case MESSAGE_GET_TRANSACTION:
+				bl.HandleTransactionRequest(msg)
+			case MESSAGE_INV_TRANSACTION:
+				bl.HandleTransactionAnnouncement(msg)
 			}
 		}
 	}
 }
 
-func DiffTransactionSlices(a, b TransactionSlice) (diff TransactionSlice) {
-	//Assumes transaction arrays are sorted (which maybe is too big of an assumption)
-	lastj := 0
-	for _, t := range a {
-		found := false
-		for j := lastj; j < len(b); j++ {
-			if reflect.DeepEqual(b[j].Signature, t.Signature) {
-				found = true
-				lastj = j
-				break
+// ProcessTransaction admits tr to the mempool, restarts mining with it and
+// announces it to the peers, which request it if they lack it. Transactions we already have are ignored. It must run on the
+// BlockChain goroutine.
+func (bl *BlockChain) ProcessTransaction(tr *Transaction) error {
+	if bl.Mempool.Exists(tr.Hash()) {
+		return nil
+	}
+	if _, ok := bl.transactions[string(tr.Hash())]; ok {
+		return nil
+	}
+	if !tr.VerifyTransaction(TRANSACTION_POW) {
+		return errors.New("Transaction verification fails")
+	}
+	fee, err := bl.UTXO.CheckTransaction(*tr, nil)
+	if err != nil {
+		return err
+	}
+	if err := bl.Mempool.Add(*tr, fee); err != nil {
+		return err
+	}
+
+	bl.interruptBlockGen <- bl.BlockTemplate()
+
+	mes := NewMessage(MESSAGE_INV_TRANSACTION)
+	mes.Data = FitBytes(tr.Hash(), 32)
+	mes.From = tr.From
+
+	time.Sleep(300 * time.Millisecond)
+	Core.Network.BroadcastQueue <- *mes
+	return nil
+}
+
+// ProcessBlock places b in the block tree, with the orphans waiting for it,
+// and connects the heaviest branch. It must run on the BlockChain goroutine.
+func (bl *BlockChain) ProcessBlock(b *Block) {
+	if bl.Tree.Exists(b.Hash()) {
+		log.Println("block exists")
+		return
+	}
+
+	if !b.VerifyBlock(Params.PowLimit) {
+		log.Println("block verification fails")
+		return
+	}
+
+	pending := []*Block{b}
+	for len(pending) > 0 {
+		b, pending = pending[0], pending[1:]
+		parent := bl.Tree.Get(b.PrevBlock)
+		if bytes.Equal(FitBytes(b.PrevBlock, 32), make([]byte, 32)) {
+			log.Println("Block of another genesis")
+			break
+		}
+		if parent == nil {
+			log.Println("Missing blocks in between")
+			if bl.AddOrphan(b) && !bl.IsOrphan(b.PrevBlock) {
+				bl.RequestBlocks(b.Peer, b.PrevBlock)
 			}
+			continue
+		}
+		if parent.Invalid {
+			log.Println("Block builds on an invalid block")
+			continue
+		}
+		if !CheckBlockContext(*b, parent) {
+			continue
+		}
+
+		node := bl.Tree.Add(*b)
+
+		if node.Heavier(bl.Tip) {
+			bl.ConnectBlock(node, bl.interruptBlockGen)
+		} else {
+			log.Println("Side branch block", node.Hash)
 		}
-		if !found {
-			diff = append(diff, t)
+		pending = append(pending, bl.NextOrphans(node.Hash)...)
+	}
+}
+
+// Generate mines n blocks on top of the tip with the pending transactions,
+// paying the coinbases to script, and returns their hashes. Blocks are
+// searched here rather than by the Miner, so this is only practical with the
+// trivial difficulty of regtest. It must run on the BlockChain goroutine.
+func (bl *BlockChain) Generate(n int, script []byte) ([][]byte, error) {
+	hashes := [][]byte{}
+	for i := 0; i < n; i++ {
+		b := bl.blockTemplate(script)
+		b.BlockHeader.MerkelRoot = b.GenerateMerkelRoot()
+		b.BlockHeader.Timestamp = blockTime(b.Timestamp)
+		b.BlockHeader.Nonce = b.GenerateNounce()
+		b.Signature = b.Sign(Core.Keypair)
+
+		bl.ProcessBlock(&b)
+		if !bytes.Equal(bl.TipHash(), b.Hash()) {
+			return hashes, errors.New("Generated block was not connected")
 		}
+		hashes = append(hashes, b.Hash())
+	}
+	return hashes, nil
+}
+
+// RefreshTemplate restarts mining on a new template. It must run on the
+// BlockChain goroutine.
+func (bl *BlockChain) RefreshTemplate() {
+	bl.interruptBlockGen <- bl.BlockTemplate()
+}
+
+// Do runs f on the BlockChain goroutine and waits for it to return.
+func (bl *BlockChain) Do(f func()) {
+	done := make(chan bool)
+	bl.QueryChannel <- func() {
+		f()
+		done <- true
+	}
+	<-done
+}
+
+func (bl *BlockChain) ConnectBlock(node *BlockNode, interruptBlockGen chan Block) {
+
+	log.Println("New block!", node.Hash)
+
+	if !bytes.Equal(FitBytes(node.PrevBlock, 32), bl.TipHash()) {
+		log.Println("Heavier branch found, reorganizing")
+	}
+	if !bl.Reorganize(node) {
+		return
 	}
 
-	return
+	mes := NewMessage(MESSAGE_SEND_BLOCK)
+	mes.Data, _ = node.Block.MarshalBinary()
+	mes.From = node.From
+	Core.Network.BroadcastQueue <- *mes
+
+	interruptBlockGen <- bl.BlockTemplate()
 }
 
+// GenerateBlocks mines every template sent on the returned channel, dropping
+// the previous job.
 func (bl *BlockChain) GenerateBlocks() chan Block {
 	interrupt := make(chan Block)
 
 	go func() {
-		block := <-interrupt
-	loop:
-		log.Println("Starting Proof of Work...")
-		block.BlockHeader.MerkelRoot = block.GenerateMerkelRoot()
-		block.BlockHeader.Nonce = 0
-		block.BlockHeader.Timestamp = uint32(time.Now().Unix())
-
-		for true {
-			sleepTime := time.Nanosecond
-			if block.TransactionSlice.Len() > 0 {
-				if CheckProofOfWork(BLOCK_POW, block.Hash()) {
-					block.Signature = block.Sign(Core.Keypair)
-					bl.BlockChannel <- &block
-					sleepTime = time.Hour * 24
-					log.Println("Found Block!!")
-				} else {
-					block.BlockHeader.Nonce += 1
-				}
-			} else {
-				sleepTime = time.Hour * 24
-				log.Println("No trans sleep")
-			}
+		cancel := func() {}
+		found := make(chan *Block)
 
+		for {
 			select {
-			case block = <-interrupt:
-				goto loop
-			case <-time.NewTimer(sleepTime).C:
-				continue
-			}
+			case block := <-interrupt:
+				cancel()
+				if !bl.Miner.Enabled() {
+					continue
+				}
+				if block.TransactionSlice.Len() <= 1 {
+					log.Println("No trans sleep")
+					continue
+				}
 
+				log.Println("Starting Proof of Work...")
+				var ctx context.Context
+				ctx, cancel = context.WithCancel(context.Background())
+				go bl.Miner.Mine(ctx, block, found)
+
+			case block := <-found:
+				go func() {
+					bl.BlockChannel <- block
+				}()
+			}
 		}
 	}()
 	return interrupt
@@ -1,34 +1,184 @@
 package bitcoin
 
 const (
-	BLOCKCHAIN_DEFAULT_PORT = 9200
+	BLOCKCHAIN_DEFAULT_DATA_DIR = "data"
+
+	EXPLORER_RECENT_BLOCKS = 20
+	EXPLORER_HISTORY_SIZE  = 100
+
+	BLOCKSTORE_BLOCKS_FILE      = "blocks.dat"
+	BLOCKSTORE_INDEX_FILE       = "index.dat"
+	BLOCKSTORE_INDEX_ENTRY_SIZE = 32 /* block hash */ +
+		8 /* int64 offset */ +
+		4 /* int32 length */
+
+	WALLET_FILE      = "wallet.dat"
+	WALLET_MAGIC     = 0x574c5433
+	WALLET_SALT_SIZE = 16
+	WALLET_SCRYPT_N  = 1 << 15
+	WALLET_SCRYPT_R  = 8
+	WALLET_SCRYPT_P  = 1
+
+	// Bounds on the scrypt parameters read from a wallet file, so that a
+	// crafted file can't make unlocking it take all the memory or time.
+	WALLET_SCRYPT_MAX_N      = 1 << 20
+	WALLET_SCRYPT_MAX_R      = 16
+	WALLET_SCRYPT_MAX_P      = 16
+	WALLET_SCRYPT_MAX_MEMORY = 1 << 30
+
+	WALLET_RECEIVE_PATH = "m/0'/0"
+	WALLET_CHANGE_PATH  = "m/0'/1"
+	WALLET_GAP_LIMIT    = 20
+
+	MNEMONIC_ENTROPY_SIZE = 16
+
+	HD_HARDENED          = 0x80000000
+	HD_EXTENDED_KEY_SIZE = 4 /* int32 version */ +
+		1 /* depth */ +
+		4 /* parent fingerprint */ +
+		4 /* int32 child index */ +
+		32 /* chain code */ +
+		33 /* key */
+
+	PSBT_MAGIC = 0x50534254
 
 	NETWORK_KEY_SIZE = 80
 
-	TRANSACTION_HEADER_SIZE = NETWORK_KEY_SIZE /* from key */ +
+	// The version of blocks and transactions names their signature scheme
+	SCHEME_P224       = 1
+	SCHEME_SECP256K1  = 2
+	CONSENSUS_VERSION = SCHEME_SECP256K1
+
+	ADDRESS_HASH_SIZE = 20
+
+	TRANSACTION_HEADER_SIZE = 4 /* int32 version */ +
+		NETWORK_KEY_SIZE /* from key */ +
 		NETWORK_KEY_SIZE /* to key */ +
 		4 /* int32 timestamp */ +
 		32 /* sha256 payload hash */ +
 		4 /* int32 payload length */ +
-		4 /* int32 nonce */
+		4 /* int32 nonce */ +
+		4 /* int32 input count */ +
+		4 /* int32 output count */ +
+		4 /* int32 lock time */
 
-	BLOCK_HEADER_SIZE = NETWORK_KEY_SIZE /* origin key */ +
-		4 /* int32 timestamp */ +
+	// Inputs and outputs are followed by their script
+	TRANSACTION_INPUT_SIZE = 32 /* previous transaction hash */ +
+		4 /* int32 output index */ +
+		2 /* int16 unlocking script length */
+
+	TRANSACTION_OUTPUT_SIZE = 8 /* int64 amount */ +
+		2 /* int16 locking script length */
+
+	SCRIPT_MAX_SIZE          = 10000
+	SCRIPT_MAX_ELEMENT_SIZE  = 520
+	SCRIPT_MAX_STACK_SIZE    = 1000
+	SCRIPT_MAX_OPS           = 201
+	SCRIPT_MAX_MULTISIG_KEYS = 20
+
+	// Lock times below are block heights, above unix times
+	LOCKTIME_THRESHOLD = 500000000
+
+	BLOCK_HEADER_SIZE = 4 /* int32 version */ +
+		NETWORK_KEY_SIZE /* origin key */ +
 		32 /* prev block hash */ +
 		32 /* merkel tree hash */ +
+		4 /* int32 timestamp */ +
+		4 /* int32 bits */ +
 		4 /* int32 nonce */
 
 	KEY_POW_COMPLEXITY         = 0
-	BLOCK_POW_COMPLEXITY       = 2
 	TRANSACTION_POW_COMPLEXITY = 1
 
-	POW_PREFIX = 0
+	BLOCK_MAX_FUTURE_TIME = 2 * 60 * 60 /* seconds */
+	// A block must be later than the median time of this many blocks before
+	BLOCK_MEDIAN_TIME_SPAN = 11
+
+	BLOCK_MAX_SIZE = 1000000
+
+	MEMPOOL_MAX_SIZE = 32 * 1000000
+	MEMPOOL_MAX_AGE  = 24 * 60 * 60 /* seconds */
+
+	MINER_CHECK_INTERVAL = 1 << 12
+	GENERATE_MAX_BLOCKS  = 1000
+	COINBASE_MAX_PAYLOAD = 100
+
+	COIN = 100000000
+
+	// Genesis blocks are built by genesisBlock, these pin them down
+	GENESIS_MESSAGE       = "Bitcoin-go genesis block"
+	GENESIS_MAINNET_NONCE = 20174
+	GENESIS_MAINNET_HASH  = "00007824eb8f42af4fd9ef4c08798c5358784962e9b03df4b70653f99d9999e0"
+	GENESIS_TESTNET_NONCE = 412
+	GENESIS_TESTNET_HASH  = "00dbb106bd27c25c0ddf87809cf05b0950f4a1a78011dbb55a9386c65f0687b6"
+	GENESIS_REGTEST_NONCE = 0
+	GENESIS_REGTEST_HASH  = "7840e94d37fa70fde8600df12e4ee6baaadd8df1a331665be0313fa1324bcbb5"
 
 	KEY_SIZE = 28
 	IP_SIZE  = 21
 
+	MESSAGE_FORMAT       = 1
 	MESSAGE_TYPE_SIZE    = 1
 	MESSAGE_OPTIONS_SIZE = 4
+	MESSAGE_HEADER_SIZE  = 1 /* format */ +
+		MESSAGE_TYPE_SIZE +
+		IP_SIZE /* sender address */ +
+		MESSAGE_OPTIONS_SIZE
+
+	MESSAGE_FRAME_SIZE = 4 /* int32 magic */ +
+		4 /* int32 body length */ +
+		4 /* sha256 checksum prefix */
+	MESSAGE_MAX_SIZE = 32 * 1024 * 1024
+
+	BLOCK_REQUEST_SIZE = 32 /* block hash */ +
+		4 /* int32 height */ +
+		4 /* int32 count */
+	BLOCK_SYNC_BATCH  = 500
+	BLOCK_MAX_ORPHANS = 100 /* of at most BLOCK_MAX_SIZE bytes each */
+
+	// Peers older than PROTOCOL_MIN_VERSION are refused in the handshake
+	PROTOCOL_VERSION     = 1
+	PROTOCOL_MIN_VERSION = 1
+	USER_AGENT           = "/bitcoin-go:1/"
+	USER_AGENT_MAX_SIZE  = 255
+	HANDSHAKE_TIMEOUT    = 10 /* seconds */
+	VERSION_MESSAGE_SIZE = 4 /* int32 protocol version */ +
+		8 /* int64 services */ +
+		4 /* int32 best height */ +
+		8 /* int64 nonce */ +
+		IP_SIZE /* listening address */ +
+		1 /* user agent length */
+
+	// Services a node offers, as a bitmask
+	SERVICE_NETWORK = 1 << 0 /* serves the full chain */
+
+	NODES_GOSSIP_INTERVAL  = 60 /* seconds */
+	NODES_MAX_ADDRESSES    = 1000
+	NODES_MAX_OUTBOUND     = 8
+	NODES_CONNECT_INTERVAL = 10 /* seconds */
+	NODES_SEND_QUEUE       = 64 /* replies waiting for the writer of a node */
+
+	// The address book lives in the data directory. New addresses from one
+	// network of senders fit in ADDRESS_BUCKETS_PER_GROUP new buckets, and
+	// reached addresses of one network in as many tried buckets.
+	PEERS_FILE                = "peers.dat"
+	PEERS_MAGIC               = 0x50454552
+	ADDRESS_NEW_BUCKETS       = 64
+	ADDRESS_TRIED_BUCKETS     = 16
+	ADDRESS_BUCKETS_PER_GROUP = 4
+	ADDRESS_BUCKET_SIZE       = 32
+	ADDRESS_SELECT_TRIES      = 200
+	ADDRESS_RETRY_INTERVAL    = 60                /* seconds */
+	ADDRESS_MAX_AGE           = 30 * 24 * 60 * 60 /* seconds */
+	ADDRESS_MAX_RETRIES       = 3                 /* without any success */
+	ADDRESS_MAX_FAILURES      = 10
+	ADDRESS_ENTRY_SIZE        = IP_SIZE /* address */ +
+		IP_SIZE /* source */ +
+		4 /* int32 last seen */ +
+		4 /* int32 last attempt */ +
+		4 /* int32 last success */ +
+		4 /* int32 failures */ +
+		1 /* tried */
 )
 
 const (
@@ -40,4 +190,22 @@ const (
 
 	MESSAGE_GET_BLOCK
 	MESSAGE_SEND_BLOCK
+
+	MESSAGE_VERSION
+	MESSAGE_VERACK
+
+	// Hashes of new transactions, which peers lacking them fetch with
+	// MESSAGE_GET_TRANSACTION
+	MESSAGE_INV_TRANSACTION
+)
+
+const (
+	// The RPC server takes HTTP basic auth with the user RPC_COOKIE_USER and
+	// a password written to RPC_COOKIE_FILE in the data directory
+	RPC_COOKIE_FILE = ".cookie"
+	RPC_COOKIE_USER = "__cookie__"
+
+	RPC_PARSE_ERROR      = -32700
+	RPC_METHOD_NOT_FOUND = -32601
+	RPC_INVALID_PARAMS   = -32602
 )
@@ -4,71 +4,147 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"errors"
 	"log"
 	"math/big"
 )
 
+// Keypair is a key of the signature scheme Scheme, one of the SCHEME_*
+// constants.
 type Keypair struct {
+	Scheme  uint32
 	Public  []byte
 	Private []byte
 }
 
-func GenerateNewKeypair() *Keypair {
-	pk, _ := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+// SignatureScheme is a way of signing hashes. Blocks and transactions record
+// the one they use in their Version.
+type SignatureScheme interface {
+	GenerateKey() (*Keypair, error)
+	FromPrivate(private []byte) (*Keypair, error)
+	Sign(private, hash []byte) ([]byte, error)
+	Verify(public, sig, hash []byte) bool
+}
+
+var signatureSchemes = map[uint32]SignatureScheme{
+	SCHEME_P224:      p224Scheme{},
+	SCHEME_SECP256K1: secp256k1Scheme{},
+}
+
+func GetSignatureScheme(scheme uint32) (SignatureScheme, error) {
+	s, ok := signatureSchemes[scheme]
+	if !ok {
+		return nil, errors.New("Unknown signature scheme")
+	}
+	return s, nil
+}
 
-	public := append(pk.PublicKey.X.Bytes(), pk.PublicKey.Y.Bytes()...)
-	private := pk.D.Bytes()
-	kp := Keypair{Public: public, Private: private}
+// GenerateNewKeypair creates a key of the scheme of CONSENSUS_VERSION.
+func GenerateNewKeypair() *Keypair {
+	kp, err := signatureSchemes[CONSENSUS_VERSION].GenerateKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return kp
+}
 
-	log.Println("Public key: ", kp.Public)
-	log.Println("Private key: ", kp.Private)
-	return &kp
+// KeypairFromPrivate recomputes the public key of private.
+func KeypairFromPrivate(scheme uint32, private []byte) (*Keypair, error) {
+	s, err := GetSignatureScheme(scheme)
+	if err != nil {
+		return nil, err
+	}
+	return s.FromPrivate(private)
 }
 
 func (k *Keypair) Sign(hash []byte) ([]byte, error) {
-	d := new(big.Int)
-	d.SetBytes(k.Private)
+	s, err := GetSignatureScheme(k.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	return s.Sign(k.Private, hash)
+}
 
-	pk := new(big.Int)
-	pk.SetBytes(k.Public)
+func SignatureVerify(scheme uint32, publicKey, sig, hash []byte) bool {
+	s, err := GetSignatureScheme(scheme)
+	if err != nil {
+		return false
+	}
+	return s.Verify(publicKey, sig, hash)
+}
 
-	pub := splitKey(pk, 2)
-	x, y := pub[0], pub[1]
+// fixedWidth returns the last size bytes of d, which are left padded with
+// zeros on the wire, or nil if d does not fit.
+func fixedWidth(d []byte, size int) []byte {
+	if len(d) <= size {
+		return FitBytes(d, size)
+	}
+	for _, b := range d[:len(d)-size] {
+		if b != 0 {
+			return nil
+		}
+	}
+	return d[len(d)-size:]
+}
 
-	key := ecdsa.PrivateKey{ecdsa.PublicKey{elliptic.P224(), x, y}, d}
+// p224Scheme is the original ECDSA over P-224. Public keys are X||Y and
+// signatures r||s, each number on 28 bytes.
+type p224Scheme struct{}
 
-	r, s, _ := ecdsa.Sign(rand.Reader, &key, hash)
+const p224Size = 28
 
-	return append(r.Bytes(), s.Bytes()...), nil
+func (p224Scheme) GenerateKey() (*Keypair, error) {
+	pk, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return p224Scheme{}.FromPrivate(pk.D.Bytes())
 }
 
-func SignatureVerify(publicKey, sig, hash []byte) bool {
-	b := new(big.Int)
-	b.SetBytes(sig)
-	bSplit := splitKey(b, 2)
-	r, s := bSplit[0], bSplit[1]
+func (p224Scheme) FromPrivate(private []byte) (*Keypair, error) {
+	curve := elliptic.P224()
+	d := new(big.Int).SetBytes(private)
+	if d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+		return nil, errors.New("Invalid private key")
+	}
 
-	b = new(big.Int)
-	b.SetBytes(publicKey)
-	pkSplit := splitKey(b, 2)
-	x, y := pkSplit[0], pkSplit[1]
+	x, y := curve.ScalarBaseMult(d.Bytes())
+	public := append(x.FillBytes(make([]byte, p224Size)), y.FillBytes(make([]byte, p224Size))...)
+	return &Keypair{Scheme: SCHEME_P224, Public: public, Private: d.FillBytes(make([]byte, p224Size))}, nil
+}
 
-	pub := ecdsa.PublicKey{elliptic.P224(), x, y}
+func (p224Scheme) Sign(private, hash []byte) ([]byte, error) {
+	kp, err := p224Scheme{}.FromPrivate(private)
+	if err != nil {
+		return nil, err
+	}
 
-	return ecdsa.Verify(&pub, hash, r, s)
+	key := &ecdsa.PrivateKey{PublicKey: p224PublicKey(kp.Public), D: new(big.Int).SetBytes(private)}
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash)
+	if err != nil {
+		return nil, err
+	}
+	return append(r.FillBytes(make([]byte, p224Size)), s.FillBytes(make([]byte, p224Size))...), nil
 }
 
-func splitKey(n *big.Int, parts int) []*big.Int {
-	bs := n.Bytes()
-	if len(bs)%2 == 1 {
-		bs = append([]byte{0}, bs...)
+func (p224Scheme) Verify(public, sig, hash []byte) bool {
+	public, sig = fixedWidth(public, 2*p224Size), fixedWidth(sig, 2*p224Size)
+	if public == nil || sig == nil {
+		return false
 	}
 
-	l := len(bs) / parts
-	as := make([]*big.Int, parts)
+	pub := p224PublicKey(public)
+	if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+		return false
+	}
+	r, s := new(big.Int).SetBytes(sig[:p224Size]), new(big.Int).SetBytes(sig[p224Size:])
+	return ecdsa.Verify(&pub, hash, r, s)
+}
 
-	for i, _ := range as {
-		as[i] = new(big.Int).SetBytes(bs[l*i : l*(i+1)])
+func p224PublicKey(public []byte) ecdsa.PublicKey {
+	return ecdsa.PublicKey{
+		Curve: elliptic.P224(),
+		X:     new(big.Int).SetBytes(public[:p224Size]),
+		Y:     new(big.Int).SetBytes(public[p224Size:]),
 	}
-	return as
 }
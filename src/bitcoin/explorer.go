@@ -0,0 +1,487 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The explorer is a read-only web view of the node: recent blocks, blocks,
+// transactions, addresses and peers. Pages are built on the BlockChain and
+// Network goroutines with Do, like the JSON-RPC handlers.
+
+type explorerBlock struct {
+	RPCBlock
+	Size         int
+	Transactions []explorerTransaction
+}
+
+type explorerInput struct {
+	RPCInput
+	Amount  uint64
+	Address string
+	Known   bool
+}
+
+type explorerTransaction struct {
+	RPCTransaction
+	Height   int
+	Inputs   []explorerInput
+	Coinbase bool
+	Total    uint64
+}
+
+type explorerHistory struct {
+	Hash      string
+	Height    int
+	Timestamp uint32
+	Received  uint64
+	Sent      uint64
+}
+
+type explorerAddress struct {
+	Address  string
+	KeyHash  string
+	Balance  uint64
+	Unspent  []RPCUnspent
+	History  []explorerHistory
+	Received uint64
+	Sent     uint64
+}
+
+type explorerHome struct {
+	Height  int
+	Bits    string
+	Mempool int
+	Peers   int
+	Blocks  []RPCBlock
+}
+
+func StartExplorer(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", explorerHomePage)
+	mux.HandleFunc("/block/", explorerBlockPage)
+	mux.HandleFunc("/tx/", explorerTransactionPage)
+	mux.HandleFunc("/address/", explorerAddressPage)
+	mux.HandleFunc("/peers", explorerPeersPage)
+	mux.HandleFunc("/search", explorerSearch)
+
+	server := &http.Server{
+		Addr:         address,
+		Handler:      mux,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	go func() {
+		log.Println("Explorer listening in", address)
+		err := server.ListenAndServe()
+		if err != nil {
+			log.Println("Explorer: ", err)
+		}
+	}()
+}
+
+func explorerRender(w http.ResponseWriter, status int, page string, data interface{}) {
+	buf := &bytes.Buffer{}
+	if err := explorerTemplates.ExecuteTemplate(buf, page, data); err != nil {
+		log.Println("Explorer:", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+func explorerNotFound(w http.ResponseWriter, what string) {
+	explorerRender(w, http.StatusNotFound, "notfound", what)
+}
+
+func explorerHomePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		explorerNotFound(w, "Page")
+		return
+	}
+
+	home := explorerHome{Blocks: []RPCBlock{}}
+	Core.BlockChain.Do(func() {
+		bl := Core.BlockChain
+		tip := len(bl.BlockSlice) - 1
+		home.Height = tip
+		home.Bits = strconv.FormatUint(uint64(NextBits(bl.Tip)), 16)
+		for h := tip; h >= 0 && h > tip-EXPLORER_RECENT_BLOCKS; h-- {
+			home.Blocks = append(home.Blocks, toRPCBlock(bl.BlockSlice[h], h, tip))
+		}
+	})
+	home.Mempool = Core.BlockChain.Mempool.Len()
+	Core.Network.Do(func() {
+		home.Peers = len(Core.Network.Nodes)
+	})
+
+	explorerRender(w, http.StatusOK, "home", home)
+}
+
+// explorerBlockPage shows /block/<hash or height>.
+func explorerBlockPage(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/block/")
+
+	var eb *explorerBlock
+	Core.BlockChain.Do(func() {
+		bl := Core.BlockChain
+		tip := len(bl.BlockSlice) - 1
+
+		var node *BlockNode
+		if height, err := strconv.Atoi(id); err == nil && height >= 0 && height <= tip {
+			node = bl.Tree.Get(bl.BlockSlice[height].Hash())
+		} else if hash, err := hex.DecodeString(id); err == nil {
+			node = bl.Tree.Get(hash)
+		}
+		if node == nil {
+			return
+		}
+
+		b := node.Block
+		eb = &explorerBlock{RPCBlock: toRPCBlock(b, node.Height, tip)}
+		if !bl.IsActive(node) {
+			eb.Confirmations = 0
+		}
+		if d, err := b.MarshalBinary(); err == nil {
+			eb.Size = len(d)
+		}
+		for _, t := range *b.TransactionSlice {
+			eb.Transactions = append(eb.Transactions, toExplorerTransaction(bl, t))
+		}
+	})
+
+	if eb == nil {
+		explorerNotFound(w, "Block")
+		return
+	}
+	explorerRender(w, http.StatusOK, "block", eb)
+}
+
+// toExplorerTransaction resolves the outputs t spends. It must run on the
+// BlockChain goroutine.
+func toExplorerTransaction(bl *BlockChain, t Transaction) explorerTransaction {
+	hash := t.Hash()
+	et := explorerTransaction{RPCTransaction: toRPCTransaction(t), Height: -1, Coinbase: t.IsCoinbase()}
+	if height, ok := bl.transactions[string(hash)]; ok {
+		et.Height = height
+		et.BlockHash = hex.EncodeToString(bl.BlockSlice[height].Hash())
+		et.Confirmations = len(bl.BlockSlice) - height
+	}
+
+	for i, in := range t.Inputs {
+		ei := explorerInput{RPCInput: et.RPCTransaction.Inputs[i]}
+		if prev := bl.FindTransaction(in.PrevTransaction); prev != nil && int(in.Index) < len(prev.Outputs) {
+			out := prev.Outputs[in.Index]
+			ei.Known, ei.Amount = true, out.Amount
+			if keyHash := out.KeyHash(); keyHash != nil {
+				ei.Address = EncodeAddress(keyHash)
+			}
+		}
+		et.Inputs = append(et.Inputs, ei)
+	}
+	for _, out := range t.Outputs {
+		et.Total += out.Amount
+	}
+	return et
+}
+
+func explorerTransactionPage(w http.ResponseWriter, r *http.Request) {
+	hash, err := hex.DecodeString(strings.TrimPrefix(r.URL.Path, "/tx/"))
+	if err != nil {
+		explorerNotFound(w, "Transaction")
+		return
+	}
+
+	var et *explorerTransaction
+	Core.BlockChain.Do(func() {
+		bl := Core.BlockChain
+		if t := bl.FindTransaction(hash); t != nil {
+			e := toExplorerTransaction(bl, *t)
+			et = &e
+		}
+	})
+
+	if et == nil {
+		explorerNotFound(w, "Transaction")
+		return
+	}
+	explorerRender(w, http.StatusOK, "transaction", et)
+}
+
+// explorerAddressPage shows the balance of an address and the transactions
+// of the active chain paying it or spending from it, newest first.
+func explorerAddressPage(w http.ResponseWriter, r *http.Request) {
+	address := strings.TrimPrefix(r.URL.Path, "/address/")
+	keyHash, err := DecodeAddress(address)
+	if err != nil {
+		explorerNotFound(w, "Address")
+		return
+	}
+
+	ea := explorerAddress{Address: address, KeyHash: hex.EncodeToString(keyHash), Unspent: []RPCUnspent{}}
+	for _, uo := range Core.BlockChain.UTXO.Unspent(keyHash) {
+		ea.Unspent = append(ea.Unspent, RPCUnspent{hex.EncodeToString(uo.Transaction), uo.Index, uo.Amount})
+		ea.Balance += uo.Amount
+	}
+
+	// Only the list of blocks is copied on the chain goroutine: accepted
+	// blocks don't change, and scanning them there would hold up consensus.
+	var blocks BlockSlice
+	Core.BlockChain.Do(func() {
+		blocks = append(blocks, Core.BlockChain.BlockSlice...)
+	})
+
+	received := map[string]uint64{}
+	for height, b := range blocks {
+		for _, t := range *b.TransactionSlice {
+			hash := t.Hash()
+			entry := explorerHistory{Hash: hex.EncodeToString(hash), Height: height, Timestamp: b.Timestamp}
+
+			for _, in := range t.Inputs {
+				k := OutPoint{in.PrevTransaction, in.Index}.key()
+				if amount, ok := received[k]; ok {
+					entry.Sent += amount
+					delete(received, k)
+				}
+			}
+			for i, out := range t.Outputs {
+				if bytes.Equal(out.KeyHash(), keyHash) {
+					entry.Received += out.Amount
+					received[OutPoint{hash, uint32(i)}.key()] = out.Amount
+				}
+			}
+
+			if entry.Received > 0 || entry.Sent > 0 {
+				ea.Received += entry.Received
+				ea.Sent += entry.Sent
+				ea.History = append(ea.History, entry)
+			}
+		}
+	}
+
+	for i, j := 0, len(ea.History)-1; i < j; i, j = i+1, j-1 {
+		ea.History[i], ea.History[j] = ea.History[j], ea.History[i]
+	}
+	if len(ea.History) > EXPLORER_HISTORY_SIZE {
+		ea.History = ea.History[:EXPLORER_HISTORY_SIZE]
+	}
+	explorerRender(w, http.StatusOK, "address", ea)
+}
+
+func explorerPeersPage(w http.ResponseWriter, r *http.Request) {
+	peers := []RPCPeer{}
+	Core.Network.Do(func() {
+		for _, node := range Core.Network.Nodes {
+			peers = append(peers, toRPCPeer(node))
+		}
+	})
+	explorerRender(w, http.StatusOK, "peers", peers)
+}
+
+// explorerSearch redirects to the page of a height, hash or address.
+func explorerSearch(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	target := ""
+	if _, err := strconv.Atoi(q); err == nil {
+		target = "/block/" + q
+	} else if _, err := DecodeAddress(q); err == nil {
+		target = "/address/" + q
+	} else if hash, err := hex.DecodeString(q); err == nil && len(hash) == 32 {
+		target = "/tx/" + q
+		Core.BlockChain.Do(func() {
+			if Core.BlockChain.Tree.Exists(hash) {
+				target = "/block/" + q
+			}
+		})
+	}
+
+	if target == "" {
+		explorerNotFound(w, "Nothing matching "+q)
+		return
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+var explorerTemplates = template.Must(template.New("explorer").Funcs(template.FuncMap{
+	"coins": func(amount uint64) string {
+		return fmt.Sprintf("%d.%08d", amount/COIN, amount%COIN)
+	},
+	"time": func(timestamp interface{}) string {
+		var t int64
+		switch v := timestamp.(type) {
+		case uint32:
+			t = int64(v)
+		case int:
+			t = int64(v)
+		}
+		return time.Unix(t, 0).UTC().Format("2006-01-02 15:04:05")
+	},
+	"short": func(s string) string {
+		if len(s) > 16 {
+			return s[:16] + "…"
+		}
+		return s
+	},
+	// payload shows messages as text and anything else, like coinbase
+	// payloads, as hex
+	"payload": func(s string) string {
+		for _, r := range s {
+			if r == utf8.RuneError || !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+				return hex.EncodeToString([]byte(s))
+			}
+		}
+		return s
+	},
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.}} - Bitcoin-go explorer</title>
+<style>
+body { font-family: sans-serif; margin: 0 auto; max-width: 1100px; padding: 0 1em; color: #222; }
+nav { display: flex; gap: 1.5em; align-items: center; padding: 1em 0; border-bottom: 1px solid #ddd; }
+nav form { margin-left: auto; }
+nav input { width: 28em; }
+table { border-collapse: collapse; width: 100%; margin: 1em 0; }
+th, td { text-align: left; padding: 0.3em 0.6em; border-bottom: 1px solid #eee; vertical-align: top; }
+th { background: #f6f6f6; }
+td.amount, th.amount { text-align: right; }
+.hash { font-family: monospace; word-break: break-all; }
+.script { font-family: monospace; font-size: 0.85em; color: #555; word-break: break-all; }
+</style>
+</head>
+<body>
+<nav>
+<a href="/"><b>Explorer</b></a>
+<a href="/peers">Peers</a>
+<form action="/search"><input name="q" placeholder="Height, block or transaction hash, address"></form>
+</nav>
+<h2>{{.}}</h2>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "notfound"}}{{template "header" "Not found"}}
+<p>{{.}} not found.</p>
+{{template "footer"}}{{end}}
+
+{{define "home"}}{{template "header" "Recent blocks"}}
+<p>Height {{.Height}} · next bits {{.Bits}} · {{.Mempool}} pending transactions · <a href="/peers">{{.Peers}} peers</a></p>
+<table>
+<tr><th>Height</th><th>Hash</th><th>Time (UTC)</th><th>Transactions</th><th>Origin</th></tr>
+{{range .Blocks}}<tr>
+<td><a href="/block/{{.Height}}">{{.Height}}</a></td>
+<td class="hash"><a href="/block/{{.Hash}}">{{.Hash}}</a></td>
+<td>{{time .Timestamp}}</td>
+<td>{{len .Transactions}}</td>
+<td><a href="/address/{{.Origin}}">{{short .Origin}}</a></td>
+</tr>{{else}}<tr><td colspan="5">No blocks yet</td></tr>{{end}}
+</table>
+{{template "footer"}}{{end}}
+
+{{define "block"}}{{template "header" (printf "Block %d" .Height)}}
+<table>
+<tr><th>Hash</th><td class="hash">{{.Hash}}</td></tr>
+<tr><th>Previous block</th><td class="hash">{{if gt .Height 0}}<a href="/block/{{.PrevBlock}}">{{.PrevBlock}}</a>{{else}}{{.PrevBlock}}{{end}}</td></tr>
+<tr><th>Merkel root</th><td class="hash">{{.MerkelRoot}}</td></tr>
+<tr><th>Version</th><td>{{.Version}}</td></tr>
+<tr><th>Time (UTC)</th><td>{{time .Timestamp}}</td></tr>
+<tr><th>Bits</th><td>{{.Bits}}</td></tr>
+<tr><th>Nonce</th><td>{{.Nonce}}</td></tr>
+<tr><th>Origin</th><td><a href="/address/{{.Origin}}">{{.Origin}}</a></td></tr>
+<tr><th>Confirmations</th><td>{{.Confirmations}}</td></tr>
+<tr><th>Size</th><td>{{.Size}} bytes</td></tr>
+</table>
+<h3>Transactions</h3>
+<table>
+<tr><th>Hash</th><th>Inputs</th><th>Outputs</th><th class="amount">Total</th></tr>
+{{range .Transactions}}<tr>
+<td class="hash"><a href="/tx/{{.Hash}}">{{.Hash}}</a>{{if .Coinbase}} (coinbase){{end}}</td>
+<td>{{len .Inputs}}</td>
+<td>{{len .Outputs}}</td>
+<td class="amount">{{coins .Total}}</td>
+</tr>{{end}}
+</table>
+{{template "footer"}}{{end}}
+
+{{define "transaction"}}{{template "header" "Transaction"}}
+<table>
+<tr><th>Hash</th><td class="hash">{{.Hash}}</td></tr>
+<tr><th>Block</th><td class="hash">{{if ge .Height 0}}<a href="/block/{{.BlockHash}}">{{.Height}}</a> ({{.Confirmations}} confirmations){{else}}Pending{{end}}</td></tr>
+<tr><th>Version</th><td>{{.Version}}</td></tr>
+<tr><th>From</th><td><a href="/address/{{.From}}">{{.From}}</a></td></tr>
+<tr><th>Time (UTC)</th><td>{{time .Timestamp}}</td></tr>
+{{if .LockTime}}<tr><th>Lock time</th><td>{{.LockTime}}</td></tr>{{end}}
+{{if .Payload}}<tr><th>Payload</th><td>{{payload .Payload}}</td></tr>{{end}}
+</table>
+<h3>Inputs</h3>
+<table>
+<tr><th>Spends</th><th>Address</th><th class="amount">Amount</th></tr>
+{{range .Inputs}}<tr>
+<td class="hash"><a href="/tx/{{.PrevTransaction}}">{{short .PrevTransaction}}</a>:{{.Index}}<div class="script">{{.Script}}</div></td>
+<td>{{if .Address}}<a href="/address/{{.Address}}">{{.Address}}</a>{{end}}</td>
+<td class="amount">{{if .Known}}{{coins .Amount}}{{else}}?{{end}}</td>
+</tr>{{else}}<tr><td colspan="3">{{if .Coinbase}}Coinbase{{else}}None{{end}}</td></tr>{{end}}
+</table>
+<h3>Outputs</h3>
+<table>
+<tr><th>#</th><th>Address or script</th><th class="amount">Amount</th></tr>
+{{range $i, $out := .Outputs}}<tr>
+<td>{{$i}}</td>
+<td>{{if .Address}}<a href="/address/{{.Address}}">{{.Address}}</a>{{end}}<div class="script">{{.Script}}</div></td>
+<td class="amount">{{coins .Amount}}</td>
+</tr>{{end}}
+</table>
+{{template "footer"}}{{end}}
+
+{{define "address"}}{{template "header" "Address"}}
+<table>
+<tr><th>Address</th><td class="hash">{{.Address}}</td></tr>
+<tr><th>Key hash</th><td class="hash">{{.KeyHash}}</td></tr>
+<tr><th>Balance</th><td>{{coins .Balance}}</td></tr>
+<tr><th>Received</th><td>{{coins .Received}}</td></tr>
+<tr><th>Sent</th><td>{{coins .Sent}}</td></tr>
+</table>
+<h3>Unspent outputs</h3>
+<table>
+<tr><th>Output</th><th class="amount">Amount</th></tr>
+{{range .Unspent}}<tr><td class="hash"><a href="/tx/{{.Transaction}}">{{.Transaction}}</a>:{{.Index}}</td><td class="amount">{{coins .Amount}}</td></tr>
+{{else}}<tr><td colspan="2">None</td></tr>{{end}}
+</table>
+<h3>History</h3>
+<table>
+<tr><th>Transaction</th><th>Block</th><th>Time (UTC)</th><th class="amount">Received</th><th class="amount">Sent</th></tr>
+{{range .History}}<tr>
+<td class="hash"><a href="/tx/{{.Hash}}">{{.Hash}}</a></td>
+<td><a href="/block/{{.Height}}">{{.Height}}</a></td>
+<td>{{time .Timestamp}}</td>
+<td class="amount">{{if .Received}}{{coins .Received}}{{end}}</td>
+<td class="amount">{{if .Sent}}{{coins .Sent}}{{end}}</td>
+</tr>{{else}}<tr><td colspan="5">No transactions</td></tr>{{end}}
+</table>
+{{template "footer"}}{{end}}
+
+{{define "peers"}}{{template "header" "Peers"}}
+<table>
+<tr><th>Address</th><th>Remote</th><th>Direction</th><th>User agent</th><th>Version</th><th>Height</th><th>Last seen (UTC)</th></tr>
+{{range .}}<tr><td>{{.Address}}</td><td>{{.Remote}}</td><td>{{if .Inbound}}inbound{{else}}outbound{{end}}</td><td>{{.UserAgent}}</td><td>{{.Version}}</td><td>{{.Height}}</td><td>{{time .LastSeen}}</td></tr>
+{{else}}<tr><td colspan="7">No peers</td></tr>{{end}}
+</table>
+{{template "footer"}}{{end}}
+`))
@@ -0,0 +1,145 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// VersionMessage opens every connection. Both peers send theirs, check the
+// other one and acknowledge it with a MESSAGE_VERACK before exchanging
+// anything else. Address is the one the sender listens on, Height the one
+// of its best block.
+type VersionMessage struct {
+	Version   uint32
+	Services  uint64
+	Height    uint32
+	Nonce     uint64
+	Address   string
+	UserAgent string
+}
+
+func (v *VersionMessage) MarshalBinary() ([]byte, error) {
+	if len(v.Address) > IP_SIZE || len(v.UserAgent) > USER_AGENT_MAX_SIZE {
+		return nil, errors.New("Version message field too long")
+	}
+	bs := &bytes.Buffer{}
+
+	binary.Write(bs, binary.LittleEndian, v.Version)
+	binary.Write(bs, binary.LittleEndian, v.Services)
+	binary.Write(bs, binary.LittleEndian, v.Height)
+	binary.Write(bs, binary.LittleEndian, v.Nonce)
+	bs.Write(FitBytes([]byte(v.Address), IP_SIZE))
+	bs.WriteByte(byte(len(v.UserAgent)))
+	bs.WriteString(v.UserAgent)
+
+	return bs.Bytes(), nil
+}
+
+func (v *VersionMessage) UnMarshalBinary(d []byte) error {
+	if len(d) < VERSION_MESSAGE_SIZE {
+		return errors.New("Insuficient version message size")
+	}
+	buf := bytes.NewBuffer(d)
+
+	binary.Read(buf, binary.LittleEndian, &v.Version)
+	binary.Read(buf, binary.LittleEndian, &v.Services)
+	binary.Read(buf, binary.LittleEndian, &v.Height)
+	binary.Read(buf, binary.LittleEndian, &v.Nonce)
+	v.Address = string(bytes.TrimLeft(buf.Next(IP_SIZE), "\x00"))
+
+	l, _ := buf.ReadByte()
+	if int(l) != buf.Len() {
+		return errors.New("Wrong version message size")
+	}
+	v.UserAgent = string(buf.Next(int(l)))
+
+	return nil
+}
+
+// LocalVersion is the version message of this node.
+func LocalVersion() VersionMessage {
+	return VersionMessage{
+		Version:   PROTOCOL_VERSION,
+		Services:  SERVICE_NETWORK,
+		Height:    uint32(Core.BlockChain.UTXO.Height()),
+		Nonce:     Core.Network.nonce,
+		Address:   Core.Network.Address,
+		UserAgent: USER_AGENT,
+	}
+}
+
+// Handshake exchanges version messages with the peer of node. Peers speaking
+// a protocol older than PROTOCOL_MIN_VERSION are rejected, and so are
+// connections to ourselves, recognized by the nonce. An inbound node takes
+// the address its peer listens on, as reached from here.
+func (node *Node) Handshake() error {
+	node.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT * time.Second))
+	defer node.SetDeadline(time.Time{})
+
+	local := LocalVersion()
+	mes := NewMessage(MESSAGE_VERSION)
+	mes.From = []byte(Core.Network.Address)
+	mes.Data, _ = local.MarshalBinary()
+	if err := node.Send(*mes); err != nil {
+		return err
+	}
+
+	m, err := ReadMessage(node.reader)
+	if err != nil {
+		return err
+	}
+	if m.Identifier != MESSAGE_VERSION {
+		return errors.New("Expected a version message")
+	}
+	peer := new(VersionMessage)
+	if err := peer.UnMarshalBinary(m.Data); err != nil {
+		return err
+	}
+	if peer.Version < PROTOCOL_MIN_VERSION {
+		return errors.New("Incompatible protocol version " + strconv.Itoa(int(peer.Version)))
+	}
+	if peer.Nonce == local.Nonce {
+		return errors.New("Connected to ourselves")
+	}
+	if _, _, err := net.SplitHostPort(peer.Address); err != nil {
+		return errors.New("Invalid peer address")
+	}
+
+	if err := node.Send(*NewMessage(MESSAGE_VERACK)); err != nil {
+		return err
+	}
+	m, err = ReadMessage(node.reader)
+	if err != nil {
+		return err
+	}
+	if m.Identifier != MESSAGE_VERACK {
+		return errors.New("Expected a verack message")
+	}
+
+	node.Peer = peer
+	if node.Address == "" {
+		if node.Address, err = inboundAddress(node.RemoteAddr(), peer.Address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inboundAddress is the host the connection of an inbound peer comes from
+// with the port the peer advertises. The host it advertises is not trusted,
+// or it could take the place of another peer.
+func inboundAddress(remote net.Addr, advertised string) (string, error) {
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return "", err
+	}
+	_, port, err := net.SplitHostPort(advertised)
+	if err != nil {
+		return "", errors.New("Invalid peer address")
+	}
+	return net.JoinHostPort(host, port), nil
+}
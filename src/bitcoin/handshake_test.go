@@ -0,0 +1,31 @@
+package bitcoin
+
+import (
+	"net"
+	"testing"
+)
+
+func TestInboundAddress(t *testing.T) {
+	tests := []struct {
+		remote, advertised, want string
+	}{
+		{"198.51.100.7:53122", "198.51.100.7:9200", "198.51.100.7:9200"},
+		{"198.51.100.7:53122", "192.0.2.1:9300", "198.51.100.7:9300"},
+		{"[2001:db8::1]:53122", "192.0.2.1:9200", "[2001:db8::1]:9200"},
+	}
+	for _, tt := range tests {
+		remote, _ := net.ResolveTCPAddr("tcp", tt.remote)
+		got, err := inboundAddress(remote, tt.advertised)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("inboundAddress(%s, %s) = %s, want %s", tt.remote, tt.advertised, got, tt.want)
+		}
+	}
+
+	remote, _ := net.ResolveTCPAddr("tcp", "198.51.100.7:53122")
+	if _, err := inboundAddress(remote, "no port"); err == nil {
+		t.Errorf("advertised address without a port is accepted")
+	}
+}
@@ -0,0 +1,215 @@
+package bitcoin
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// ExtendedKey is a secp256k1 key with a chain code from which child keys
+// are derived as in BIP32. Key is the 32 bytes private key, or the
+// compressed public key of a public extended key. Fingerprint is the start
+// of the Hash160 of the parent public key, so that the serialized keys are
+// the ones of BIP32.
+type ExtendedKey struct {
+	Private     bool
+	Depth       uint8
+	Fingerprint []byte
+	Index       uint32
+	ChainCode   []byte
+	Key         []byte
+}
+
+func NewMasterKey(seed []byte) (*ExtendedKey, error) {
+	mac := hmac.New(sha512.New, []byte("Bitcoin seed"))
+	mac.Write(seed)
+	i := mac.Sum(nil)
+
+	if _, err := (secp256k1Scheme{}).FromPrivate(i[:32]); err != nil {
+		return nil, err
+	}
+	return &ExtendedKey{Private: true, Fingerprint: make([]byte, 4), ChainCode: i[32:], Key: i[:32]}, nil
+}
+
+// PublicKey is the compressed public key of k.
+func (k *ExtendedKey) PublicKey() []byte {
+	if !k.Private {
+		return k.Key
+	}
+	kp, _ := secp256k1Scheme{}.FromPrivate(k.Key)
+	return kp.Public
+}
+
+func (k *ExtendedKey) Keypair() (*Keypair, error) {
+	if !k.Private {
+		return nil, errors.New("Public extended key")
+	}
+	return secp256k1Scheme{}.FromPrivate(k.Key)
+}
+
+// Neuter returns the public extended key of k.
+func (k *ExtendedKey) Neuter() *ExtendedKey {
+	n := *k
+	n.Private = false
+	n.Key = k.PublicKey()
+	return &n
+}
+
+// Child derives the child index of k. Indexes from HD_HARDENED up are
+// hardened and need a private key.
+func (k *ExtendedKey) Child(index uint32) (*ExtendedKey, error) {
+	data := &bytes.Buffer{}
+	if index >= HD_HARDENED {
+		if !k.Private {
+			return nil, errors.New("Hardened derivation needs a private key")
+		}
+		data.WriteByte(0)
+		data.Write(k.Key)
+	} else {
+		data.Write(k.PublicKey())
+	}
+	binary.Write(data, binary.BigEndian, index)
+
+	mac := hmac.New(sha512.New, k.ChainCode)
+	mac.Write(data.Bytes())
+	i := mac.Sum(nil)
+
+	il := new(big.Int).SetBytes(i[:32])
+	if il.Cmp(secp256k1N) >= 0 {
+		return nil, errors.New("Invalid child key, use the next index")
+	}
+
+	child := &ExtendedKey{
+		Private:     k.Private,
+		Depth:       k.Depth + 1,
+		Fingerprint: Hash160(k.PublicKey())[:4],
+		Index:       index,
+		ChainCode:   i[32:],
+	}
+
+	if k.Private {
+		key := secp256k1Order.add(secp256k1Limbs(i[:32]), secp256k1Limbs(k.Key))
+		if key.isZero() == 1 {
+			return nil, errors.New("Invalid child key, use the next index")
+		}
+		child.Key = key.bytes()
+		return child, nil
+	}
+
+	x, y, err := secp256k1Decompress(k.Key)
+	if err != nil {
+		return nil, err
+	}
+	pt := secp256k1Base().mul(i[:32]).add(secp256k1Affine(x, y))
+	if pt.infinity() {
+		return nil, errors.New("Invalid child key, use the next index")
+	}
+	child.Key = secp256k1Compress(pt.affine())
+	return child, nil
+}
+
+// Derive follows a path such as "m/0'/0/5" from k, the ' marking hardened
+// indexes.
+func (k *ExtendedKey) Derive(path string) (*ExtendedKey, error) {
+	parts := strings.Split(path, "/")
+	if parts[0] != "m" {
+		return nil, errors.New("Derivation path must start with m")
+	}
+
+	key := k
+	for _, p := range parts[1:] {
+		offset := uint32(0)
+		if strings.HasSuffix(p, "'") {
+			offset = HD_HARDENED
+			p = strings.TrimSuffix(p, "'")
+		}
+		i, err := strconv.ParseUint(p, 10, 31)
+		if err != nil {
+			return nil, errors.New("Invalid derivation path")
+		}
+
+		key, err = key.Child(uint32(i) + offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func (k *ExtendedKey) MarshalBinary() ([]byte, error) {
+	bs := &bytes.Buffer{}
+
+	if k.Private {
+		binary.Write(bs, binary.BigEndian, Params.HDPrivateVersion)
+	} else {
+		binary.Write(bs, binary.BigEndian, Params.HDPublicVersion)
+	}
+	bs.WriteByte(k.Depth)
+	bs.Write(FitBytes(k.Fingerprint, 4))
+	binary.Write(bs, binary.BigEndian, k.Index)
+	bs.Write(FitBytes(k.ChainCode, 32))
+	bs.Write(FitBytes(k.Key, 33))
+
+	return bs.Bytes(), nil
+}
+
+func (k *ExtendedKey) UnMarshalBinary(d []byte) error {
+	if len(d) != HD_EXTENDED_KEY_SIZE {
+		return errors.New("Invalid extended key size")
+	}
+	buf := bytes.NewBuffer(d)
+
+	var version uint32
+	binary.Read(buf, binary.BigEndian, &version)
+	switch version {
+	case Params.HDPrivateVersion:
+		k.Private = true
+	case Params.HDPublicVersion:
+		k.Private = false
+	default:
+		return errors.New("Unknown extended key version")
+	}
+	k.Depth, _ = buf.ReadByte()
+	k.Fingerprint = buf.Next(4)
+	binary.Read(buf, binary.BigEndian, &k.Index)
+	k.ChainCode = buf.Next(32)
+	k.Key = buf.Next(33)
+
+	if k.Private {
+		if k.Key[0] != 0 {
+			return errors.New("Invalid extended private key")
+		}
+		k.Key = k.Key[1:]
+		_, err := secp256k1Scheme{}.FromPrivate(k.Key)
+		return err
+	}
+	_, _, err := secp256k1Decompress(k.Key)
+	return err
+}
+
+// String encodes k as Base58Check, starting with xprv or xpub.
+func (k *ExtendedKey) String() string {
+	d, _ := k.MarshalBinary()
+	return Base58Encode(append(d, addressChecksum(d)...))
+}
+
+func ParseExtendedKey(s string) (*ExtendedKey, error) {
+	d, err := Base58Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(d) != HD_EXTENDED_KEY_SIZE+4 || !bytes.Equal(addressChecksum(d[:HD_EXTENDED_KEY_SIZE]), d[HD_EXTENDED_KEY_SIZE:]) {
+		return nil, errors.New("Invalid extended key checksum")
+	}
+
+	k := &ExtendedKey{}
+	if err := k.UnMarshalBinary(d[:HD_EXTENDED_KEY_SIZE]); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
@@ -0,0 +1,64 @@
+package bitcoin
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestRipemd160(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", "9c1185a5c5e9fc54612808977ee8f548b2258d31"},
+		{"abc", "8eb208f7e05d987a9b044a8e98c6b087f15a0bfc"},
+		{"message digest", "5d0689ef49d2fae572b881b123a85ffa21595f36"},
+		{"12345678901234567890123456789012345678901234567890123456789012345678901234567890", "9b752e45573d4b39f4dbd3323cab82bf63326bfb"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(Ripemd160([]byte(tt.in))); got != tt.want {
+			t.Errorf("Ripemd160(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestExtendedKeyBIP32 checks test vector 1 of BIP32.
+func TestExtendedKeyBIP32(t *testing.T) {
+	defer func(p *ChainParams) { Params = p }(Params)
+	Params = &MainNetParams
+
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	master, err := NewMasterKey(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct{ path, xprv, xpub string }{
+		{"m",
+			"xprv9s21ZrQH143K3QTDL4LXw2F7HEK3wJUD2nW2nRk4stbPy6cq3jPPqjiChkVvvNKmPGJxWUtg6LnF5kejMRNNU3TGtRBeJgk33yuGBxrMPHi",
+			"xpub661MyMwAqRbcFtXgS5sYJABqqG9YLmC4Q1Rdap9gSE8NqtwybGhePY2gZ29ESFjqJoCu1Rupje8YtGqsefD265TMg7usUDFdp6W1EGMcet8"},
+		{"m/0'",
+			"xprv9uHRZZhk6KAJC1avXpDAp4MDc3sQKNxDiPvvkX8Br5ngLNv1TxvUxt4cV1rGL5hj6KCesnDYUhd7oWgT11eZG7XnxHrnYeSvkzY7d2bhkJ7",
+			"xpub68Gmy5EdvgibQVfPdqkBBCHxA5htiqg55crXYuXoQRKfDBFA1WEjWgP6LHhwBZeNK1VTsfTFUHCdrfp1bgwQ9xv5ski8PX9rL2dZXvgGDnw"},
+		{"m/0'/1",
+			"xprv9wTYmMFdV23N2TdNG573QoEsfRrWKQgWeibmLntzniatZvR9BmLnvSxqu53Kw1UmYPxLgboyZQaXwTCg8MSY3H2EU4pWcQDnRnrVA1xe8fs",
+			"xpub6ASuArnXKPbfEwhqN6e3mwBcDTgzisQN1wXN9BJcM47sSikHjJf3UFHKkNAWbWMiGj7Wf5uMash7SyYq527Hqck2AxYysAA7xmALppuCkwQ"},
+	}
+	for _, tt := range tests {
+		k, err := master.Derive(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k.String() != tt.xprv {
+			t.Errorf("%s xprv %s, want %s", tt.path, k.String(), tt.xprv)
+		}
+		if k.Neuter().String() != tt.xpub {
+			t.Errorf("%s xpub %s, want %s", tt.path, k.Neuter().String(), tt.xpub)
+		}
+
+		parsed, err := ParseExtendedKey(tt.xpub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.String() != tt.xpub {
+			t.Errorf("%s xpub does not round trip", tt.path)
+		}
+	}
+}
@@ -1,26 +1,42 @@
 package bitcoin
 
 import (
+	"bytes"
+	"errors"
 	"io"
 	"log"
+	"net"
+	"path/filepath"
+	"strconv"
 )
 
 var Core = struct {
 	*Keypair
 	*BlockChain
 	*Network
+	Wallet *Wallet
 }{}
 
-func Start(address string, port int) {
-	log.Println("Generating keypair...")
-	Core.Keypair = GenerateNewKeypair()
-
-	Core.Network = SetupNetwork(address, port)
-	go Core.Network.Run()
+// Start runs the node with the identity of wallet, which must be unlocked.
+// The wallet is locked again once the identity is loaded. The node keeps the
+// identity to sign blocks and transaction headers only: spending its coins,
+// like those of any key, takes the wallet to be unlocked.
+func Start(address string, port int, dataDir string, workers int, wallet *Wallet) error {
+	keypair, err := wallet.Identity()
+	if err != nil {
+		return err
+	}
+	wallet.Lock()
+	Core.Keypair = keypair
+	Core.Wallet = wallet
 
-	Core.BlockChain = SetupBlockChain()
+	Core.BlockChain = SetupBlockChain(dataDir, workers)
 	go Core.BlockChain.Run()
 
+	// The handshake of the first peers already reads the height
+	Core.Network = SetupNetwork(address, port, OpenAddressBook(filepath.Join(dataDir, PEERS_FILE)))
+	go Core.Network.Run()
+
 	go func() {
 		for {
 			select {
@@ -29,17 +45,180 @@ func Start(address string, port int) {
 			}
 		}
 	}()
+
+	return nil
 }
 
 func CreateTransaction(txt string) *Transaction {
 
 	t := NewTransaction(Core.Keypair.Public, nil, []byte(txt))
+	t.Header.Version = Core.Keypair.Scheme
 	t.Header.Nonce = t.GenerateNonce(TRANSACTION_POW)
 	t.Signature = t.Sign(Core.Keypair)
 
 	return t
 }
 
+// CreatePayment spends outputs of one key of the wallet to lock amount with
+// script, leaving fee to the miner and returning the change to a fresh
+// change address.
+func CreatePayment(script []byte, amount, fee uint64) (*Transaction, error) {
+	if err := CheckScript(script, false); err != nil {
+		return nil, err
+	}
+
+	keypair, unspent, err := fundingKeypair(amount + fee)
+	if err != nil {
+		return nil, err
+	}
+
+	t := NewTransaction(keypair.Public, nil, nil)
+	t.Header.Version = keypair.Scheme
+
+	var total uint64
+	for _, uo := range unspent {
+		if total >= amount+fee {
+			break
+		}
+		t.AddInput(uo.Transaction, uo.Index)
+		total += uo.Amount
+	}
+
+	t.AddOutput(amount, script)
+	if total > amount+fee {
+		change, err := Core.Wallet.NewChangeKey()
+		if err != nil {
+			return nil, err
+		}
+		if change == nil {
+			change = keypair.Public
+		}
+		t.AddOutput(total-amount-fee, PayToKeyHash(KeyHash(change)))
+	}
+
+	t.Header.Nonce = t.GenerateNonce(TRANSACTION_POW)
+	t.SignInputs(keypair)
+	t.Signature = t.Sign(keypair)
+
+	return t, nil
+}
+
+// fundingKeypair picks the first key of the wallet holding total, the
+// identity first. Keys can only be used while the wallet is unlocked.
+func fundingKeypair(total uint64) (*Keypair, []UnspentOutput, error) {
+	err := errors.New("Insufficient funds")
+	for _, k := range Core.Wallet.Keys() {
+		unspent := spendable(Core.BlockChain.UTXO.Unspent(KeyHash(k)))
+		var balance uint64
+		for _, uo := range unspent {
+			balance += uo.Amount
+		}
+		if balance < total {
+			continue
+		}
+
+		keypair, kerr := Core.Wallet.Keypair(k)
+		if kerr != nil {
+			err = kerr
+			continue
+		}
+		return keypair, unspent, nil
+	}
+	return nil, nil, err
+}
+
+// spendable drops the outputs that transactions of the mempool already spend.
+func spendable(unspent []UnspentOutput) []UnspentOutput {
+	available := []UnspentOutput{}
+	for _, uo := range unspent {
+		if !Core.BlockChain.Mempool.Spends(uo.OutPoint) {
+			available = append(available, uo)
+		}
+	}
+	return available
+}
+
+// CreatePartialPayment spends the outputs locked with from, typically a
+// MultiSigScript, to lock amount with script. The change goes back to from.
+// The result is signed by nobody yet, except for the header signature of the
+// node, which does not unlock anything.
+func CreatePartialPayment(from, script []byte, amount, fee uint64) (*PartialTransaction, error) {
+	if err := CheckScript(script, false); err != nil {
+		return nil, err
+	}
+
+	t := NewTransaction(Core.Keypair.Public, nil, nil)
+	t.Header.Version = Core.Keypair.Scheme
+
+	var total uint64
+	spent := []TransactionOutput{}
+	for _, uo := range spendable(Core.BlockChain.UTXO.UnspentScript(from)) {
+		if total >= amount+fee {
+			break
+		}
+		t.AddInput(uo.Transaction, uo.Index)
+		spent = append(spent, uo.TransactionOutput)
+		total += uo.Amount
+	}
+	if total < amount+fee {
+		return nil, errors.New("Insufficient funds")
+	}
+
+	t.AddOutput(amount, script)
+	if total > amount+fee {
+		t.AddOutput(total-amount-fee, from)
+	}
+
+	t.Header.Nonce = t.GenerateNonce(TRANSACTION_POW)
+	t.Signature = t.Sign(Core.Keypair)
+
+	return NewPartialTransaction(*t, spent)
+}
+
+// SignPartial signs p with every wallet key that can unlock its inputs and
+// returns how many signatures were added. The spent outputs p claims are
+// checked against our UTXO set first.
+func SignPartial(p *PartialTransaction) (int, error) {
+	for i, in := range p.Inputs {
+		out, ok := Core.BlockChain.UTXO.Get(OutPoint{in.PrevTransaction, in.Index})
+		if !ok {
+			return 0, errors.New("Input " + strconv.Itoa(i) + " spends an unknown output")
+		}
+		if out.Amount != p.Spent[i].Amount || !bytes.Equal(out.Script, p.Spent[i].Script) {
+			return 0, errors.New("Input " + strconv.Itoa(i) + " misstates the output it spends")
+		}
+	}
+
+	// A key we cannot use, locked or watch-only, only matters if no other
+	// key signs
+	signed := 0
+	var kerr error
+	for _, k := range Core.Wallet.Keys() {
+		usable := false
+		for i := range p.Inputs {
+			usable = usable || p.canSign(i, k)
+		}
+		if !usable {
+			continue
+		}
+
+		keypair, err := Core.Wallet.Keypair(k)
+		if err != nil {
+			kerr = err
+			continue
+		}
+		n, err := p.Sign(keypair)
+		signed += n
+		if err != nil {
+			return signed, err
+		}
+	}
+	if signed == 0 && kerr != nil {
+		return 0, kerr
+	}
+	return signed, nil
+}
+
 func HandleIncomingMessage(msg Message) {
 
 	switch msg.Identifier {
@@ -63,7 +242,37 @@ func HandleIncomingMessage(msg Message) {
 			break
 		}
 		b.From = msg.From
+		b.Peer = msg.Peer
 		Core.BlockChain.BlockChannel <- b
+
+	case MESSAGE_GET_BLOCK, MESSAGE_GET_TRANSACTION, MESSAGE_INV_TRANSACTION:
+		Core.BlockChain.RequestChannel <- msg
+
+	case MESSAGE_VERSION, MESSAGE_VERACK:
+		log.Println("Unexpected handshake message")
+
+	case MESSAGE_GET_NODES:
+		reply := NewMessage(MESSAGE_SEND_NODES)
+		var addresses NodeAddresses
+		Core.Network.Do(func() {
+			addresses = Core.Network.KnownAddresses()
+		})
+		reply.Data, _ = addresses.MarshalBinary()
+		msg.Peer.Queue(*reply)
+
+	case MESSAGE_SEND_NODES:
+		// The network dials them as it needs more peers
+		addresses := new(NodeAddresses)
+		addresses.UnMarshalBinary(msg.Data)
+		source := string(bytes.TrimLeft(msg.From, "\x00"))
+		for _, addr := range *addresses {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				continue
+			}
+			if addr != Core.Network.Address {
+				Core.Network.Book.Add(addr, source)
+			}
+		}
 	default:
 		log.Println("Received strange message")
 	}
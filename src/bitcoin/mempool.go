@@ -0,0 +1,223 @@
+package bitcoin
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+type MempoolEntry struct {
+	Transaction
+	Fee   uint64
+	Size  int
+	Added time.Time
+}
+
+// FeeRate is the fee paid per thousand bytes.
+func (e *MempoolEntry) FeeRate() uint64 {
+	return e.Fee * 1000 / uint64(e.Size)
+}
+
+// Mempool holds the valid transactions waiting to be mined, indexed by hash
+// and by the outputs they spend so conflicting spends are refused.
+type Mempool struct {
+	lock    sync.RWMutex
+	entries map[string]*MempoolEntry
+	spends  map[string]string
+	size    int
+}
+
+func NewMempool() *Mempool {
+	return &Mempool{entries: map[string]*MempoolEntry{}, spends: map[string]string{}}
+}
+
+func (m *Mempool) Len() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return len(m.entries)
+}
+
+func (m *Mempool) Size() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.size
+}
+
+func (m *Mempool) Exists(hash []byte) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.entries[string(hash)] != nil
+}
+
+// Spends tells whether a transaction of the pool spends out.
+func (m *Mempool) Spends(out OutPoint) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	_, ok := m.spends[out.key()]
+	return ok
+}
+
+func (m *Mempool) Get(hash []byte) *Transaction {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	e := m.entries[string(hash)]
+	if e == nil {
+		return nil
+	}
+	return &e.Transaction
+}
+
+// Add inserts t, which must already be valid against the UTXO set. When the
+// pool is full the entries with the lowest fee rate are evicted, unless t
+// pays less than them.
+func (m *Mempool) Add(t Transaction, fee uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	hash := string(t.Hash())
+	if m.entries[hash] != nil {
+		return errors.New("Transaction already in mempool")
+	}
+	for _, i := range t.Inputs {
+		if _, ok := m.spends[OutPoint{i.PrevTransaction, i.Index}.key()]; ok {
+			return errors.New("Transaction conflicts with mempool")
+		}
+	}
+
+	d, err := t.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	e := &MempoolEntry{Transaction: t, Fee: fee, Size: len(d), Added: time.Now()}
+
+	if e.Size > MEMPOOL_MAX_SIZE {
+		return errors.New("Transaction too big")
+	}
+	byRate := m.sorted()
+	for m.size+e.Size > MEMPOOL_MAX_SIZE {
+		worst := byRate[len(byRate)-1]
+		if worst.FeeRate() >= e.FeeRate() {
+			return errors.New("Mempool full")
+		}
+		m.remove(string(worst.Hash()))
+		byRate = byRate[:len(byRate)-1]
+	}
+
+	m.entries[hash] = e
+	m.size += e.Size
+	for _, i := range t.Inputs {
+		m.spends[OutPoint{i.PrevTransaction, i.Index}.key()] = hash
+	}
+
+	return nil
+}
+
+func (m *Mempool) Remove(hash []byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.remove(string(hash))
+}
+
+func (m *Mempool) remove(hash string) {
+	e := m.entries[hash]
+	if e == nil {
+		return
+	}
+
+	for _, i := range e.Inputs {
+		delete(m.spends, OutPoint{i.PrevTransaction, i.Index}.key())
+	}
+	m.size -= e.Size
+	delete(m.entries, hash)
+}
+
+// RemoveBlock drops the transactions of b and the ones spending the same
+// outputs.
+func (m *Mempool) RemoveBlock(b Block) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, t := range *b.TransactionSlice {
+		m.remove(string(t.Hash()))
+		for _, i := range t.Inputs {
+			if hash, ok := m.spends[OutPoint{i.PrevTransaction, i.Index}.key()]; ok {
+				m.remove(hash)
+			}
+		}
+	}
+}
+
+// Revalidate drops the entries that no longer apply on utxo, and the ones
+// older than MEMPOOL_MAX_AGE.
+func (m *Mempool) Revalidate(utxo *UTXOSet) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	expiry := time.Now().Add(-MEMPOOL_MAX_AGE * time.Second)
+	for hash, e := range m.entries {
+		if e.Added.Before(expiry) {
+			m.remove(hash)
+			continue
+		}
+
+		fee, err := utxo.CheckTransaction(e.Transaction, nil)
+		if err != nil {
+			m.remove(hash)
+			continue
+		}
+		e.Fee = fee
+	}
+}
+
+// sorted lists the entries by decreasing fee rate, oldest first on ties.
+func (m *Mempool) sorted() []*MempoolEntry {
+	entries := make([]*MempoolEntry, 0, len(m.entries))
+	for _, e := range m.entries {
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].FeeRate() != entries[j].FeeRate() {
+			return entries[i].FeeRate() > entries[j].FeeRate()
+		}
+		return entries[i].Added.Before(entries[j].Added)
+	})
+	return entries
+}
+
+// Select picks transactions by fee rate until size bytes are filled. It
+// returns them with the fees they pay.
+func (m *Mempool) Select(size int) (TransactionSlice, uint64) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	ts := TransactionSlice{}
+	var fees uint64
+	for _, e := range m.sorted() {
+		if e.Size > size {
+			continue
+		}
+		ts = append(ts, e.Transaction)
+		fees += e.Fee
+		size -= e.Size
+	}
+	return ts, fees
+}
+
+func (m *Mempool) Transactions() TransactionSlice {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	ts := TransactionSlice{}
+	for _, e := range m.sorted() {
+		ts = append(ts, e.Transaction)
+	}
+	return ts
+}
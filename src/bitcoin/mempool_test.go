@@ -0,0 +1,194 @@
+package bitcoin
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// mempoolTransaction spends output index of the transaction prev into an
+// output anyone can spend.
+func mempoolTransaction(prev []byte, index uint32, amount uint64, payload []byte) Transaction {
+	tr := Transaction{Header: TransactionHeader{Version: CONSENSUS_VERSION, Timestamp: 1514764801}}
+	tr.SetPayload(payload)
+	tr.AddInput(prev, index)
+	tr.AddOutput(amount, []byte{OP_1})
+	return tr
+}
+
+func TestMempoolConflicts(t *testing.T) {
+	m := NewMempool()
+	prev := bytes.Repeat([]byte{1}, 32)
+	a := mempoolTransaction(prev, 0, COIN, []byte("a"))
+	b := mempoolTransaction(prev, 0, COIN, []byte("b"))
+	other := mempoolTransaction(prev, 1, COIN, nil)
+
+	if err := m.Add(a, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(a, 10); err == nil {
+		t.Errorf("adding a transaction twice succeeds")
+	}
+	if err := m.Add(b, 1000); err == nil {
+		t.Errorf("adding a conflicting transaction succeeds")
+	}
+	if err := m.Add(other, 10); err != nil {
+		t.Errorf("adding a transaction spending another output fails: %v", err)
+	}
+	if !m.Spends(OutPoint{prev, 0}) || !m.Spends(OutPoint{prev, 1}) || m.Spends(OutPoint{prev, 2}) {
+		t.Errorf("spent outputs not tracked")
+	}
+
+	m.Remove(a.Hash())
+	if m.Spends(OutPoint{prev, 0}) {
+		t.Errorf("removed transaction still spends its outputs")
+	}
+	if err := m.Add(b, 10); err != nil {
+		t.Errorf("adding once the conflict is removed fails: %v", err)
+	}
+
+	// A block spending the same output drops b from the pool
+	block := NewBlock(make([]byte, 32))
+	block.AddTransaction(a)
+	m.RemoveBlock(block)
+	if m.Exists(b.Hash()) || !m.Exists(other.Hash()) {
+		t.Errorf("block conflicts not removed")
+	}
+	if m.Len() != 1 {
+		t.Errorf("%d entries left, want 1", m.Len())
+	}
+	ob, _ := other.MarshalBinary()
+	if m.Size() != len(ob) {
+		t.Errorf("size %d, want %d", m.Size(), len(ob))
+	}
+}
+
+func TestMempoolEviction(t *testing.T) {
+	m := NewMempool()
+	payload := make([]byte, 1000000)
+
+	// Entries of about a megabyte paying 2, 3, ... per thousand bytes fill the
+	// pool
+	entries := []Transaction{}
+	for i := 0; ; i++ {
+		tr := mempoolTransaction(FitBytes([]byte{byte(i)}, 32), 0, COIN, payload)
+		if m.Size()+len(payload) > MEMPOOL_MAX_SIZE {
+			break
+		}
+		if err := m.Add(tr, uint64(i+2)*1000); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, tr)
+	}
+	n := m.Len()
+
+	cheap := mempoolTransaction(FitBytes([]byte{0xfe}, 32), 0, COIN, payload)
+	if err := m.Add(cheap, 2000); err == nil {
+		t.Errorf("transaction paying the lowest fee rate evicts")
+	}
+
+	rich := mempoolTransaction(FitBytes([]byte{0xff}, 32), 0, COIN, payload)
+	if err := m.Add(rich, 100*1000); err != nil {
+		t.Fatal(err)
+	}
+	if m.Exists(entries[0].Hash()) || !m.Exists(entries[1].Hash()) || !m.Exists(rich.Hash()) {
+		t.Errorf("eviction did not drop exactly the lowest fee rate")
+	}
+	if m.Len() != n || m.Size() > MEMPOOL_MAX_SIZE {
+		t.Errorf("%d entries of %d bytes after eviction, want %d", m.Len(), m.Size(), n)
+	}
+
+	if err := m.Add(mempoolTransaction(nil, 0, 0, make([]byte, MEMPOOL_MAX_SIZE)), 1<<40); err == nil {
+		t.Errorf("transaction larger than the pool is added")
+	}
+}
+
+func TestMempoolRevalidate(t *testing.T) {
+	utxo := NewUTXOSet()
+	funding := mempoolTransaction(nil, 0, 0, nil)
+	funding.Inputs, funding.Header.InputCount = nil, 0
+	funding.Outputs, funding.Header.OutputCount = nil, 0
+	funding.AddOutput(10*COIN, []byte{OP_1})
+	funding.AddOutput(10*COIN, []byte{OP_1})
+	funding.AddOutput(10*COIN, []byte{OP_1})
+	utxo.apply(funding)
+
+	m := NewMempool()
+	valid := mempoolTransaction(funding.Hash(), 0, 9*COIN, nil)
+	old := mempoolTransaction(funding.Hash(), 1, 9*COIN, nil)
+	unknown := mempoolTransaction(bytes.Repeat([]byte{9}, 32), 0, COIN, nil)
+	locked := mempoolTransaction(funding.Hash(), 2, 9*COIN, nil)
+	locked.Header.LockTime = 100
+	for _, tr := range []Transaction{valid, old, unknown, locked} {
+		if err := m.Add(tr, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.entries[string(old.Hash())].Added = time.Now().Add(-(MEMPOOL_MAX_AGE + 1) * time.Second)
+
+	m.Revalidate(utxo)
+
+	if !m.Exists(valid.Hash()) || m.Exists(old.Hash()) || m.Exists(unknown.Hash()) || m.Exists(locked.Hash()) {
+		t.Errorf("revalidation keeps %d entries, want only the valid one", m.Len())
+	}
+	if fee := m.entries[string(valid.Hash())].Fee; fee != COIN {
+		t.Errorf("revalidated fee %d, want %d", fee, COIN)
+	}
+}
+
+func TestMempoolSelect(t *testing.T) {
+	m := NewMempool()
+	now := time.Now()
+
+	add := func(i byte, payload int, fee uint64, added time.Duration) Transaction {
+		tr := mempoolTransaction(FitBytes([]byte{i}, 32), 0, COIN, make([]byte, payload))
+		if err := m.Add(tr, fee); err != nil {
+			t.Fatal(err)
+		}
+		m.entries[string(tr.Hash())].Added = now.Add(added)
+		return tr
+	}
+	low := add(1, 900, 1000, 0)
+	high := add(2, 900, 10000, 0)
+	tieOld := add(3, 900, 5000, -time.Minute)
+	tieNew := add(4, 900, 5000, 0)
+	big := add(5, 5000, 200000, 0)
+
+	size := func(trs ...Transaction) int {
+		n := 0
+		for _, tr := range trs {
+			d, _ := tr.MarshalBinary()
+			n += len(d)
+		}
+		return n
+	}
+
+	tests := []struct {
+		name string
+		size int
+		want []Transaction
+	}{
+		{"everything", 1 << 20, []Transaction{big, high, tieOld, tieNew, low}},
+		{"skips what does not fit", size(high, tieOld, tieNew), []Transaction{high, tieOld, tieNew}},
+		{"fills with smaller entries", size(big) - 1, []Transaction{high, tieOld, tieNew, low}},
+		{"nothing fits", 10, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, fees := m.Select(tt.size)
+			if len(ts) != len(tt.want) {
+				t.Fatalf("selected %d transactions, want %d", len(ts), len(tt.want))
+			}
+			var want uint64
+			for i := range ts {
+				if !bytes.Equal(ts[i].Hash(), tt.want[i].Hash()) {
+					t.Errorf("transaction %d is not the expected one", i)
+				}
+				want += m.entries[string(tt.want[i].Hash())].Fee
+			}
+			if fees != want {
+				t.Errorf("fees %d, want %d", fees, want)
+			}
+		})
+	}
+}
@@ -2,8 +2,10 @@ package bitcoin
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
-	"math"
+	"io"
 )
 
 type Message struct {
@@ -11,16 +13,19 @@ type Message struct {
 	From       []byte
 	Options    []byte
 	Data       []byte
-	Reply      chan Message
+	Peer       *Node
 }
 
 func NewMessage(id byte) *Message {
 	return &Message{Identifier: id}
 }
 
+// MarshalBinary writes the version of the message format, the identifier, the
+// address of the sender, the options and the data.
 func (m *Message) MarshalBinary() ([]byte, error) {
 	bs := &bytes.Buffer{}
 
+	bs.WriteByte(MESSAGE_FORMAT)
 	bs.WriteByte(m.Identifier)
 	bs.Write(FitBytes(m.From, IP_SIZE))
 	bs.Write(FitBytes(m.Options, MESSAGE_OPTIONS_SIZE))
@@ -31,13 +36,79 @@ func (m *Message) MarshalBinary() ([]byte, error) {
 func (m *Message) UnMarshalBinary(d []byte) error {
 	bs := bytes.NewBuffer(d)
 
-	if len(d) < MESSAGE_OPTIONS_SIZE+MESSAGE_TYPE_SIZE {
+	if len(d) < MESSAGE_HEADER_SIZE {
 		return errors.New("Insuficient message size")
 	}
-	m.Identifier = bs.Next(1)[0]
+	if version, _ := bs.ReadByte(); version != MESSAGE_FORMAT {
+		return errors.New("Unknown message version")
+	}
+	m.Identifier, _ = bs.ReadByte()
 	m.From = bs.Next(IP_SIZE)
 	m.Options = bs.Next(MESSAGE_OPTIONS_SIZE)
-	m.Data = bs.Next(math.MaxInt64)
+	m.Data = bs.Bytes()
 
 	return nil
 }
+
+func messageChecksum(d []byte) []byte {
+	hash := sha256.New()
+	hash.Write(d)
+	return hash.Sum(nil)[:4]
+}
+
+// WriteMessage writes m to w framed as magic, body length, checksum and body.
+func WriteMessage(w io.Writer, m Message) error {
+	body, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	bs := &bytes.Buffer{}
+	binary.Write(bs, binary.LittleEndian, Params.Magic)
+	binary.Write(bs, binary.LittleEndian, uint32(len(body)))
+	bs.Write(messageChecksum(body))
+	bs.Write(body)
+
+	_, err = w.Write(bs.Bytes())
+	return err
+}
+
+// ReadMessage reads the next framed message from r.
+func ReadMessage(r io.Reader) (*Message, error) {
+	frame := make([]byte, MESSAGE_FRAME_SIZE)
+	_, err := io.ReadFull(r, frame)
+	if err != nil {
+		return nil, err
+	}
+
+	var magic, l uint32
+	bf := bytes.NewBuffer(frame)
+	binary.Read(bytes.NewBuffer(bf.Next(4)), binary.LittleEndian, &magic)
+	binary.Read(bytes.NewBuffer(bf.Next(4)), binary.LittleEndian, &l)
+	checksum := bf.Next(4)
+
+	if magic != Params.Magic {
+		return nil, errors.New("Wrong message magic")
+	}
+	if l > MESSAGE_MAX_SIZE {
+		return nil, errors.New("Message too big")
+	}
+
+	body := make([]byte, l)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(checksum, messageChecksum(body)) {
+		return nil, errors.New("Wrong message checksum")
+	}
+
+	m := new(Message)
+	err = m.UnMarshalBinary(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
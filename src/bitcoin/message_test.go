@@ -0,0 +1,164 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func testMessage() Message {
+	m := NewMessage(MESSAGE_SEND_NODES)
+	m.From = FitBytes([]byte("192.0.2.1:9200"), IP_SIZE)
+	m.Options = []byte{1, 2, 3, 4}
+	addresses := NodeAddresses{"192.0.2.1:9200", "198.51.100.7:9200"}
+	m.Data, _ = addresses.MarshalBinary()
+	return *m
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	block := testBlock()
+	blockData, _ := block.MarshalBinary()
+
+	tests := []struct {
+		name    string
+		message Message
+	}{
+		{"nodes", testMessage()},
+		{"no data", *NewMessage(MESSAGE_GET_NODES)},
+		{"block", Message{Identifier: MESSAGE_SEND_BLOCK, From: FitBytes(nil, IP_SIZE), Options: make([]byte, MESSAGE_OPTIONS_SIZE), Data: blockData}},
+		{"unknown identifier", Message{Identifier: 0xff, From: FitBytes(nil, IP_SIZE), Options: make([]byte, MESSAGE_OPTIONS_SIZE), Data: []byte{1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			framed := &bytes.Buffer{}
+			if err := WriteMessage(framed, tt.message); err != nil {
+				t.Fatal(err)
+			}
+			d := append([]byte{}, framed.Bytes()...)
+
+			m, err := ReadMessage(framed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if framed.Len() != 0 {
+				t.Errorf("%d bytes left after the message", framed.Len())
+			}
+			if m.Identifier != tt.message.Identifier || !bytes.Equal(m.Data, tt.message.Data) {
+				t.Errorf("decoded message %+v, want %+v", m, tt.message)
+			}
+
+			again := &bytes.Buffer{}
+			WriteMessage(again, *m)
+			if !bytes.Equal(again.Bytes(), d) {
+				t.Errorf("encoding does not round trip:\n got %x\nwant %x", again.Bytes(), d)
+			}
+		})
+	}
+}
+
+func TestReadMessageRejects(t *testing.T) {
+	framed := &bytes.Buffer{}
+	WriteMessage(framed, testMessage())
+	d := framed.Bytes()
+
+	edit := func(f func(d []byte)) []byte {
+		e := append([]byte{}, d...)
+		f(e)
+		return e
+	}
+	body := func(b []byte) []byte {
+		bs := &bytes.Buffer{}
+		binary.Write(bs, binary.LittleEndian, Params.Magic)
+		binary.Write(bs, binary.LittleEndian, uint32(len(b)))
+		bs.Write(messageChecksum(b))
+		bs.Write(b)
+		return bs.Bytes()
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated frame", d[:MESSAGE_FRAME_SIZE-1]},
+		{"truncated body", d[:len(d)-1]},
+		{"wrong magic", edit(func(d []byte) { d[0] ^= 1 })},
+		{"wrong checksum", edit(func(d []byte) { d[8] ^= 1 })},
+		{"corrupted body", edit(func(d []byte) { d[len(d)-1] ^= 1 })},
+		{"too big", edit(func(d []byte) { binary.LittleEndian.PutUint32(d[4:], MESSAGE_MAX_SIZE+1) })},
+		{"unknown format", body(append([]byte{MESSAGE_FORMAT + 1}, make([]byte, MESSAGE_HEADER_SIZE)...))},
+		{"short header", body(make([]byte, MESSAGE_HEADER_SIZE-1))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadMessage(bytes.NewReader(tt.data)); err == nil {
+				t.Errorf("reading succeeds")
+			}
+		})
+	}
+}
+
+func TestVersionMessageRoundTrip(t *testing.T) {
+	tests := []VersionMessage{
+		{Version: PROTOCOL_VERSION, Services: SERVICE_NETWORK, Height: 12, Nonce: 1 << 60, Address: "192.0.2.1:9200", UserAgent: USER_AGENT},
+		{},
+	}
+	for _, v := range tests {
+		d, err := v.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := VersionMessage{}
+		if err := decoded.UnMarshalBinary(d); err != nil {
+			t.Fatal(err)
+		}
+		if decoded != v {
+			t.Errorf("decoded %+v, want %+v", decoded, v)
+		}
+		if err := decoded.UnMarshalBinary(append(d, 0)); err == nil {
+			t.Errorf("decoding with a trailing byte succeeds")
+		}
+	}
+}
+
+func TestMessageGolden(t *testing.T) {
+	framed := &bytes.Buffer{}
+	if err := WriteMessage(framed, testMessage()); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "message.golden", framed.Bytes())
+
+	m, err := ReadMessage(bytes.NewReader(readGolden(t, "message.golden")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses := NodeAddresses{}
+	addresses.UnMarshalBinary(m.Data)
+	if len(addresses) != 2 || addresses[1] != "198.51.100.7:9200" {
+		t.Errorf("golden message addresses %v", addresses)
+	}
+}
+
+// FuzzMessageUnMarshal checks that decoding never panics and that whatever
+// decodes is the canonical encoding of the result.
+func FuzzMessageUnMarshal(f *testing.F) {
+	m := testMessage()
+	d, _ := m.MarshalBinary()
+	f.Add(d)
+	golden := readGolden(f, "message.golden")
+	f.Add(golden[MESSAGE_FRAME_SIZE:])
+
+	f.Fuzz(func(t *testing.T, d []byte) {
+		m := Message{}
+		if err := m.UnMarshalBinary(d); err != nil {
+			return
+		}
+		again, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again, d) {
+			t.Errorf("decoded message encodes to\n%x\nnot\n%x", again, d)
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package bitcoin
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log"
+	"math"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Miner searches proof of work with several goroutines. Each worker owns a
+// slice of the nonce space; once it is exhausted the worker rolls its own
+// extra nonce in the coinbase and the timestamp and searches the full space
+// again.
+type Miner struct {
+	Workers int
+
+	enabled  int32
+	hashes   uint64
+	jobStart int64
+}
+
+func NewMiner(workers int) *Miner {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &Miner{Workers: workers, enabled: 1}
+}
+
+func (m *Miner) Enabled() bool {
+	return atomic.LoadInt32(&m.enabled) == 1
+}
+
+func (m *Miner) SetEnabled(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&m.enabled, 1)
+	} else {
+		atomic.StoreInt32(&m.enabled, 0)
+	}
+}
+
+// HashRate is the number of hashes per second of the current job.
+func (m *Miner) HashRate() float64 {
+	start := atomic.LoadInt64(&m.jobStart)
+	if start == 0 {
+		return 0
+	}
+
+	elapsed := time.Since(time.Unix(0, start)).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(atomic.LoadUint64(&m.hashes)) / elapsed
+}
+
+// Mine searches a nonce for b until ctx is cancelled. A found block is signed
+// and sent to found.
+func (m *Miner) Mine(ctx context.Context, b Block, found chan<- *Block) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	atomic.StoreUint64(&m.hashes, 0)
+	atomic.StoreInt64(&m.jobStart, time.Now().UnixNano())
+
+	b.BlockHeader.MerkelRoot = b.GenerateMerkelRoot()
+	b.BlockHeader.Timestamp = blockTime(b.Timestamp)
+
+	result := make(chan *Block)
+	span := (uint64(math.MaxUint32) + 1) / uint64(m.Workers)
+	for w := 0; w < m.Workers; w++ {
+		first, last := uint64(w)*span, uint64(w+1)*span
+		if w == m.Workers-1 {
+			last = uint64(math.MaxUint32) + 1
+		}
+		go m.work(ctx, b, w, first, last, result)
+	}
+
+	select {
+	case <-ctx.Done():
+		atomic.StoreInt64(&m.jobStart, 0)
+	case block := <-result:
+		block.Signature = block.Sign(Core.Keypair)
+		log.Printf("Found Block!! %.0f hashes/s\n", m.HashRate())
+		atomic.StoreInt64(&m.jobStart, 0)
+		found <- block
+	}
+}
+
+func (m *Miner) work(ctx context.Context, b Block, worker int, first, last uint64, result chan<- *Block) {
+
+	header := *b.BlockHeader
+	b.BlockHeader = &header
+
+	for round := 0; ; round++ {
+		if round > 0 {
+			b = rollExtraNonce(b, uint32(round*m.Workers+worker))
+			first, last = 0, uint64(math.MaxUint32)+1
+		}
+
+		target := b.Target()
+		for n := first; n < last; n++ {
+			if n%MINER_CHECK_INTERVAL == 0 {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+				atomic.AddUint64(&m.hashes, MINER_CHECK_INTERVAL)
+			}
+
+			b.BlockHeader.Nonce = uint32(n)
+			if CheckProofOfWork(target, b.Hash()) {
+				select {
+				case result <- &b:
+				case <-ctx.Done():
+				}
+				return
+			}
+		}
+	}
+}
+
+// rollExtraNonce returns a copy of b whose coinbase carries extraNonce after
+// the height, with the merkel root and timestamp updated.
+func rollExtraNonce(b Block, extraNonce uint32) Block {
+	ts := append(TransactionSlice{}, *b.TransactionSlice...)
+
+	coinbase := ts[0]
+	payload := bytes.NewBuffer(append([]byte{}, coinbase.Payload[:4]...))
+	binary.Write(payload, binary.LittleEndian, extraNonce)
+	coinbase.SetPayload(payload.Bytes())
+	coinbase.Header.Nonce = coinbase.GenerateNonce(TRANSACTION_POW)
+	coinbase.Signature = coinbase.Sign(Core.Keypair)
+	ts[0] = coinbase
+
+	header := *b.BlockHeader
+	b.BlockHeader = &header
+	b.TransactionSlice = &ts
+	b.BlockHeader.MerkelRoot = b.GenerateMerkelRoot()
+	b.BlockHeader.Timestamp = blockTime(b.Timestamp)
+
+	return b
+}
@@ -0,0 +1,110 @@
+package bitcoin
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"strings"
+)
+
+// A mnemonic writes the seed entropy one word per byte, followed by a word
+// for the first byte of its sha256 as a checksum. Words may be shortened to
+// their first four letters, which are unique in the list.
+var mnemonicWords = []string{
+	"able", "acid", "actor", "adult", "agent", "alarm", "album", "alley",
+	"amber", "angle", "apple", "april", "arena", "armor", "arrow", "atlas",
+	"audio", "autumn", "avocado", "bacon", "badge", "baker", "bamboo", "banana",
+	"barrel", "basket", "beach", "beaver", "bench", "berry", "bicycle", "bird",
+	"blanket", "blossom", "board", "bonus", "border", "bottle", "bounce",
+	"brave", "bread", "brick", "bridge", "bronze", "brush", "bubble", "bucket",
+	"budget", "buffalo", "bullet", "burger", "butter", "cabin", "cactus",
+	"camera", "canal", "candle", "canvas", "captain", "carbon", "carpet",
+	"castle", "cattle", "cement", "cereal", "chair", "chalk", "cherry",
+	"chicken", "chimney", "circle", "citrus", "clever", "climb", "clock",
+	"cloud", "coconut", "coffee", "comet", "copper", "coral", "cotton",
+	"cousin", "crayon", "cricket", "crystal", "cupboard", "curtain", "cycle",
+	"daisy", "dancer", "dawn", "debate", "decade", "desert", "diamond",
+	"dinner", "dolphin", "donkey", "dragon", "dream", "drum", "eagle", "earth",
+	"echo", "eclipse", "eight", "elbow", "elephant", "ember", "empire",
+	"engine", "envelope", "equator", "escape", "evening", "exotic", "fabric",
+	"falcon", "family", "fancy", "feather", "fence", "fiber", "field", "finger",
+	"flame", "flower", "focus", "forest", "fossil", "fountain", "fox", "frame",
+	"frost", "fruit", "funnel", "galaxy", "garden", "garlic", "gazelle",
+	"gentle", "giant", "ginger", "giraffe", "glacier", "globe", "gold",
+	"gorilla", "grape", "gravel", "guitar", "hammer", "harbor", "harvest",
+	"hazard", "helmet", "hero", "hockey", "honey", "horizon", "hotel", "humble",
+	"hunter", "icon", "igloo", "impact", "indigo", "infant", "inkwell",
+	"island", "ivory", "jacket", "jaguar", "jelly", "jewel", "jigsaw", "jockey",
+	"jungle", "kayak", "kettle", "kidney", "kingdom", "kitchen", "kiwi",
+	"knight", "koala", "ladder", "lagoon", "lantern", "laptop", "lemon",
+	"leopard", "letter", "lizard", "lobster", "lotus", "lumber", "magnet",
+	"mammal", "mango", "marble", "meadow", "melon", "mermaid", "meteor",
+	"mirror", "monkey", "morning", "mosaic", "mountain", "muffin", "museum",
+	"napkin", "nature", "needle", "nephew", "nickel", "noodle", "north",
+	"number", "oasis", "ocean", "olive", "omelet", "onion", "orange", "orbit",
+	"orchid", "otter", "oyster", "paddle", "palace", "panda", "parrot",
+	"pepper", "piano", "pigeon", "pillow", "pilot", "planet", "pocket", "pony",
+	"potato", "puzzle", "pyramid", "quarter", "quiet", "rabbit", "radar",
+	"rainbow", "raven", "record", "ribbon", "river", "rocket",
+}
+
+func NewMnemonic() (string, error) {
+	entropy := make([]byte, MNEMONIC_ENTROPY_SIZE)
+	if _, err := rand.Read(entropy); err != nil {
+		return "", err
+	}
+	return EntropyToMnemonic(entropy), nil
+}
+
+func EntropyToMnemonic(entropy []byte) string {
+	checksum := sha256.Sum256(entropy)
+
+	words := []string{}
+	for _, b := range append(append([]byte{}, entropy...), checksum[0]) {
+		words = append(words, mnemonicWords[b])
+	}
+	return strings.Join(words, " ")
+}
+
+func MnemonicToEntropy(mnemonic string) ([]byte, error) {
+	words := strings.Fields(strings.ToLower(mnemonic))
+	if len(words) != MNEMONIC_ENTROPY_SIZE+1 {
+		return nil, errors.New("Wrong number of mnemonic words")
+	}
+
+	d := []byte{}
+	for _, w := range words {
+		i := mnemonicIndex(w)
+		if i < 0 {
+			return nil, errors.New("Unknown mnemonic word " + w)
+		}
+		d = append(d, byte(i))
+	}
+
+	entropy := d[:MNEMONIC_ENTROPY_SIZE]
+	checksum := sha256.Sum256(entropy)
+	if checksum[0] != d[MNEMONIC_ENTROPY_SIZE] {
+		return nil, errors.New("Invalid mnemonic checksum")
+	}
+	return entropy, nil
+}
+
+func mnemonicIndex(word string) int {
+	for i, w := range mnemonicWords {
+		if w == word || (len(word) >= 4 && strings.HasPrefix(w, word)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// MnemonicSeed stretches a valid mnemonic into the seed of the master key.
+func MnemonicSeed(mnemonic string) ([]byte, error) {
+	entropy, err := MnemonicToEntropy(mnemonic)
+	if err != nil {
+		return nil, err
+	}
+	return pbkdf2.Key(sha512.New, EntropyToMnemonic(entropy), []byte("mnemonic"), 2048, 64)
+}
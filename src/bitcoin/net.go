@@ -1,19 +1,83 @@
 package bitcoin
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type ConnectionQueue chan string
 type NodeChannel chan *Node
+
+// Node is a connection to a peer. Address is the one the peer listens on and
+// Peer its version message, both known once the handshake is done.
 type Node struct {
 	*net.TCPConn
-	lastSeen int
+	Address  string
+	Inbound  bool
+	Peer     *VersionMessage
+	lastSeen int64
+
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+	queue     chan Message
+	closed    chan struct{}
+}
+
+func NewNode(con *net.TCPConn) *Node {
+	return &Node{
+		TCPConn:  con,
+		lastSeen: time.Now().Unix(),
+		reader:   bufio.NewReader(con),
+		queue:    make(chan Message, NODES_SEND_QUEUE),
+		closed:   make(chan struct{}),
+	}
+}
+
+// LastSeen is when the last message of the peer arrived.
+func (node *Node) LastSeen() int {
+	return int(atomic.LoadInt64(&node.lastSeen))
+}
+
+// Send writes a framed message, serializing writers on the connection.
+func (node *Node) Send(m Message) error {
+	node.writeLock.Lock()
+	defer node.writeLock.Unlock()
+
+	return WriteMessage(node.TCPConn, m)
+}
+
+// Queue hands m to the writer of node, waiting while its queue is full.
+// Messages for a node whose connection closed are dropped.
+func (node *Node) Queue(m Message) {
+	select {
+	case node.queue <- m:
+	case <-node.closed:
+	}
+}
+
+// write sends the queued messages until the connection closes.
+func (node *Node) write() {
+	for {
+		select {
+		case m := <-node.queue:
+			if err := node.Send(m); err != nil {
+				log.Println("Error replying to", node.TCPConn.RemoteAddr())
+			}
+		case <-node.closed:
+			return
+		}
+	}
 }
 
 type Nodes map[string]*Node
@@ -24,17 +88,32 @@ type Network struct {
 	ConnectionCallback NodeChannel
 	BroadcastQueue     chan Message
 	IncomingMessages   chan Message
+	QueryChannel       chan func()
+	Disconnected       NodeChannel
+
+	// Book keeps the addresses of peers to connect to across restarts
+	Book *AddressBook
+
+	// nonce tells connections to ourselves apart in the handshake
+	nonce uint64
 }
 
-func SetupNetwork(address string, port int) *Network {
+func SetupNetwork(address string, port int, book *AddressBook) *Network {
 
 	n := &Network{}
 
 	n.BroadcastQueue, n.IncomingMessages = make(chan Message), make(chan Message)
+	n.QueryChannel = make(chan func())
+	n.Disconnected = make(NodeChannel)
 	n.ConnectionQueue, n.ConnectionCallback = CreateConnectionQueue(port)
 	n.Nodes = Nodes{}
+	n.Book = book
 	n.Address = fmt.Sprintf("%s:%d", address, port)
 
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	n.nonce = binary.LittleEndian.Uint64(nonce)
+
 	return n
 }
 
@@ -46,10 +125,17 @@ func CreateConnectionQueue(port int) (ConnectionQueue, NodeChannel) {
 
 		for {
 			address := <-in
-			address = fmt.Sprintf("%s:%d", address, port)
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				address = fmt.Sprintf("%s:%d", address, port)
+			}
 			log.Println(address)
-			if address != Core.Network.Address && Core.Nodes[address] == nil {
+			connected := false
+			Core.Network.Do(func() {
+				connected = Core.Nodes[address] != nil
+			})
+			if address != Core.Network.Address && !connected {
 				log.Printf("Connect to node: %s\n", address)
+				Core.Network.Book.Attempt(address)
 				go ConnectToNode(address, 5*time.Second, false, out)
 			}
 		}
@@ -62,27 +148,163 @@ func (n *Network) Run() {
 
 	log.Println("Listening in", Core.Network.Address)
 	listenCb := StartListening(Core.Network.Address)
+	gossip := time.NewTicker(NODES_GOSSIP_INTERVAL * time.Second)
+	connect := time.NewTicker(NODES_CONNECT_INTERVAL * time.Second)
+
+	// Reconnect to the peers that worked last time
+	best := n.Book.Best(NODES_MAX_OUTBOUND)
+	go func() {
+		for _, addr := range best {
+			n.ConnectionQueue <- addr
+		}
+	}()
 
 	for {
 		select {
 		case node := <-listenCb:
-			Core.Nodes.AddNode(node)
+			if Core.Nodes.AddNode(node) {
+				n.Book.Add(node.Address, node.RemoteAddr().String())
+				go node.Sync()
+			}
 
 		case node := <-n.ConnectionCallback:
-			Core.Nodes.AddNode(node)
+			if Core.Nodes.AddNode(node) {
+				n.Book.Good(node.Address)
+				n.saveBook()
+				go func() {
+					node.Send(*NewMessage(MESSAGE_GET_NODES))
+					node.Sync()
+				}()
+			}
+
+		case node := <-n.Disconnected:
+			if n.Nodes[node.Address] == node {
+				delete(n.Nodes, node.Address)
+				n.Book.Seen(node.Address)
+			}
+
+		case <-connect.C:
+			n.connectOutbound()
 
 		case message := <-n.BroadcastQueue:
-			go n.BroadcastMessage(message)
+			n.BroadcastMessage(message)
+
+		case <-gossip.C:
+			n.BroadcastMessage(*NewMessage(MESSAGE_GET_NODES))
+			n.saveBook()
+
+		case f := <-n.QueryChannel:
+			f()
+		}
+	}
+}
+
+// Do runs f on the Network goroutine and waits for it to return.
+func (n *Network) Do(f func()) {
+	done := make(chan bool)
+	n.QueryChannel <- func() {
+		f()
+		done <- true
+	}
+	<-done
+}
+
+func (n *Network) saveBook() {
+	if err := n.Book.Save(); err != nil {
+		log.Println("Fail to save address book", err)
+	}
+}
+
+// connectOutbound dials one more address of the book while we have less than
+// NODES_MAX_OUTBOUND outbound peers. Peers share a network at most once, so
+// that one network can't surround us; networks of unroutable addresses,
+// like those of local test nodes, are not limited.
+func (n *Network) connectOutbound() {
+	outbound := 0
+	groups := map[string]bool{}
+	for _, node := range n.Nodes {
+		if !node.Inbound {
+			outbound++
+			if routable(node.Address) {
+				groups[addressGroup(node.Address)] = true
+			}
 		}
 	}
+	if outbound >= NODES_MAX_OUTBOUND {
+		return
+	}
+
+	addr := n.Book.Select(func(addr string) bool {
+		return addr == n.Address || n.Nodes[addr] != nil || groups[addressGroup(addr)]
+	})
+	if addr != "" {
+		go func() { n.ConnectionQueue <- addr }()
+	}
+}
+
+// KnownAddresses lists our own address, the ones of connected nodes and some
+// of the address book. It must run on the Network goroutine.
+func (n *Network) KnownAddresses() NodeAddresses {
+	addresses := NodeAddresses{n.Address}
+	known := map[string]bool{n.Address: true}
+	for addr := range n.Nodes {
+		if len(addresses) >= NODES_MAX_ADDRESSES {
+			break
+		}
+		addresses = append(addresses, addr)
+		known[addr] = true
+	}
+	for _, addr := range n.Book.Addresses(NODES_MAX_ADDRESSES) {
+		if len(addresses) >= NODES_MAX_ADDRESSES {
+			break
+		}
+		if !known[addr] {
+			addresses = append(addresses, addr)
+		}
+	}
+	return addresses
+}
+
+type NodeAddresses []string
+
+func (addresses *NodeAddresses) MarshalBinary() ([]byte, error) {
+	bf := &bytes.Buffer{}
+
+	for _, addr := range *addresses {
+		if len(addr) > IP_SIZE {
+			return nil, errors.New("Address too long")
+		}
+		bf.Write(FitBytes([]byte(addr), IP_SIZE))
+	}
+
+	return bf.Bytes(), nil
+}
+
+func (addresses *NodeAddresses) UnMarshalBinary(d []byte) error {
+	bf := bytes.NewBuffer(d)
+
+	for bf.Len() >= IP_SIZE && len(*addresses) < NODES_MAX_ADDRESSES {
+		addr := string(bytes.TrimLeft(bf.Next(IP_SIZE), "\x00"))
+		(*addresses) = append((*addresses), addr)
+	}
+	return nil
 }
 
+// Sync asks the peer of node for its blocks if it had more than us when the
+// connection opened.
+func (node *Node) Sync() {
+	if int(node.Peer.Height) > Core.BlockChain.UTXO.Height() {
+		node.Send(SyncMessage())
+	}
+}
+
+// AddNode registers a node whose handshake is done under the address its
+// peer listens on.
 func (n Nodes) AddNode(node *Node) bool {
-	ip, _, _ := net.SplitHostPort(node.TCPConn.RemoteAddr().String())
-	addr := fmt.Sprintf("%s:%d", ip, BLOCKCHAIN_DEFAULT_PORT)
+	addr := node.Address
 
 	if addr != Core.Network.Address && n[addr] == nil {
-		log.Println("Node connected ", addr)
+		log.Println("Node connected ", addr, node.Peer.UserAgent)
 		n[addr] = node
 
 		go HandleNode(node)
@@ -90,7 +312,8 @@ func (n Nodes) AddNode(node *Node) bool {
 		return true
 	}
 
-	log.Println("Duplicate ip address")
+	log.Println("Duplicate peer address", addr)
+	node.TCPConn.Close()
 	return false
 }
 
@@ -111,59 +334,52 @@ func StartListening(address string) NodeChannel {
 
 		for {
 			connection, err := l.AcceptTCP()
-			if err != nil && err != io.EOF {
+			if err != nil {
 				log.Println(err)
+				continue
 			}
 
-			cb <- &Node{connection, int(time.Now().Unix())}
+			go func() {
+				node := NewNode(connection)
+				node.Inbound = true
+				if err := node.Handshake(); err != nil {
+					log.Println("Handshake with", connection.RemoteAddr(), "fails:", err)
+					connection.Close()
+					return
+				}
+				cb <- node
+			}()
 		}
 	}(listener)
 
 	return cb
 }
 
+// HandleNode reads the messages of node until its connection closes. They
+// are marked as coming from the address of the node, whatever the peer
+// claims, and carry the node for the replies, which one writer sends.
 func HandleNode(node *Node) {
+	defer func() { Core.Network.Disconnected <- node }()
+	defer close(node.closed)
+	go node.write()
+
 	for {
-		var bs []byte = make([]byte, 1024*1000)
-		n, err := node.TCPConn.Read(bs)
+		m, err := ReadMessage(node.reader)
 		if err == io.EOF {
 			log.Printf("%s： Connection Closed\n", node.TCPConn.RemoteAddr().String())
 			node.TCPConn.Close()
 			break
 		}
 		if err != nil {
+			// The stream can't be resynchronized after a bad frame
 			log.Println("Blockchain network: ", err)
+			node.TCPConn.Close()
+			break
 		}
 
-		m := new(Message)
-		err = m.UnMarshalBinary(bs[:n])
-
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-
-		m.Reply = make(chan Message)
-
-		go func(cb chan Message) {
-			for {
-				m, ok := <-cb
-
-				if !ok {
-					close(cb)
-					break
-				}
-
-				b, _ := m.MarshalBinary()
-				l := len(b)
-
-				i := 0
-				for i < l {
-					a, _ := node.TCPConn.Write(b[i:])
-					i += a
-				}
-			}
-		}(m.Reply)
+		atomic.StoreInt64(&node.lastSeen, time.Now().Unix())
+		m.From = FitBytes([]byte(node.Address), IP_SIZE)
+		m.Peer = node
 
 		Core.Network.IncomingMessages <- *m
 	}
@@ -180,13 +396,20 @@ func ConnectToNode(dst string, timeout time.Duration, retry bool, cb NodeChannel
 	var con *net.TCPConn = nil
 loop:
 	for {
-		breakChannel := make(chan bool)
+		breakChannel := make(chan bool, 1)
 		go func() {
 
 			con, err = net.DialTCP("tcp", nil, addrDst)
 
 			if con != nil {
-				cb <- &Node{con, int(time.Now().Unix())}
+				node := NewNode(con)
+				node.Address = dst
+				if err := node.Handshake(); err != nil {
+					log.Println("Handshake with", dst, "fails:", err)
+					con.Close()
+				} else {
+					cb <- node
+				}
 				breakChannel <- true
 			}
 		}()
@@ -202,21 +425,20 @@ loop:
 	}
 }
 
+// BroadcastMessage sends message to every node but the one it came from. It
+// must run on the Network goroutine, which alone changes Nodes; the sends
+// themselves don't block it.
 func (n *Network) BroadcastMessage(message Message) {
 	originalFrom := message.From
 	message.From = []byte(n.Address)
-	b, _ := message.MarshalBinary()
 
 	for k, node := range n.Nodes {
-		ip, _, _ := net.SplitHostPort(node.TCPConn.RemoteAddr().String())
-		nodeAddr := fmt.Sprintf("%s:%d", ip, BLOCKCHAIN_DEFAULT_PORT)
-
-		if reflect.DeepEqual(originalFrom, FitBytes([]byte(nodeAddr), IP_SIZE)) {
+		if reflect.DeepEqual(originalFrom, FitBytes([]byte(k), IP_SIZE)) {
 			continue
 		}
 		log.Println("Broadcasting...", k)
 		go func() {
-			_, err := node.TCPConn.Write(b)
+			err := node.Send(message)
 			if err != nil {
 				log.Println("Error bcing to", node.TCPConn.RemoteAddr())
 			}
@@ -0,0 +1,163 @@
+package bitcoin
+
+import (
+	"encoding/hex"
+	"errors"
+	"math/big"
+)
+
+// ChainParams describes a network. Nodes of different networks never talk:
+// they frame messages with different magic bytes and start from different
+// genesis blocks.
+type ChainParams struct {
+	Name string
+	// DataDir is the subdirectory of the default data directory holding the
+	// network's nodes
+	DataDir string
+
+	Port         int
+	RPCPort      int
+	ExplorerPort int
+
+	Magic            uint32
+	AddressVersion   byte
+	HDPrivateVersion uint32
+	HDPublicVersion  uint32
+
+	Genesis     Block
+	GenesisHash []byte
+
+	// PowLimit is the easiest target, the one of the first blocks. The
+	// target is retargeted every RetargetInterval blocks for blocks to come
+	// TargetSpacing seconds apart, unless NoRetarget is set.
+	PowLimit         *big.Int
+	RetargetInterval int
+	TargetSpacing    int
+	NoRetarget       bool
+
+	// OnDemandMining starts the node with the miner stopped and allows
+	// blocks to be generated at will
+	OnDemandMining bool
+
+	Subsidy         uint64
+	HalvingInterval int
+}
+
+var MainNetParams = ChainParams{
+	Name:         "mainnet",
+	Port:         9200,
+	RPCPort:      9201,
+	ExplorerPort: 9202,
+
+	Magic:            0xd9b4bef9,
+	AddressVersion:   0x00,
+	HDPrivateVersion: 0x0488ade4,
+	HDPublicVersion:  0x0488b21e,
+
+	Genesis:     genesisBlock(1514764800, 0x1f00ffff, GENESIS_MAINNET_NONCE),
+	GenesisHash: hexBytes(GENESIS_MAINNET_HASH),
+
+	PowLimit:         PrefixTarget(2),
+	RetargetInterval: 10,
+	TargetSpacing:    30,
+
+	Subsidy:         50 * COIN,
+	HalvingInterval: 1000,
+}
+
+var TestNetParams = ChainParams{
+	Name:         "testnet",
+	DataDir:      "testnet",
+	Port:         19200,
+	RPCPort:      19201,
+	ExplorerPort: 19202,
+
+	Magic:            0x0709110b,
+	AddressVersion:   0x6f,
+	HDPrivateVersion: 0x04358394,
+	HDPublicVersion:  0x043587cf,
+
+	Genesis:     genesisBlock(1514764800, 0x2000ffff, GENESIS_TESTNET_NONCE),
+	GenesisHash: hexBytes(GENESIS_TESTNET_HASH),
+
+	PowLimit:         PrefixTarget(1),
+	RetargetInterval: 10,
+	TargetSpacing:    30,
+
+	Subsidy:         50 * COIN,
+	HalvingInterval: 1000,
+}
+
+// RegTestParams is a network for tests: blocks are found at once, the
+// difficulty never changes and blocks are only mined when asked for.
+var RegTestParams = ChainParams{
+	Name:         "regtest",
+	DataDir:      "regtest",
+	Port:         29200,
+	RPCPort:      29201,
+	ExplorerPort: 29202,
+
+	Magic:            0xdab5bffa,
+	AddressVersion:   0x6f,
+	HDPrivateVersion: 0x04358394,
+	HDPublicVersion:  0x043587cf,
+
+	Genesis:     genesisBlock(1514764800, 0x2100ffff, GENESIS_REGTEST_NONCE),
+	GenesisHash: hexBytes(GENESIS_REGTEST_HASH),
+
+	PowLimit:         PrefixTarget(0),
+	RetargetInterval: 10,
+	TargetSpacing:    30,
+	NoRetarget:       true,
+
+	OnDemandMining: true,
+
+	Subsidy:         50 * COIN,
+	HalvingInterval: 150,
+}
+
+// Params is the network the node runs on. It is chosen with SelectParams
+// before the node starts and never changes afterwards.
+var Params = &MainNetParams
+
+var networks = []*ChainParams{&MainNetParams, &TestNetParams, &RegTestParams}
+
+// SelectParams makes the network called name the one of the node.
+func SelectParams(name string) error {
+	for _, p := range networks {
+		if p.Name == name {
+			Params = p
+			return nil
+		}
+	}
+	return errors.New("Unknown network " + name)
+}
+
+// InitialBits is the compact form of PowLimit.
+func (p *ChainParams) InitialBits() uint32 {
+	return BigToCompact(p.PowLimit)
+}
+
+// genesisBlock builds the first block of a network. Its coinbase locks the
+// subsidy with OP_RETURN so nobody can spend it, and it is not signed: nodes
+// accept it by its hash instead of verifying it.
+func genesisBlock(timestamp, bits, nonce uint32) Block {
+	coinbase := Transaction{Header: TransactionHeader{Version: CONSENSUS_VERSION, Timestamp: timestamp}}
+	coinbase.SetPayload(append(coinbasePayload(0), GENESIS_MESSAGE...))
+	coinbase.AddOutput(50*COIN, []byte{OP_RETURN})
+
+	b := NewBlock(make([]byte, 32))
+	b.AddTransaction(coinbase)
+	b.Timestamp, b.Bits, b.Nonce = timestamp, bits, nonce
+	b.MerkelRoot = b.GenerateMerkelRoot()
+
+	return b
+}
+
+func hexBytes(s string) []byte {
+	d, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
@@ -1,18 +1,149 @@
 package bitcoin
 
 import (
-	"reflect"
+	"math/big"
+	"sort"
+	"time"
 )
 
 var (
-	TRANSACTION_POW = ArrayOfBytes(TRANSACTION_POW_COMPLEXITY, POW_PREFIX)
-	BLOCK_POW       = ArrayOfBytes(BLOCK_POW_COMPLEXITY, POW_PREFIX)
+	TRANSACTION_POW = PrefixTarget(TRANSACTION_POW_COMPLEXITY)
 )
 
-func CheckProofOfWork(prefix []byte, hash []byte) bool {
+// PrefixTarget is the target met by hashes starting with the given number of
+// zero bytes.
+func PrefixTarget(zeros int) *big.Int {
+	one := big.NewInt(1)
+	return new(big.Int).Sub(new(big.Int).Lsh(one, uint(256-8*zeros)), one)
+}
+
+func CheckProofOfWork(target *big.Int, hash []byte) bool {
+	return new(big.Int).SetBytes(hash).Cmp(target) <= 0
+}
+
+// CompactToBig expands the compact representation of a target: the high byte
+// is the length of the number in bytes and the low three bytes its most
+// significant digits.
+func CompactToBig(bits uint32) *big.Int {
+	mantissa := int64(bits & 0x007fffff)
+	exponent := uint(bits >> 24)
+
+	target := big.NewInt(mantissa)
+	if exponent <= 3 {
+		return target.Rsh(target, 8*(3-exponent))
+	}
+	return target.Lsh(target, 8*(exponent-3))
+}
+
+func BigToCompact(target *big.Int) uint32 {
+	if target.Sign() <= 0 {
+		return 0
+	}
+
+	exponent := uint(len(target.Bytes()))
+	var mantissa uint32
+	if exponent <= 3 {
+		mantissa = uint32(target.Uint64()) << (8 * (3 - exponent))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(target, 8*(exponent-3)).Uint64())
+	}
+
+	// The mantissa's top bit is a sign bit, keep it clear
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	return uint32(exponent<<24) | mantissa
+}
+
+// BlockWork is the expected number of hashes needed to find a block.
+func BlockWork(b Block) *big.Int {
+	target := CompactToBig(b.Bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, target.Add(target, big.NewInt(1)))
+}
+
+// Difficulty is how many times harder than the easiest one bits is.
+func Difficulty(bits uint32) float64 {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return 0
+	}
+
+	easiest := new(big.Float).SetInt(CompactToBig(Params.InitialBits()))
+	d, _ := new(big.Float).Quo(easiest, new(big.Float).SetInt(target)).Float64()
+	return d
+}
+
+// BlockSubsidy is the newly created value a miner may claim at height.
+func BlockSubsidy(height int) uint64 {
+	halvings := height / Params.HalvingInterval
+	if halvings >= 64 {
+		return 0
+	}
+	return Params.Subsidy >> uint(halvings)
+}
+
+// NextBits returns the difficulty for the block following parent. It changes
+// every RetargetInterval blocks of the network so that the last interval
+// would have taken TargetSpacing seconds per block.
+func NextBits(parent *BlockNode) uint32 {
+	if parent == nil {
+		return Params.InitialBits()
+	}
+	if Params.NoRetarget || (parent.Height+1)%Params.RetargetInterval != 0 {
+		return parent.Bits
+	}
+
+	first := parent
+	for i := 0; i < Params.RetargetInterval-1 && first.Parent != nil; i++ {
+		first = first.Parent
+	}
+
+	expected := int64(Params.RetargetInterval * Params.TargetSpacing)
+	actual := int64(parent.Timestamp) - int64(first.Timestamp)
+	if actual < expected/4 {
+		actual = expected / 4
+	}
+	if actual > expected*4 {
+		actual = expected * 4
+	}
+
+	target := CompactToBig(parent.Bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+	if target.Cmp(Params.PowLimit) > 0 {
+		target = Params.PowLimit
+	}
+
+	return BigToCompact(target)
+}
+
+// MedianTimePast is the median timestamp of node and the blocks before it,
+// BLOCK_MEDIAN_TIME_SPAN of them at most. The block after node must be later.
+func MedianTimePast(node *BlockNode) uint32 {
+	times := []uint32{}
+	for ; node != nil && len(times) < BLOCK_MEDIAN_TIME_SPAN; node = node.Parent {
+		times = append(times, node.Timestamp)
+	}
+	if len(times) == 0 {
+		return 0
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
 
-	if len(prefix) > 0 {
-		return reflect.DeepEqual(prefix, hash[:len(prefix)])
+// blockTime is the current time, or min if the clock is behind it.
+func blockTime(min uint32) uint32 {
+	now := uint32(time.Now().Unix())
+	if now < min {
+		return min
 	}
-	return true
+	return now
 }
@@ -0,0 +1,197 @@
+package bitcoin
+
+import (
+	"math/big"
+	"testing"
+)
+
+func hexBig(s string) *big.Int {
+	n, _ := new(big.Int).SetString(s, 16)
+	return n
+}
+
+func TestCompactToBig(t *testing.T) {
+	tests := []struct {
+		name string
+		bits uint32
+		want *big.Int
+	}{
+		{"zero", 0, big.NewInt(0)},
+		{"one byte", 0x01123456, big.NewInt(0x12)},
+		{"two bytes", 0x02123456, big.NewInt(0x1234)},
+		{"three bytes", 0x03123456, big.NewInt(0x123456)},
+		{"shifted", 0x1d00ffff, hexBig("ffff0000000000000000000000000000000000000000000000000000")},
+		{"sign bit ignored", 0x04923456, big.NewInt(0x12345600)},
+		{"beyond 256 bits", 0x22123456, new(big.Int).Lsh(big.NewInt(0x123456), 8*31)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CompactToBig(tt.bits); got.Cmp(tt.want) != 0 {
+				t.Errorf("CompactToBig(%08x) = %x, want %x", tt.bits, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBigToCompact(t *testing.T) {
+	tests := []struct {
+		name   string
+		target *big.Int
+		want   uint32
+	}{
+		{"zero", big.NewInt(0), 0},
+		{"negative", big.NewInt(-1), 0},
+		{"one byte", big.NewInt(0x12), 0x01120000},
+		{"two bytes", big.NewInt(0x1234), 0x02123400},
+		{"truncated", big.NewInt(0x12345678), 0x04123456},
+		// A mantissa with its top bit set would read as negative: it moves
+		// one byte down and the exponent one up
+		{"mantissa overflow", big.NewInt(0x80), 0x02008000},
+		{"mantissa overflow shifted", big.NewInt(0x92345678), 0x05009234},
+		{"mainnet limit", PrefixTarget(2), 0x1f00ffff},
+		{"regtest limit", PrefixTarget(0), 0x2100ffff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := BigToCompact(tt.target)
+			if got != tt.want {
+				t.Errorf("BigToCompact(%x) = %08x, want %08x", tt.target, got, tt.want)
+			}
+			if got&0x00800000 != 0 {
+				t.Errorf("BigToCompact(%x) sets the sign bit", tt.target)
+			}
+		})
+	}
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	for _, bits := range []uint32{0x01120000, 0x02123400, 0x03123456, 0x04123456, 0x1b0404cb, 0x1d00ffff, 0x1f00ffff, 0x2100ffff} {
+		if got := BigToCompact(CompactToBig(bits)); got != bits {
+			t.Errorf("round trip of %08x gives %08x", bits, got)
+		}
+	}
+
+	// Targets lose the digits below the mantissa, never gain any
+	for _, target := range []*big.Int{big.NewInt(1), big.NewInt(0x7fffff), hexBig("123456789abcdef"), PrefixTarget(1), PrefixTarget(3)} {
+		got := CompactToBig(BigToCompact(target))
+		if got.Cmp(target) > 0 || BigToCompact(got) != BigToCompact(target) {
+			t.Errorf("round trip of %x gives %x", target, got)
+		}
+	}
+}
+
+// testNodeChain links nodes with the given bits and timestamps, the last one
+// being returned as the tip.
+func testNodeChain(bits uint32, times ...uint32) *BlockNode {
+	var tip *BlockNode
+	for i, ts := range times {
+		b := NewBlock(make([]byte, 32))
+		b.Bits, b.Timestamp = bits, ts
+		tip = &BlockNode{Block: b, Parent: tip, Height: i}
+	}
+	return tip
+}
+
+func TestNextBits(t *testing.T) {
+	params := Params
+	Params = &MainNetParams
+	defer func() { Params = params }()
+
+	interval := uint32(Params.RetargetInterval)
+	expected := int64(Params.RetargetInterval * Params.TargetSpacing)
+	bits := uint32(0x1d00ffff)
+
+	// chain has a block every spacing seconds, its tip a retarget away
+	chain := func(bits uint32, spacing uint32) *BlockNode {
+		times := []uint32{}
+		for i := uint32(0); i < interval; i++ {
+			times = append(times, 1514764800+i*spacing)
+		}
+		return testNodeChain(bits, times...)
+	}
+	scaled := func(bits uint32, num, den int64) uint32 {
+		target := CompactToBig(bits)
+		target.Mul(target, big.NewInt(num))
+		return BigToCompact(target.Div(target, big.NewInt(den)))
+	}
+	actual := func(spacing uint32) int64 {
+		return int64((interval - 1) * spacing)
+	}
+	spacing := uint32(Params.TargetSpacing)
+
+	tests := []struct {
+		name   string
+		parent *BlockNode
+		want   uint32
+	}{
+		{"first block", nil, Params.InitialBits()},
+		{"between retargets", testNodeChain(bits, 1514764800, 1514764801), bits},
+		{"on time", chain(bits, spacing), scaled(bits, actual(spacing), expected)},
+		{"twice as fast", chain(bits, spacing/2), scaled(bits, actual(spacing/2), expected)},
+		{"clamped to 4 times harder", chain(bits, 1), scaled(bits, 1, 4)},
+		{"twice as slow", chain(bits, 2*spacing), scaled(bits, actual(2*spacing), expected)},
+		{"clamped to 4 times easier", chain(bits, 100*spacing), scaled(bits, 4, 1)},
+		{"capped at the limit", chain(Params.InitialBits(), 3*spacing), Params.InitialBits()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NextBits(tt.parent); got != tt.want {
+				t.Errorf("NextBits = %08x, want %08x", got, tt.want)
+			}
+		})
+	}
+
+	Params = &RegTestParams
+	if got := NextBits(chain(bits, 1)); got != bits {
+		t.Errorf("NextBits without retarget = %08x, want %08x", got, bits)
+	}
+}
+
+func TestMedianTimePast(t *testing.T) {
+	tests := []struct {
+		name  string
+		times []uint32
+		want  uint32
+	}{
+		{"no block", nil, 0},
+		{"one block", []uint32{100}, 100},
+		{"unordered", []uint32{100, 300, 200}, 200},
+		{"only the last blocks", []uint32{1000, 1000, 1000, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MedianTimePast(testNodeChain(0x2100ffff, tt.times...)); got != tt.want {
+				t.Errorf("MedianTimePast = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckBlockContextTime(t *testing.T) {
+	params := Params
+	Params = &RegTestParams
+	defer func() { Params = params }()
+
+	parent := testNodeChain(Params.InitialBits(), 1514764800, 1514764805, 1514764810)
+	median := MedianTimePast(parent)
+
+	tests := []struct {
+		name      string
+		timestamp uint32
+		ok        bool
+	}{
+		{"before the median", median - 1, false},
+		{"at the median", median, false},
+		{"after the median", median + 1, true},
+		{"before the parent", parent.Timestamp - 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBlock(parent.Hash)
+			b.Bits, b.Timestamp = Params.InitialBits(), tt.timestamp
+			if ok := CheckBlockContext(b, parent); ok != tt.ok {
+				t.Errorf("CheckBlockContext = %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// PartialTransaction is a transaction passed around its signers until the
+// inputs hold enough signatures to be finalized. Spent records the output
+// each input spends, so signers can check amounts and scripts without the
+// UTXO set.
+type PartialTransaction struct {
+	Transaction
+	Spent      []TransactionOutput
+	Signatures [][]PartialSignature
+}
+
+// PartialSignature is the signature of the key Public over the transaction
+// hash.
+type PartialSignature struct {
+	Public    []byte
+	Signature []byte
+}
+
+// NewPartialTransaction wraps t, whose inputs spend the outputs spent, in
+// the same order.
+func NewPartialTransaction(t Transaction, spent []TransactionOutput) (*PartialTransaction, error) {
+	if len(spent) != len(t.Inputs) {
+		return nil, errors.New("Spent outputs do not match inputs")
+	}
+	return &PartialTransaction{Transaction: t, Spent: spent, Signatures: make([][]PartialSignature, len(t.Inputs))}, nil
+}
+
+// signers lists the keys that may sign the input i, and how many
+// signatures it needs.
+func (p *PartialTransaction) signers(i int) (int, [][]byte) {
+	script := p.Spent[i].Script
+	if m, keys := ScriptMultiSig(script); keys != nil {
+		return m, keys
+	}
+	return 1, nil
+}
+
+// canSign tells whether public may sign the input i.
+func (p *PartialTransaction) canSign(i int, public []byte) bool {
+	if keyHash := ScriptKeyHash(p.Spent[i].Script); keyHash != nil {
+		return bytes.Equal(KeyHash(public), keyHash)
+	}
+	_, keys := p.signers(i)
+	for _, k := range keys {
+		if bytes.Equal(k, public) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PartialTransaction) hasSignature(i int, public []byte) bool {
+	for _, s := range p.Signatures[i] {
+		if bytes.Equal(s.Public, public) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddSignature records sig by public on the input i after checking it.
+func (p *PartialTransaction) AddSignature(i int, public, sig []byte) error {
+	if i < 0 || i >= len(p.Inputs) {
+		return errors.New("Unknown input")
+	}
+	if !p.canSign(i, public) {
+		return errors.New("Key cannot sign input " + strconv.Itoa(i))
+	}
+	if !SignatureVerify(p.Header.Version, public, sig, p.Hash()) {
+		return errors.New("Invalid signature for input " + strconv.Itoa(i))
+	}
+	if !p.hasSignature(i, public) {
+		p.Signatures[i] = append(p.Signatures[i], PartialSignature{public, sig})
+	}
+	return nil
+}
+
+// Sign adds the signature of keypair to every input it can sign and returns
+// how many it signed.
+func (p *PartialTransaction) Sign(keypair *Keypair) (int, error) {
+	if keypair.Scheme != p.Header.Version {
+		return 0, nil
+	}
+
+	hash := p.Hash()
+	signed := 0
+	for i := range p.Inputs {
+		if !p.canSign(i, keypair.Public) || p.hasSignature(i, keypair.Public) {
+			continue
+		}
+		sig, err := keypair.Sign(hash)
+		if err != nil {
+			return signed, err
+		}
+		p.Signatures[i] = append(p.Signatures[i], PartialSignature{keypair.Public, sig})
+		signed++
+	}
+	return signed, nil
+}
+
+// Combine adds the signatures of other, which must be a copy of the same
+// transaction.
+func (p *PartialTransaction) Combine(other *PartialTransaction) error {
+	if !bytes.Equal(p.Hash(), other.Hash()) || len(other.Signatures) != len(p.Signatures) {
+		return errors.New("Partial transactions differ")
+	}
+	for i, sigs := range other.Signatures {
+		for _, s := range sigs {
+			if err := p.AddSignature(i, s.Public, s.Signature); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Missing is the number of signatures the input i still needs.
+func (p *PartialTransaction) Missing(i int) int {
+	m, _ := p.signers(i)
+	if len(p.Signatures[i]) >= m {
+		return 0
+	}
+	return m - len(p.Signatures[i])
+}
+
+func (p *PartialTransaction) Complete() bool {
+	for i := range p.Inputs {
+		if p.Missing(i) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Fee is what the spent outputs leave over the outputs created.
+func (p *PartialTransaction) Fee() (uint64, error) {
+	var in, out uint64
+	for _, o := range p.Spent {
+		in += o.Amount
+	}
+	for _, o := range p.Outputs {
+		out += o.Amount
+	}
+	if out > in {
+		return 0, errors.New("Outputs exceed inputs")
+	}
+	return in - out, nil
+}
+
+// Finalize writes the unlocking scripts of the inputs from the signatures
+// and returns the transaction ready to broadcast. Only PayToKeyHash and
+// MultiSigScript outputs can be finalized.
+func (p *PartialTransaction) Finalize() (*Transaction, error) {
+	t := p.Transaction
+	t.Inputs = append([]TransactionInput{}, p.Inputs...)
+
+	for i := range t.Inputs {
+		if p.Missing(i) > 0 {
+			return nil, errors.New("Input " + strconv.Itoa(i) + " misses signatures")
+		}
+
+		if ScriptKeyHash(p.Spent[i].Script) != nil {
+			s := p.Signatures[i][0]
+			t.Inputs[i].Script = SignatureScript(s.Signature, s.Public)
+			continue
+		}
+
+		m, keys := p.signers(i)
+		if keys == nil {
+			return nil, errors.New("Cannot finalize the script of input " + strconv.Itoa(i))
+		}
+
+		// CHECKMULTISIG wants the signatures in the order of the keys
+		sb := &ScriptBuilder{}
+		for _, k := range keys {
+			for _, s := range p.Signatures[i] {
+				if m > 0 && bytes.Equal(s.Public, k) {
+					sb.AddData(s.Signature)
+					m--
+				}
+			}
+		}
+		t.Inputs[i].Script = sb.Script()
+	}
+	return &t, nil
+}
+
+func (p *PartialTransaction) MarshalBinary() ([]byte, error) {
+	bs := &bytes.Buffer{}
+
+	binary.Write(bs, binary.LittleEndian, uint32(PSBT_MAGIC))
+	tb, err := p.Transaction.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	bs.Write(tb)
+
+	for i, out := range p.Spent {
+		ob, _ := out.MarshalBinary()
+		bs.Write(ob)
+
+		bs.WriteByte(byte(len(p.Signatures[i])))
+		for _, s := range p.Signatures[i] {
+			writeBytes(bs, s.Public)
+			writeBytes(bs, s.Signature)
+		}
+	}
+
+	return bs.Bytes(), nil
+}
+
+func (p *PartialTransaction) UnMarshalBinary(d []byte) error {
+	buf := bytes.NewBuffer(d)
+
+	var magic uint32
+	binary.Read(buf, binary.LittleEndian, &magic)
+	if magic != PSBT_MAGIC {
+		return errors.New("Not a partial transaction")
+	}
+
+	rest, err := p.Transaction.UnMarshalBinary(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	p.Spent, p.Signatures = nil, nil
+	for range p.Inputs {
+		out := TransactionOutput{}
+		if rest, err = out.UnMarshalBinary(rest); err != nil {
+			return err
+		}
+		if len(rest) == 0 {
+			return errors.New("Insuficient partial transaction size")
+		}
+
+		buf = bytes.NewBuffer(rest[1:])
+		sigs := make([]PartialSignature, rest[0])
+		for j := range sigs {
+			if sigs[j].Public, err = readBytes(buf); err != nil {
+				return err
+			}
+			if sigs[j].Signature, err = readBytes(buf); err != nil {
+				return err
+			}
+		}
+		rest = buf.Bytes()
+
+		p.Spent = append(p.Spent, out)
+		p.Signatures = append(p.Signatures, sigs)
+	}
+	if len(rest) > 0 {
+		return errors.New("Trailing partial transaction data")
+	}
+	return nil
+}
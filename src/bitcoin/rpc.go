@@ -0,0 +1,1049 @@
+package bitcoin
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RPCRequest struct {
+	JSONRPC string            `json:"jsonrpc"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+	ID      json.RawMessage   `json:"id"`
+}
+
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type RPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result"`
+	Error   *RPCError       `json:"error"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type RPCBlock struct {
+	Hash          string   `json:"hash"`
+	Version       uint32   `json:"version"`
+	Height        int      `json:"height"`
+	Confirmations int      `json:"confirmations"`
+	PrevBlock     string   `json:"prevblock"`
+	MerkelRoot    string   `json:"merkelroot"`
+	Origin        string   `json:"origin"`
+	Timestamp     uint32   `json:"timestamp"`
+	Bits          string   `json:"bits"`
+	Nonce         uint32   `json:"nonce"`
+	Transactions  []string `json:"transactions"`
+}
+
+type RPCInput struct {
+	PrevTransaction string `json:"prevtransaction"`
+	Index           uint32 `json:"index"`
+	Script          string `json:"script"`
+}
+
+type RPCOutput struct {
+	Amount  uint64 `json:"amount"`
+	Address string `json:"address,omitempty"`
+	Script  string `json:"script"`
+}
+
+type RPCTransaction struct {
+	Hash          string      `json:"hash"`
+	Version       uint32      `json:"version"`
+	From          string      `json:"from"`
+	To            string      `json:"to"`
+	Timestamp     uint32      `json:"timestamp"`
+	LockTime      uint32      `json:"locktime"`
+	Payload       string      `json:"payload"`
+	Inputs        []RPCInput  `json:"inputs"`
+	Outputs       []RPCOutput `json:"outputs"`
+	BlockHash     string      `json:"blockhash,omitempty"`
+	Confirmations int         `json:"confirmations"`
+}
+
+type RPCPeer struct {
+	Address   string `json:"address"`
+	Remote    string `json:"remote"`
+	Inbound   bool   `json:"inbound"`
+	LastSeen  int    `json:"lastseen"`
+	Version   uint32 `json:"version"`
+	Services  uint64 `json:"services"`
+	Height    uint32 `json:"height"`
+	UserAgent string `json:"useragent"`
+}
+
+type RPCNodeAddress struct {
+	Address     string `json:"address"`
+	Source      string `json:"source"`
+	Tried       bool   `json:"tried"`
+	LastSeen    uint32 `json:"lastseen"`
+	LastAttempt uint32 `json:"lastattempt"`
+	LastSuccess uint32 `json:"lastsuccess"`
+	Failures    uint32 `json:"failures"`
+}
+
+type RPCMempoolInfo struct {
+	Size  int `json:"size"`
+	Bytes int `json:"bytes"`
+}
+
+type RPCWalletInfo struct {
+	Address   string `json:"address"`
+	PublicKey string `json:"publickey"`
+	Balance   uint64 `json:"balance"`
+	Keys      int    `json:"keys"`
+	Locked    bool   `json:"locked"`
+}
+
+type RPCKey struct {
+	Address   string `json:"address"`
+	PublicKey string `json:"publickey"`
+	Balance   uint64 `json:"balance"`
+	Identity  bool   `json:"identity"`
+	Path      string `json:"path,omitempty"`
+	WatchOnly bool   `json:"watchonly"`
+}
+
+type RPCAddress struct {
+	Valid   bool   `json:"valid"`
+	Error   string `json:"error,omitempty"`
+	KeyHash string `json:"keyhash,omitempty"`
+	Mine    bool   `json:"mine"`
+}
+
+type RPCScript struct {
+	Hex     string `json:"hex"`
+	Asm     string `json:"asm"`
+	Address string `json:"address,omitempty"`
+}
+
+type RPCUnspent struct {
+	Transaction string `json:"transaction"`
+	Index       uint32 `json:"index"`
+	Amount      uint64 `json:"amount"`
+}
+
+type RPCPartialInput struct {
+	Amount     uint64   `json:"amount"`
+	Script     string   `json:"script"`
+	Signatures []string `json:"signatures"`
+	Missing    int      `json:"missing"`
+}
+
+type RPCPartialTransaction struct {
+	Transaction RPCTransaction    `json:"transaction"`
+	Inputs      []RPCPartialInput `json:"inputs"`
+	Fee         uint64            `json:"fee"`
+	Complete    bool              `json:"complete"`
+}
+
+type RPCSignResult struct {
+	PSBT     string `json:"psbt"`
+	Signed   int    `json:"signed"`
+	Complete bool   `json:"complete"`
+}
+
+type RPCMiningInfo struct {
+	Mining       bool    `json:"mining"`
+	Blocks       int     `json:"blocks"`
+	Bits         string  `json:"bits"`
+	Difficulty   float64 `json:"difficulty"`
+	HashesPerSec float64 `json:"hashespersec"`
+	Workers      int     `json:"workers"`
+	PooledTx     int     `json:"pooledtx"`
+}
+
+type rpcHandler func(params []json.RawMessage) (interface{}, error)
+
+var rpcHandlers = map[string]rpcHandler{}
+
+func init() {
+	rpcHandlers["getblockcount"] = rpcGetBlockCount
+	rpcHandlers["getblock"] = rpcGetBlock
+	rpcHandlers["gettransaction"] = rpcGetTransaction
+	rpcHandlers["sendtransaction"] = rpcSendTransaction
+	rpcHandlers["getpeerinfo"] = rpcGetPeerInfo
+	rpcHandlers["addnode"] = rpcAddNode
+	rpcHandlers["getnodeaddresses"] = rpcGetNodeAddresses
+	rpcHandlers["getmempoolinfo"] = rpcGetMempoolInfo
+	rpcHandlers["getmininginfo"] = rpcGetMiningInfo
+	rpcHandlers["setmining"] = rpcSetMining
+	rpcHandlers["generate"] = rpcGenerate
+	rpcHandlers["sendpayment"] = rpcSendPayment
+	rpcHandlers["sendtoscript"] = rpcSendToScript
+	rpcHandlers["decodescript"] = rpcDecodeScript
+	rpcHandlers["createmultisig"] = rpcCreateMultiSig
+	rpcHandlers["listunspent"] = rpcListUnspent
+	rpcHandlers["createpsbt"] = rpcCreatePSBT
+	rpcHandlers["decodepsbt"] = rpcDecodePSBT
+	rpcHandlers["signpsbt"] = rpcSignPSBT
+	rpcHandlers["combinepsbt"] = rpcCombinePSBT
+	rpcHandlers["finalizepsbt"] = rpcFinalizePSBT
+	rpcHandlers["sendmessage"] = rpcSendMessage
+	rpcHandlers["getwalletinfo"] = rpcGetWalletInfo
+	rpcHandlers["listkeys"] = rpcListKeys
+	rpcHandlers["walletunlock"] = rpcWalletUnlock
+	rpcHandlers["walletlock"] = rpcWalletLock
+	rpcHandlers["getnewaddress"] = rpcGetNewAddress
+	rpcHandlers["getxpub"] = rpcGetXpub
+	rpcHandlers["watchxpub"] = rpcWatchXpub
+	rpcHandlers["importkey"] = rpcImportKey
+	rpcHandlers["exportkey"] = rpcExportKey
+	rpcHandlers["validateaddress"] = rpcValidateAddress
+}
+
+// StartRPC serves the JSON-RPC API over HTTP on address. Clients
+// authenticate with the password of a new cookie file in dataDir, which only
+// the user running the node can read.
+func StartRPC(address, dataDir string) error {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	password := hex.EncodeToString(secret)
+
+	cookie := filepath.Join(dataDir, RPC_COOKIE_FILE)
+	os.Remove(cookie)
+	if err := os.WriteFile(cookie, []byte(RPC_COOKIE_USER+":"+password), 0600); err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Addr: address,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handleRPC(w, r, password)
+		}),
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	go func() {
+		log.Println("RPC listening in", address)
+		err := server.ListenAndServe()
+		if err != nil {
+			log.Println("RPC: ", err)
+		}
+	}()
+	return nil
+}
+
+// ReadRPCCookie returns the user and password of the RPC server keeping its
+// data in dataDir.
+func ReadRPCCookie(dataDir string) (string, string, error) {
+	d, err := os.ReadFile(filepath.Join(dataDir, RPC_COOKIE_FILE))
+	if err != nil {
+		return "", "", err
+	}
+	user, password, ok := strings.Cut(strings.TrimSpace(string(d)), ":")
+	if !ok {
+		return "", "", errors.New("Invalid RPC cookie file")
+	}
+	return user, password, nil
+}
+
+// handleRPC runs the request of a client knowing password. Web pages can
+// make browsers post to the server, but not with the password, a JSON
+// content type or without telling their origin.
+func handleRPC(w http.ResponseWriter, r *http.Request, password string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "JSON-RPC requests must be POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "http://"+r.Host {
+		http.Error(w, "Cross-origin requests are not allowed", http.StatusForbidden)
+		return
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(RPC_COOKIE_USER)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="jsonrpc"`)
+		http.Error(w, "Wrong RPC credentials", http.StatusUnauthorized)
+		return
+	}
+	if t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || t != "application/json" {
+		http.Error(w, "JSON-RPC requests must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	req := RPCRequest{}
+	res := RPCResponse{JSONRPC: "2.0"}
+
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MESSAGE_MAX_SIZE)).Decode(&req)
+	if err != nil {
+		res.Error = &RPCError{RPC_PARSE_ERROR, err.Error()}
+	} else if handler, ok := rpcHandlers[req.Method]; !ok {
+		res.ID = req.ID
+		res.Error = &RPCError{RPC_METHOD_NOT_FOUND, "Method not found"}
+	} else {
+		res.ID = req.ID
+		res.Result, err = handler(req.Params)
+		if err != nil {
+			res.Error = &RPCError{RPC_INVALID_PARAMS, err.Error()}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func rpcParam(params []json.RawMessage, i int, v interface{}) error {
+	if i >= len(params) {
+		return errors.New("Missing parameter " + strconv.Itoa(i+1))
+	}
+	return json.Unmarshal(params[i], v)
+}
+
+// rpcScript decodes a hex script, or one written as for AssembleScript.
+func rpcScript(s string) ([]byte, error) {
+	script, err := hex.DecodeString(s)
+	if err != nil {
+		return AssembleScript(s)
+	}
+	return script, CheckScript(script, false)
+}
+
+// rpcHash decodes a hex block or transaction hash.
+func rpcHash(s string) ([]byte, error) {
+	hash, err := hex.DecodeString(s)
+	if err != nil || len(hash) != 32 {
+		return nil, errors.New("Invalid hash")
+	}
+	return hash, nil
+}
+
+func toRPCBlock(b Block, height, tipHeight int) RPCBlock {
+	rb := RPCBlock{
+		Hash:          hex.EncodeToString(b.Hash()),
+		Version:       b.Version,
+		Height:        height,
+		Confirmations: tipHeight - height + 1,
+		PrevBlock:     hex.EncodeToString(FitBytes(b.PrevBlock, 32)),
+		MerkelRoot:    hex.EncodeToString(b.MerkelRoot),
+		Origin:        AddressFromKey(b.Origin),
+		Timestamp:     b.Timestamp,
+		Bits:          strconv.FormatUint(uint64(b.Bits), 16),
+		Nonce:         b.Nonce,
+		Transactions:  []string{},
+	}
+	for _, t := range *b.TransactionSlice {
+		rb.Transactions = append(rb.Transactions, hex.EncodeToString(t.Hash()))
+	}
+	return rb
+}
+
+func toRPCTransaction(t Transaction) RPCTransaction {
+	rt := RPCTransaction{
+		Hash:      hex.EncodeToString(t.Hash()),
+		Version:   t.Header.Version,
+		From:      AddressFromKey(t.Header.From),
+		To:        hex.EncodeToString(t.Header.To),
+		Timestamp: t.Header.Timestamp,
+		LockTime:  t.Header.LockTime,
+		Payload:   string(t.Payload),
+		Inputs:    []RPCInput{},
+		Outputs:   []RPCOutput{},
+	}
+	for _, in := range t.Inputs {
+		script, _ := DisassembleScript(in.Script)
+		rt.Inputs = append(rt.Inputs, RPCInput{hex.EncodeToString(in.PrevTransaction), in.Index, script})
+	}
+	for _, out := range t.Outputs {
+		ro := RPCOutput{Amount: out.Amount}
+		if keyHash := out.KeyHash(); keyHash != nil {
+			ro.Address = EncodeAddress(keyHash)
+		}
+		ro.Script, _ = DisassembleScript(out.Script)
+		rt.Outputs = append(rt.Outputs, ro)
+	}
+	return rt
+}
+
+func rpcGetBlockCount(params []json.RawMessage) (interface{}, error) {
+	var count int
+	Core.BlockChain.Do(func() {
+		count = len(Core.BlockChain.BlockSlice)
+	})
+	return count, nil
+}
+
+// rpcGetBlock takes a block hash or a height of the active chain.
+func rpcGetBlock(params []json.RawMessage) (interface{}, error) {
+	var height int
+	var hash []byte
+
+	var s string
+	if rpcParam(params, 0, &s) == nil {
+		h, err := rpcHash(s)
+		if err != nil {
+			return nil, err
+		}
+		hash = h
+	} else if err := rpcParam(params, 0, &height); err != nil {
+		return nil, errors.New("Expected a block hash or height")
+	}
+
+	var rb *RPCBlock
+	Core.BlockChain.Do(func() {
+		bl := Core.BlockChain
+		if hash != nil {
+			node := bl.Tree.Get(hash)
+			if node == nil {
+				return
+			}
+			r := toRPCBlock(node.Block, node.Height, len(bl.BlockSlice)-1)
+			if !bl.IsActive(node) {
+				r.Confirmations = 0
+			}
+			rb = &r
+		} else if height >= 0 && height < len(bl.BlockSlice) {
+			r := toRPCBlock(bl.BlockSlice[height], height, len(bl.BlockSlice)-1)
+			rb = &r
+		}
+	})
+
+	if rb == nil {
+		return nil, errors.New("Block not found")
+	}
+	return rb, nil
+}
+
+func rpcGetTransaction(params []json.RawMessage) (interface{}, error) {
+	var s string
+	if err := rpcParam(params, 0, &s); err != nil {
+		return nil, err
+	}
+	hash, err := rpcHash(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var rt *RPCTransaction
+	Core.BlockChain.Do(func() {
+		bl := Core.BlockChain
+		t := bl.FindTransaction(hash)
+		if t == nil {
+			return
+		}
+
+		r := toRPCTransaction(*t)
+		if height, ok := bl.transactions[string(hash)]; ok {
+			r.BlockHash = hex.EncodeToString(bl.BlockSlice[height].Hash())
+			r.Confirmations = len(bl.BlockSlice) - height
+		}
+		rt = &r
+	})
+
+	if rt == nil {
+		return nil, errors.New("Transaction not found")
+	}
+	return rt, nil
+}
+
+// rpcSendTransaction takes a hex encoded transaction and relays it.
+func rpcSendTransaction(params []json.RawMessage) (interface{}, error) {
+	var s string
+	if err := rpcParam(params, 0, &s); err != nil {
+		return nil, err
+	}
+	d, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	t := new(Transaction)
+	rest, err := t.UnMarshalBinary(d)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("Trailing transaction data")
+	}
+
+	t.From = nil
+	return rpcSubmit(t)
+}
+
+// rpcSubmit hands t to the BlockChain and returns its hash once it is in the
+// mempool, or why it is not.
+func rpcSubmit(t *Transaction) (interface{}, error) {
+	var err error
+	Core.BlockChain.Do(func() {
+		err = Core.BlockChain.ProcessTransaction(t)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hex.EncodeToString(t.Hash()), nil
+}
+
+func rpcGetPeerInfo(params []json.RawMessage) (interface{}, error) {
+	peers := []RPCPeer{}
+	Core.Network.Do(func() {
+		for _, node := range Core.Network.Nodes {
+			peers = append(peers, toRPCPeer(node))
+		}
+	})
+	return peers, nil
+}
+
+// toRPCPeer must run on the Network goroutine.
+func toRPCPeer(node *Node) RPCPeer {
+	return RPCPeer{
+		Address:   node.Address,
+		Remote:    node.TCPConn.RemoteAddr().String(),
+		Inbound:   node.Inbound,
+		LastSeen:  node.LastSeen(),
+		Version:   node.Peer.Version,
+		Services:  node.Peer.Services,
+		Height:    node.Peer.Height,
+		UserAgent: node.Peer.UserAgent,
+	}
+}
+
+func rpcAddNode(params []json.RawMessage) (interface{}, error) {
+	var address string
+	if err := rpcParam(params, 0, &address); err != nil {
+		return nil, err
+	}
+
+	Core.Network.ConnectionQueue <- address
+	return nil, nil
+}
+
+func rpcGetNodeAddresses(params []json.RawMessage) (interface{}, error) {
+	addresses := []RPCNodeAddress{}
+	for _, e := range Core.Network.Book.Entries() {
+		addresses = append(addresses, RPCNodeAddress{e.Address, e.Source, e.Tried, e.LastSeen, e.LastAttempt, e.LastSuccess, e.Failures})
+	}
+	return addresses, nil
+}
+
+func rpcGetMempoolInfo(params []json.RawMessage) (interface{}, error) {
+	mempool := Core.BlockChain.Mempool
+	return RPCMempoolInfo{mempool.Len(), mempool.Size()}, nil
+}
+
+func rpcGetMiningInfo(params []json.RawMessage) (interface{}, error) {
+	info := RPCMiningInfo{}
+	Core.BlockChain.Do(func() {
+		bl := Core.BlockChain
+		bits := NextBits(bl.Tip)
+
+		info.Blocks = len(bl.BlockSlice)
+		info.Bits = strconv.FormatUint(uint64(bits), 16)
+		info.Difficulty = Difficulty(bits)
+	})
+	info.Mining = Core.BlockChain.Miner.Enabled()
+	info.HashesPerSec = Core.BlockChain.Miner.HashRate()
+	info.Workers = Core.BlockChain.Miner.Workers
+	info.PooledTx = Core.BlockChain.Mempool.Len()
+
+	return info, nil
+}
+
+func rpcSetMining(params []json.RawMessage) (interface{}, error) {
+	var enabled bool
+	if err := rpcParam(params, 0, &enabled); err != nil {
+		return nil, err
+	}
+
+	Core.BlockChain.Miner.SetEnabled(enabled)
+	Core.BlockChain.Do(Core.BlockChain.RefreshTemplate)
+	return enabled, nil
+}
+
+// rpcGenerate takes a number of blocks and optionally the address their
+// coinbases pay, the node's identity by default. It returns the block hashes
+// once they are all connected.
+func rpcGenerate(params []json.RawMessage) (interface{}, error) {
+	if !Params.OnDemandMining {
+		return nil, errors.New("Blocks can only be generated on regtest")
+	}
+
+	var n int
+	if err := rpcParam(params, 0, &n); err != nil {
+		return nil, err
+	}
+	if n < 1 || n > GENERATE_MAX_BLOCKS {
+		return nil, errors.New("Block count out of range")
+	}
+
+	script := PayToKeyHash(KeyHash(Core.Keypair.Public))
+	if len(params) > 1 {
+		var s string
+		if err := rpcParam(params, 1, &s); err != nil {
+			return nil, err
+		}
+		keyHash, err := DecodeAddress(s)
+		if err != nil {
+			return nil, err
+		}
+		script = PayToKeyHash(keyHash)
+	}
+
+	var hashes [][]byte
+	var err error
+	Core.BlockChain.Do(func() {
+		hashes, err = Core.BlockChain.Generate(n, script)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, hash := range hashes {
+		result = append(result, hex.EncodeToString(hash))
+	}
+	return result, nil
+}
+
+// rpcSendPayment takes the address to pay, the amount and optionally the
+// fee.
+func rpcSendPayment(params []json.RawMessage) (interface{}, error) {
+	var s string
+	if err := rpcParam(params, 0, &s); err != nil {
+		return nil, err
+	}
+	keyHash, err := DecodeAddress(s)
+	if err != nil {
+		return nil, err
+	}
+	return rpcPay(params, PayToKeyHash(keyHash))
+}
+
+// rpcSendToScript locks the amount with a script given as in decodescript,
+// and optionally leaves a fee.
+func rpcSendToScript(params []json.RawMessage) (interface{}, error) {
+	var s string
+	if err := rpcParam(params, 0, &s); err != nil {
+		return nil, err
+	}
+	script, err := rpcScript(s)
+	if err != nil {
+		return nil, err
+	}
+	return rpcPay(params, script)
+}
+
+func rpcPay(params []json.RawMessage, script []byte) (interface{}, error) {
+	var amount, fee uint64
+	if err := rpcParam(params, 1, &amount); err != nil {
+		return nil, err
+	}
+	if len(params) > 2 {
+		if err := rpcParam(params, 2, &fee); err != nil {
+			return nil, err
+		}
+	}
+
+	t, err := CreatePayment(script, amount, fee)
+	if err != nil {
+		return nil, err
+	}
+	return rpcSubmit(t)
+}
+
+// rpcDecodeScript takes a hex encoded script, or one written as opcodes,
+// numbers and hex data such as "OP_DUP OP_KEYHASH 0x<keyhash> OP_EQUALVERIFY
+// OP_CHECKSIG".
+func rpcDecodeScript(params []json.RawMessage) (interface{}, error) {
+	var s string
+	if err := rpcParam(params, 0, &s); err != nil {
+		return nil, err
+	}
+
+	script, err := rpcScript(s)
+	if err != nil {
+		return nil, err
+	}
+	return toRPCScript(script), nil
+}
+
+func toRPCScript(script []byte) RPCScript {
+	asm, _ := DisassembleScript(script)
+	rs := RPCScript{Hex: hex.EncodeToString(script), Asm: asm}
+	if keyHash := ScriptKeyHash(script); keyHash != nil {
+		rs.Address = EncodeAddress(keyHash)
+	}
+	return rs
+}
+
+// rpcCreateMultiSig takes the number of signatures required and the keys,
+// as hex public keys or addresses of our wallet, and returns the script
+// locking to them.
+func rpcCreateMultiSig(params []json.RawMessage) (interface{}, error) {
+	var m int
+	var names []string
+	if err := rpcParam(params, 0, &m); err != nil {
+		return nil, err
+	}
+	if err := rpcParam(params, 1, &names); err != nil {
+		return nil, err
+	}
+
+	keys := [][]byte{}
+	for _, name := range names {
+		if keyHash, err := DecodeAddress(name); err == nil {
+			public := Core.Wallet.Lookup(keyHash)
+			if public == nil {
+				return nil, errors.New("Address not in wallet: " + name)
+			}
+			keys = append(keys, public)
+			continue
+		}
+
+		public, err := hex.DecodeString(name)
+		if err != nil {
+			return nil, errors.New("Invalid key: " + name)
+		}
+		keys = append(keys, public)
+	}
+
+	script, err := MultiSigScript(m, keys)
+	if err != nil {
+		return nil, err
+	}
+	return toRPCScript(script), nil
+}
+
+// rpcListUnspent lists the outputs locked with a script.
+func rpcListUnspent(params []json.RawMessage) (interface{}, error) {
+	var s string
+	if err := rpcParam(params, 0, &s); err != nil {
+		return nil, err
+	}
+	script, err := rpcScript(s)
+	if err != nil {
+		return nil, err
+	}
+
+	unspent := []RPCUnspent{}
+	for _, uo := range Core.BlockChain.UTXO.UnspentScript(script) {
+		unspent = append(unspent, RPCUnspent{hex.EncodeToString(uo.Transaction), uo.Index, uo.Amount})
+	}
+	return unspent, nil
+}
+
+func rpcPSBT(params []json.RawMessage, i int) (*PartialTransaction, error) {
+	var s string
+	if err := rpcParam(params, i, &s); err != nil {
+		return nil, err
+	}
+	return decodePSBT(s)
+}
+
+func decodePSBT(s string) (*PartialTransaction, error) {
+	d, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := new(PartialTransaction)
+	if err := p.UnMarshalBinary(d); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func encodePSBT(p *PartialTransaction) (string, error) {
+	d, err := p.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(d), nil
+}
+
+// rpcCreatePSBT takes the script of the funds to spend, the address or
+// script to pay, the amount and optionally the fee, and returns a partially
+// signed transaction for signpsbt.
+func rpcCreatePSBT(params []json.RawMessage) (interface{}, error) {
+	var s, to string
+	var amount, fee uint64
+	if err := rpcParam(params, 0, &s); err != nil {
+		return nil, err
+	}
+	if err := rpcParam(params, 1, &to); err != nil {
+		return nil, err
+	}
+	if err := rpcParam(params, 2, &amount); err != nil {
+		return nil, err
+	}
+	if len(params) > 3 {
+		if err := rpcParam(params, 3, &fee); err != nil {
+			return nil, err
+		}
+	}
+
+	from, err := rpcScript(s)
+	if err != nil {
+		return nil, err
+	}
+	var script []byte
+	if keyHash, err := DecodeAddress(to); err == nil {
+		script = PayToKeyHash(keyHash)
+	} else if script, err = rpcScript(to); err != nil {
+		return nil, err
+	}
+
+	p, err := CreatePartialPayment(from, script, amount, fee)
+	if err != nil {
+		return nil, err
+	}
+	return encodePSBT(p)
+}
+
+func rpcDecodePSBT(params []json.RawMessage) (interface{}, error) {
+	p, err := rpcPSBT(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	rp := RPCPartialTransaction{Transaction: toRPCTransaction(p.Transaction), Inputs: []RPCPartialInput{}, Complete: p.Complete()}
+	if rp.Fee, err = p.Fee(); err != nil {
+		return nil, err
+	}
+	for i, out := range p.Spent {
+		ri := RPCPartialInput{Amount: out.Amount, Signatures: []string{}, Missing: p.Missing(i)}
+		ri.Script, _ = DisassembleScript(out.Script)
+		for _, s := range p.Signatures[i] {
+			ri.Signatures = append(ri.Signatures, hex.EncodeToString(s.Public))
+		}
+		rp.Inputs = append(rp.Inputs, ri)
+	}
+	return rp, nil
+}
+
+// rpcSignPSBT adds the signatures of our wallet keys.
+func rpcSignPSBT(params []json.RawMessage) (interface{}, error) {
+	p, err := rpcPSBT(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	signed, err := SignPartial(p)
+	if err != nil {
+		return nil, err
+	}
+	s, err := encodePSBT(p)
+	if err != nil {
+		return nil, err
+	}
+	return RPCSignResult{s, signed, p.Complete()}, nil
+}
+
+// rpcCombinePSBT merges the signatures of copies of a partially signed
+// transaction.
+func rpcCombinePSBT(params []json.RawMessage) (interface{}, error) {
+	var copies []string
+	if err := rpcParam(params, 0, &copies); err != nil {
+		return nil, err
+	}
+	if len(copies) == 0 {
+		return nil, errors.New("No partial transaction")
+	}
+
+	var p *PartialTransaction
+	for _, s := range copies {
+		other, err := decodePSBT(s)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			p = other
+		} else if err := p.Combine(other); err != nil {
+			return nil, err
+		}
+	}
+	return encodePSBT(p)
+}
+
+// rpcFinalizePSBT returns the hex transaction of a complete partially signed
+// transaction, for sendtransaction.
+func rpcFinalizePSBT(params []json.RawMessage) (interface{}, error) {
+	p, err := rpcPSBT(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := p.Finalize()
+	if err != nil {
+		return nil, err
+	}
+	d, err := t.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return hex.EncodeToString(d), nil
+}
+
+func rpcSendMessage(params []json.RawMessage) (interface{}, error) {
+	var text string
+	if err := rpcParam(params, 0, &text); err != nil {
+		return nil, err
+	}
+
+	return rpcSubmit(CreateTransaction(text))
+}
+
+func rpcGetWalletInfo(params []json.RawMessage) (interface{}, error) {
+	return RPCWalletInfo{
+		Address:   AddressFromKey(Core.Keypair.Public),
+		PublicKey: hex.EncodeToString(Core.Keypair.Public),
+		Balance:   Core.BlockChain.UTXO.Balance(KeyHash(Core.Keypair.Public)),
+		Keys:      len(Core.Wallet.Keys()),
+		Locked:    Core.Wallet.Locked(),
+	}, nil
+}
+
+func rpcListKeys(params []json.RawMessage) (interface{}, error) {
+	keys := []RPCKey{}
+	for i, k := range Core.Wallet.List() {
+		keys = append(keys, RPCKey{
+			Address:   AddressFromKey(k.Public),
+			PublicKey: hex.EncodeToString(k.Public),
+			Balance:   Core.BlockChain.UTXO.Balance(KeyHash(k.Public)),
+			Identity:  i == 0,
+			Path:      k.Path,
+			WatchOnly: k.WatchOnly,
+		})
+	}
+	return keys, nil
+}
+
+// rpcWalletUnlock takes the passphrase and the number of seconds the wallet
+// stays unlocked, 0 meaning until walletlock.
+func rpcWalletUnlock(params []json.RawMessage) (interface{}, error) {
+	var passphrase string
+	var seconds int
+	if err := rpcParam(params, 0, &passphrase); err != nil {
+		return nil, err
+	}
+	if len(params) > 1 {
+		if err := rpcParam(params, 1, &seconds); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := Core.Wallet.Unlock(passphrase, time.Duration(seconds)*time.Second); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func rpcWalletLock(params []json.RawMessage) (interface{}, error) {
+	Core.Wallet.Lock()
+	return nil, nil
+}
+
+func rpcGetNewAddress(params []json.RawMessage) (interface{}, error) {
+	public, err := Core.Wallet.NewReceiveKey()
+	if err != nil {
+		return nil, err
+	}
+	return AddressFromKey(public), nil
+}
+
+func rpcGetXpub(params []json.RawMessage) (interface{}, error) {
+	xpub, err := Core.Wallet.ReceiveExtendedKey()
+	if err != nil {
+		return nil, err
+	}
+	return xpub.String(), nil
+}
+
+// rpcWatchXpub takes an extended public key and optionally how many of its
+// addresses to watch, WALLET_GAP_LIMIT by default. It returns the addresses
+// added.
+func rpcWatchXpub(params []json.RawMessage) (interface{}, error) {
+	var s string
+	count := WALLET_GAP_LIMIT
+	if err := rpcParam(params, 0, &s); err != nil {
+		return nil, err
+	}
+	if len(params) > 1 {
+		if err := rpcParam(params, 1, &count); err != nil {
+			return nil, err
+		}
+	}
+
+	xpub, err := ParseExtendedKey(s)
+	if err != nil {
+		return nil, err
+	}
+	added, err := Core.Wallet.Watch(xpub, count)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := []string{}
+	for _, k := range added {
+		addresses = append(addresses, AddressFromKey(k))
+	}
+	return addresses, nil
+}
+
+func rpcImportKey(params []json.RawMessage) (interface{}, error) {
+	var s string
+	if err := rpcParam(params, 0, &s); err != nil {
+		return nil, err
+	}
+	private, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	kp, err := Core.Wallet.Import(private)
+	if err != nil {
+		return nil, err
+	}
+	return AddressFromKey(kp.Public), nil
+}
+
+// rpcExportKey returns the hex private key of an address of the wallet.
+func rpcExportKey(params []json.RawMessage) (interface{}, error) {
+	var s string
+	if err := rpcParam(params, 0, &s); err != nil {
+		return nil, err
+	}
+	keyHash, err := DecodeAddress(s)
+	if err != nil {
+		return nil, err
+	}
+
+	public := Core.Wallet.Lookup(keyHash)
+	if public == nil {
+		return nil, errors.New("Key not in wallet")
+	}
+	kp, err := Core.Wallet.Keypair(public)
+	if err != nil {
+		return nil, err
+	}
+	return hex.EncodeToString(kp.Private), nil
+}
+
+func rpcValidateAddress(params []json.RawMessage) (interface{}, error) {
+	var s string
+	if err := rpcParam(params, 0, &s); err != nil {
+		return nil, err
+	}
+
+	keyHash, err := DecodeAddress(s)
+	if err != nil {
+		return RPCAddress{Error: err.Error()}, nil
+	}
+	return RPCAddress{Valid: true, KeyHash: hex.EncodeToString(keyHash), Mine: Core.Wallet.Lookup(keyHash) != nil}, nil
+}
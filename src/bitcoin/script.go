@@ -0,0 +1,766 @@
+package bitcoin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Outputs are locked by a script and inputs unlock them with another one.
+// The unlocking script may only push data; it runs first and the locking
+// script then runs on the stack it left. The input is valid if the locking
+// script ends with a true value on top of the stack. Opcodes follow the
+// numbering of Bitcoin, OP_KEYHASH standing for OP_HASH160.
+const (
+	OP_0         = 0x00
+	OP_PUSHDATA1 = 0x4c
+	OP_PUSHDATA2 = 0x4d
+	OP_1NEGATE   = 0x4f
+	OP_1         = 0x51
+	OP_16        = 0x60
+
+	OP_NOP    = 0x61
+	OP_IF     = 0x63
+	OP_NOTIF  = 0x64
+	OP_ELSE   = 0x67
+	OP_ENDIF  = 0x68
+	OP_VERIFY = 0x69
+	OP_RETURN = 0x6a
+
+	OP_DROP = 0x75
+	OP_DUP  = 0x76
+	OP_OVER = 0x78
+	OP_SWAP = 0x7c
+	OP_SIZE = 0x82
+
+	OP_EQUAL          = 0x87
+	OP_EQUALVERIFY    = 0x88
+	OP_NOT            = 0x91
+	OP_ADD            = 0x93
+	OP_SUB            = 0x94
+	OP_NUMEQUAL       = 0x9c
+	OP_NUMEQUALVERIFY = 0x9d
+	OP_LESSTHAN       = 0x9f
+	OP_GREATERTHAN    = 0xa0
+
+	OP_SHA256              = 0xa8
+	OP_KEYHASH             = 0xa9
+	OP_HASH256             = 0xaa
+	OP_CHECKSIG            = 0xac
+	OP_CHECKSIGVERIFY      = 0xad
+	OP_CHECKMULTISIG       = 0xae
+	OP_CHECKMULTISIGVERIFY = 0xaf
+
+	OP_CHECKLOCKTIMEVERIFY = 0xb1
+)
+
+var opcodeNames = map[byte]string{
+	OP_0:                   "OP_0",
+	OP_PUSHDATA1:           "OP_PUSHDATA1",
+	OP_PUSHDATA2:           "OP_PUSHDATA2",
+	OP_1NEGATE:             "OP_1NEGATE",
+	OP_NOP:                 "OP_NOP",
+	OP_IF:                  "OP_IF",
+	OP_NOTIF:               "OP_NOTIF",
+	OP_ELSE:                "OP_ELSE",
+	OP_ENDIF:               "OP_ENDIF",
+	OP_VERIFY:              "OP_VERIFY",
+	OP_RETURN:              "OP_RETURN",
+	OP_DROP:                "OP_DROP",
+	OP_DUP:                 "OP_DUP",
+	OP_OVER:                "OP_OVER",
+	OP_SWAP:                "OP_SWAP",
+	OP_SIZE:                "OP_SIZE",
+	OP_EQUAL:               "OP_EQUAL",
+	OP_EQUALVERIFY:         "OP_EQUALVERIFY",
+	OP_NOT:                 "OP_NOT",
+	OP_ADD:                 "OP_ADD",
+	OP_SUB:                 "OP_SUB",
+	OP_NUMEQUAL:            "OP_NUMEQUAL",
+	OP_NUMEQUALVERIFY:      "OP_NUMEQUALVERIFY",
+	OP_LESSTHAN:            "OP_LESSTHAN",
+	OP_GREATERTHAN:         "OP_GREATERTHAN",
+	OP_SHA256:              "OP_SHA256",
+	OP_KEYHASH:             "OP_KEYHASH",
+	OP_HASH256:             "OP_HASH256",
+	OP_CHECKSIG:            "OP_CHECKSIG",
+	OP_CHECKSIGVERIFY:      "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+}
+
+func init() {
+	for i := 1; i <= 16; i++ {
+		opcodeNames[byte(OP_1+i-1)] = "OP_" + strconv.Itoa(i)
+	}
+}
+
+// ScriptBuilder appends opcodes and pushes to a script.
+type ScriptBuilder struct {
+	bytes.Buffer
+}
+
+func (s *ScriptBuilder) AddOp(op byte) *ScriptBuilder {
+	s.WriteByte(op)
+	return s
+}
+
+// AddData pushes d with the shortest push opcode.
+func (s *ScriptBuilder) AddData(d []byte) *ScriptBuilder {
+	switch {
+	case len(d) < OP_PUSHDATA1:
+		s.WriteByte(byte(len(d)))
+	case len(d) <= 0xff:
+		s.WriteByte(OP_PUSHDATA1)
+		s.WriteByte(byte(len(d)))
+	default:
+		s.WriteByte(OP_PUSHDATA2)
+		binary.Write(s, binary.LittleEndian, uint16(len(d)))
+	}
+	s.Write(d)
+	return s
+}
+
+// AddInt pushes n, with a small integer opcode when there is one.
+func (s *ScriptBuilder) AddInt(n int64) *ScriptBuilder {
+	switch {
+	case n == 0:
+		return s.AddOp(OP_0)
+	case n == -1:
+		return s.AddOp(OP_1NEGATE)
+	case n >= 1 && n <= 16:
+		return s.AddOp(byte(OP_1 + n - 1))
+	}
+	return s.AddData(scriptNum(n))
+}
+
+func (s *ScriptBuilder) Script() []byte {
+	return append([]byte{}, s.Bytes()...)
+}
+
+// PayToKeyHash locks an output to the key hashing to keyHash. It is unlocked
+// by a signature and the key.
+func PayToKeyHash(keyHash []byte) []byte {
+	s := &ScriptBuilder{}
+	s.AddOp(OP_DUP).AddOp(OP_KEYHASH).AddData(FitBytes(keyHash, ADDRESS_HASH_SIZE)).AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG)
+	return s.Script()
+}
+
+// MultiSigScript locks an output to m signatures of the keys, given in the
+// order of the keys.
+func MultiSigScript(m int, keys [][]byte) ([]byte, error) {
+	if m < 1 || m > len(keys) || len(keys) > SCRIPT_MAX_MULTISIG_KEYS {
+		return nil, errors.New("Invalid multisig key count")
+	}
+
+	s := &ScriptBuilder{}
+	s.AddInt(int64(m))
+	for _, k := range keys {
+		s.AddData(k)
+	}
+	s.AddInt(int64(len(keys))).AddOp(OP_CHECKMULTISIG)
+	return s.Script(), nil
+}
+
+// SignatureScript unlocks a PayToKeyHash output.
+func SignatureScript(sig, public []byte) []byte {
+	s := &ScriptBuilder{}
+	s.AddData(sig).AddData(public)
+	return s.Script()
+}
+
+// ScriptKeyHash returns the key hash of a PayToKeyHash script, or nil for
+// any other script.
+func ScriptKeyHash(script []byte) []byte {
+	if len(script) != 5+ADDRESS_HASH_SIZE ||
+		script[0] != OP_DUP || script[1] != OP_KEYHASH || script[2] != ADDRESS_HASH_SIZE ||
+		script[3+ADDRESS_HASH_SIZE] != OP_EQUALVERIFY || script[4+ADDRESS_HASH_SIZE] != OP_CHECKSIG {
+		return nil
+	}
+	return script[3 : 3+ADDRESS_HASH_SIZE]
+}
+
+// ScriptMultiSig returns the signature count and keys of a MultiSigScript,
+// or 0 and nil for any other script.
+func ScriptMultiSig(script []byte) (int, [][]byte) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) < 4 || ops[len(ops)-1].Code != OP_CHECKMULTISIG {
+		return 0, nil
+	}
+
+	m, n := ops[0].number(), ops[len(ops)-2].number()
+	if m < 1 || m > n || n != len(ops)-3 || n > SCRIPT_MAX_MULTISIG_KEYS {
+		return 0, nil
+	}
+
+	keys := [][]byte{}
+	for _, op := range ops[1 : len(ops)-2] {
+		if op.Data == nil || op.Code > OP_PUSHDATA2 {
+			return 0, nil
+		}
+		keys = append(keys, op.Data)
+	}
+	return m, keys
+}
+
+type scriptOp struct {
+	Code byte
+	Data []byte
+}
+
+// parseScript splits script into its opcodes and pushed data.
+func parseScript(script []byte) ([]scriptOp, error) {
+	if len(script) > SCRIPT_MAX_SIZE {
+		return nil, errors.New("Script too large")
+	}
+
+	ops := []scriptOp{}
+	for i := 0; i < len(script); {
+		op := scriptOp{Code: script[i]}
+		i++
+
+		n := -1
+		switch {
+		case op.Code > OP_0 && op.Code < OP_PUSHDATA1:
+			n = int(op.Code)
+		case op.Code == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, errors.New("Truncated script push")
+			}
+			n = int(script[i])
+			i++
+		case op.Code == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, errors.New("Truncated script push")
+			}
+			n = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		}
+
+		if n >= 0 {
+			if i+n > len(script) {
+				return nil, errors.New("Truncated script push")
+			}
+			op.Data = script[i : i+n]
+			i += n
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// number is the value a push of a number puts on the stack, or -1.
+func (op scriptOp) number() int {
+	if op.Code >= OP_1 && op.Code <= OP_16 {
+		return int(op.Code-OP_1) + 1
+	}
+	if op.Code == OP_0 || op.Code > OP_PUSHDATA2 {
+		return -1
+	}
+	n, err := parseScriptNum(op.Data, 4)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return int(n)
+}
+
+func (op scriptOp) isPush() bool {
+	return op.Code <= OP_PUSHDATA2 || op.Code == OP_1NEGATE || (op.Code >= OP_1 && op.Code <= OP_16)
+}
+
+// CheckScript tells whether script parses, and for an unlocking script
+// whether it only pushes data.
+func CheckScript(script []byte, unlocking bool) error {
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if len(op.Data) > SCRIPT_MAX_ELEMENT_SIZE {
+			return errors.New("Script push too large")
+		}
+		if unlocking && !op.isPush() {
+			return errors.New("Unlocking script must only push data")
+		}
+	}
+	return nil
+}
+
+// VerifyScript runs the unlocking script of an input of t and the locking
+// script of the output it spends. hash is the hash of t, which
+// signatures are checked against.
+func VerifyScript(unlock, lock []byte, t *Transaction, hash []byte) error {
+	if err := CheckScript(unlock, true); err != nil {
+		return err
+	}
+
+	vm := &scriptVM{tx: t, hash: hash}
+	if err := vm.run(unlock); err != nil {
+		return err
+	}
+	if err := vm.run(lock); err != nil {
+		return err
+	}
+	if len(vm.stack) == 0 || !scriptBool(vm.stack[len(vm.stack)-1]) {
+		return errors.New("Script evaluates to false")
+	}
+	return nil
+}
+
+type scriptVM struct {
+	tx    *Transaction
+	hash  []byte
+	stack [][]byte
+}
+
+func (vm *scriptVM) push(d []byte) error {
+	if len(vm.stack) >= SCRIPT_MAX_STACK_SIZE {
+		return errors.New("Script stack overflow")
+	}
+	vm.stack = append(vm.stack, d)
+	return nil
+}
+
+func (vm *scriptVM) pop() ([]byte, error) {
+	if len(vm.stack) == 0 {
+		return nil, errors.New("Script stack underflow")
+	}
+	d := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return d, nil
+}
+
+func (vm *scriptVM) popInt(size int) (int64, error) {
+	d, err := vm.pop()
+	if err != nil {
+		return 0, err
+	}
+	return parseScriptNum(d, size)
+}
+
+func (vm *scriptVM) pushBool(b bool) error {
+	if b {
+		return vm.push([]byte{1})
+	}
+	return vm.push(nil)
+}
+
+func (vm *scriptVM) run(script []byte) error {
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+
+	// exec holds one entry per open OP_IF, telling whether its branch runs
+	exec := []bool{}
+	executing := func() bool {
+		for _, e := range exec {
+			if !e {
+				return false
+			}
+		}
+		return true
+	}
+
+	for count, op := range ops {
+		if count >= SCRIPT_MAX_OPS {
+			return errors.New("Script too long")
+		}
+		if len(op.Data) > SCRIPT_MAX_ELEMENT_SIZE {
+			return errors.New("Script push too large")
+		}
+
+		switch op.Code {
+		case OP_IF, OP_NOTIF:
+			branch := false
+			if executing() {
+				d, err := vm.pop()
+				if err != nil {
+					return err
+				}
+				branch = scriptBool(d) == (op.Code == OP_IF)
+			}
+			exec = append(exec, branch)
+			continue
+		case OP_ELSE:
+			if len(exec) == 0 {
+				return errors.New("OP_ELSE without OP_IF")
+			}
+			exec[len(exec)-1] = !exec[len(exec)-1]
+			continue
+		case OP_ENDIF:
+			if len(exec) == 0 {
+				return errors.New("OP_ENDIF without OP_IF")
+			}
+			exec = exec[:len(exec)-1]
+			continue
+		}
+
+		if !executing() {
+			continue
+		}
+		if err := vm.step(op); err != nil {
+			return err
+		}
+	}
+
+	if len(exec) != 0 {
+		return errors.New("Unbalanced conditional")
+	}
+	return nil
+}
+
+func (vm *scriptVM) step(op scriptOp) error {
+	switch {
+	case op.Code == OP_0 || op.Code < OP_PUSHDATA1 || op.Code == OP_PUSHDATA1 || op.Code == OP_PUSHDATA2:
+		return vm.push(op.Data)
+	case op.Code == OP_1NEGATE:
+		return vm.push(scriptNum(-1))
+	case op.Code >= OP_1 && op.Code <= OP_16:
+		return vm.push(scriptNum(int64(op.Code - OP_1 + 1)))
+	}
+
+	switch op.Code {
+	case OP_NOP:
+		return nil
+
+	case OP_VERIFY:
+		d, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		if !scriptBool(d) {
+			return errors.New("OP_VERIFY fails")
+		}
+		return nil
+
+	case OP_RETURN:
+		return errors.New("OP_RETURN")
+
+	case OP_DROP:
+		_, err := vm.pop()
+		return err
+
+	case OP_DUP, OP_OVER:
+		depth := 1
+		if op.Code == OP_OVER {
+			depth = 2
+		}
+		if len(vm.stack) < depth {
+			return errors.New("Script stack underflow")
+		}
+		return vm.push(vm.stack[len(vm.stack)-depth])
+
+	case OP_SWAP:
+		l := len(vm.stack)
+		if l < 2 {
+			return errors.New("Script stack underflow")
+		}
+		vm.stack[l-1], vm.stack[l-2] = vm.stack[l-2], vm.stack[l-1]
+		return nil
+
+	case OP_SIZE:
+		if len(vm.stack) == 0 {
+			return errors.New("Script stack underflow")
+		}
+		return vm.push(scriptNum(int64(len(vm.stack[len(vm.stack)-1]))))
+
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		b, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		if op.Code == OP_EQUALVERIFY {
+			if !bytes.Equal(a, b) {
+				return errors.New("OP_EQUALVERIFY fails")
+			}
+			return nil
+		}
+		return vm.pushBool(bytes.Equal(a, b))
+
+	case OP_NOT:
+		n, err := vm.popInt(4)
+		if err != nil {
+			return err
+		}
+		return vm.pushBool(n == 0)
+
+	case OP_ADD, OP_SUB, OP_NUMEQUAL, OP_NUMEQUALVERIFY, OP_LESSTHAN, OP_GREATERTHAN:
+		b, err := vm.popInt(4)
+		if err != nil {
+			return err
+		}
+		a, err := vm.popInt(4)
+		if err != nil {
+			return err
+		}
+
+		switch op.Code {
+		case OP_ADD:
+			return vm.push(scriptNum(a + b))
+		case OP_SUB:
+			return vm.push(scriptNum(a - b))
+		case OP_NUMEQUAL:
+			return vm.pushBool(a == b)
+		case OP_NUMEQUALVERIFY:
+			if a != b {
+				return errors.New("OP_NUMEQUALVERIFY fails")
+			}
+			return nil
+		case OP_LESSTHAN:
+			return vm.pushBool(a < b)
+		default:
+			return vm.pushBool(a > b)
+		}
+
+	case OP_SHA256, OP_KEYHASH, OP_HASH256:
+		d, err := vm.pop()
+		if err != nil {
+			return err
+		}
+
+		switch op.Code {
+		case OP_SHA256:
+			h := sha256.Sum256(d)
+			return vm.push(h[:])
+		case OP_KEYHASH:
+			return vm.push(KeyHash(d))
+		default:
+			first := sha256.Sum256(d)
+			second := sha256.Sum256(first[:])
+			return vm.push(second[:])
+		}
+
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		public, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		sig, err := vm.pop()
+		if err != nil {
+			return err
+		}
+
+		ok := SignatureVerify(vm.tx.Header.Version, public, sig, vm.hash)
+		if op.Code == OP_CHECKSIGVERIFY {
+			if !ok {
+				return errors.New("OP_CHECKSIGVERIFY fails")
+			}
+			return nil
+		}
+		return vm.pushBool(ok)
+
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		ok, err := vm.checkMultiSig()
+		if err != nil {
+			return err
+		}
+		if op.Code == OP_CHECKMULTISIGVERIFY {
+			if !ok {
+				return errors.New("OP_CHECKMULTISIGVERIFY fails")
+			}
+			return nil
+		}
+		return vm.pushBool(ok)
+
+	case OP_CHECKLOCKTIMEVERIFY:
+		if len(vm.stack) == 0 {
+			return errors.New("Script stack underflow")
+		}
+		lockTime, err := parseScriptNum(vm.stack[len(vm.stack)-1], 5)
+		if err != nil {
+			return err
+		}
+
+		// Heights and times do not compare, and the transaction must not be
+		// final before lockTime
+		txLockTime := int64(vm.tx.Header.LockTime)
+		if lockTime < 0 ||
+			(lockTime < LOCKTIME_THRESHOLD) != (txLockTime < LOCKTIME_THRESHOLD) ||
+			lockTime > txLockTime {
+			return errors.New("OP_CHECKLOCKTIMEVERIFY fails")
+		}
+		return nil
+	}
+
+	return errors.New("Unknown opcode " + strconv.Itoa(int(op.Code)))
+}
+
+// checkMultiSig pops n keys, then m signatures in the order of their keys.
+func (vm *scriptVM) checkMultiSig() (bool, error) {
+	n, err := vm.popInt(4)
+	if err != nil {
+		return false, err
+	}
+	if n < 0 || n > SCRIPT_MAX_MULTISIG_KEYS {
+		return false, errors.New("Invalid multisig key count")
+	}
+	keys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if keys[i], err = vm.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	m, err := vm.popInt(4)
+	if err != nil {
+		return false, err
+	}
+	if m < 0 || m > n {
+		return false, errors.New("Invalid multisig signature count")
+	}
+	sigs := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		if sigs[i], err = vm.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	k := 0
+	for _, sig := range sigs {
+		for k < len(keys) && !SignatureVerify(vm.tx.Header.Version, keys[k], sig, vm.hash) {
+			k++
+		}
+		if k == len(keys) {
+			return false, nil
+		}
+		k++
+	}
+	return true, nil
+}
+
+// scriptBool is false for an empty item, zeros and negative zero.
+func scriptBool(d []byte) bool {
+	for i, b := range d {
+		if b != 0 && !(i == len(d)-1 && b == 0x80) {
+			return true
+		}
+	}
+	return false
+}
+
+// scriptNum encodes n in little endian with a sign bit, on as few bytes as
+// possible.
+func scriptNum(n int64) []byte {
+	if n == 0 {
+		return nil
+	}
+
+	negative := n < 0
+	if negative {
+		n = -n
+	}
+	d := []byte{}
+	for n > 0 {
+		d = append(d, byte(n))
+		n >>= 8
+	}
+
+	if d[len(d)-1]&0x80 != 0 {
+		d = append(d, 0)
+	}
+	if negative {
+		d[len(d)-1] |= 0x80
+	}
+	return d
+}
+
+func parseScriptNum(d []byte, size int) (int64, error) {
+	if len(d) > size {
+		return 0, errors.New("Script number too large")
+	}
+	if len(d) == 0 {
+		return 0, nil
+	}
+	if d[len(d)-1]&0x7f == 0 && (len(d) == 1 || d[len(d)-2]&0x80 == 0) {
+		return 0, errors.New("Script number not minimally encoded")
+	}
+
+	var n int64
+	for i, b := range d {
+		n |= int64(b) << (8 * uint(i))
+	}
+	if d[len(d)-1]&0x80 != 0 {
+		n &^= int64(0x80) << (8 * uint(len(d)-1))
+		n = -n
+	}
+	return n, nil
+}
+
+// DisassembleScript writes script as opcode names, numbers and hex data.
+func DisassembleScript(script []byte) (string, error) {
+	ops, err := parseScript(script)
+	if err != nil {
+		return "", err
+	}
+
+	words := []string{}
+	for _, op := range ops {
+		if op.Code > OP_0 && op.Code <= OP_PUSHDATA2 {
+			if n, err := parseScriptNum(op.Data, 4); err == nil && len(op.Data) > 0 {
+				words = append(words, strconv.FormatInt(n, 10))
+				continue
+			}
+			words = append(words, "0x"+hex.EncodeToString(op.Data))
+			continue
+		}
+		if name, ok := opcodeNames[op.Code]; ok {
+			words = append(words, name)
+			continue
+		}
+		words = append(words, "OP_UNKNOWN"+strconv.Itoa(int(op.Code)))
+	}
+	return strings.Join(words, " "), nil
+}
+
+// AssembleScript reads the format of DisassembleScript. Decimal numbers are
+// pushed as script numbers, other words are opcode names, with or without
+// OP_, or hex data, with or without 0x.
+func AssembleScript(asm string) ([]byte, error) {
+	s := &ScriptBuilder{}
+	for _, word := range strings.Fields(asm) {
+		if n, err := strconv.ParseInt(word, 10, 32); err == nil {
+			s.AddInt(n)
+			continue
+		}
+
+		if op, ok := opcodeByName(word); ok {
+			s.AddOp(op)
+			continue
+		}
+
+		d, err := hex.DecodeString(strings.TrimPrefix(word, "0x"))
+		if err != nil {
+			return nil, errors.New("Unknown script word " + word)
+		}
+		s.AddData(d)
+	}
+
+	script := s.Script()
+	if err := CheckScript(script, false); err != nil {
+		return nil, err
+	}
+	return script, nil
+}
+
+func opcodeByName(name string) (byte, bool) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "OP_") {
+		name = "OP_" + name
+	}
+	for op, n := range opcodeNames {
+		if n == name && op != OP_PUSHDATA1 && op != OP_PUSHDATA2 {
+			return op, true
+		}
+	}
+	return 0, false
+}
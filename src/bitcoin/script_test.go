@@ -0,0 +1,291 @@
+package bitcoin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+type scriptTest struct {
+	name         string
+	unlock, lock string
+	ok           bool
+}
+
+// runScriptTests assembles the scripts of the tests, hex data being written
+// 0x..., and verifies them as an input of tr.
+func runScriptTests(t *testing.T, tr *Transaction, tests []scriptTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unlock, err := AssembleScript(tt.unlock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lock, err := AssembleScript(tt.lock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = VerifyScript(unlock, lock, tr, tr.Hash())
+			if tt.ok && err != nil {
+				t.Errorf("script fails: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("script succeeds")
+			}
+		})
+	}
+}
+
+func asmData(d []byte) string {
+	return "0x" + hex.EncodeToString(d)
+}
+
+// scriptKeys are keys with their signature of the hash of testTransaction.
+func scriptKeys(t *testing.T, n int) (*Transaction, []string, []string) {
+	tr := testTransaction()
+	keys, sigs := []string{}, []string{}
+	for i := 0; i < n; i++ {
+		kp := GenerateNewKeypair()
+		sig, err := kp.Sign(tr.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, sigs = append(keys, asmData(kp.Public)), append(sigs, asmData(sig))
+	}
+	return &tr, keys, sigs
+}
+
+func TestScriptPayToKeyHash(t *testing.T) {
+	tr, keys, sigs := scriptKeys(t, 2)
+	public, _ := hex.DecodeString(strings.TrimPrefix(keys[0], "0x"))
+	lock, _ := DisassembleScript(PayToKeyHash(KeyHash(public)))
+
+	otherHash, _ := GenerateNewKeypair().Sign(make([]byte, 32))
+
+	runScriptTests(t, tr, []scriptTest{
+		{"signature and key", sigs[0] + " " + keys[0], lock, true},
+		{"key of another hash", sigs[1] + " " + keys[1], lock, false},
+		{"signature of another key", sigs[1] + " " + keys[0], lock, false},
+		{"signature of another hash", asmData(otherHash) + " " + keys[0], lock, false},
+		{"no key", sigs[0], lock, false},
+		{"nothing", "", lock, false},
+		{"unlocking opcode", sigs[0] + " " + keys[0] + " OP_NOP", lock, false},
+	})
+}
+
+func TestScriptMultiSig(t *testing.T) {
+	tr, keys, sigs := scriptKeys(t, 3)
+	lock := "2 " + strings.Join(keys, " ") + " 3 OP_CHECKMULTISIG"
+
+	runScriptTests(t, tr, []scriptTest{
+		{"first and second", sigs[0] + " " + sigs[1], lock, true},
+		{"first and third", sigs[0] + " " + sigs[2], lock, true},
+		{"second and third", sigs[1] + " " + sigs[2], lock, true},
+		{"out of key order", sigs[1] + " " + sigs[0], lock, false},
+		{"same signature twice", sigs[0] + " " + sigs[0], lock, false},
+		{"one signature", sigs[0], lock, false},
+		{"unknown signature", sigs[0] + " " + asmData(make([]byte, 64)), lock, false},
+		{"zero of one", "", "0 " + keys[0] + " 1 OP_CHECKMULTISIG", true},
+		{"more signatures than keys", sigs[0] + " " + sigs[1], "2 " + keys[0] + " 1 OP_CHECKMULTISIG", false},
+		{"too many keys", "", "0 " + strings.Repeat(keys[0]+" ", 21) + "21 OP_CHECKMULTISIG", false},
+		{"verify", sigs[0] + " " + sigs[2], "2 " + strings.Join(keys, " ") + " 3 OP_CHECKMULTISIGVERIFY 1", true},
+		{"verify fails", sigs[2] + " " + sigs[0], "2 " + strings.Join(keys, " ") + " 3 OP_CHECKMULTISIGVERIFY 1", false},
+	})
+
+	// Unlike Bitcoin, OP_CHECKMULTISIG pops nothing past the signatures: no
+	// dummy element is needed, and one given stays on the stack.
+	for _, dummy := range []string{"", "7 "} {
+		unlock, _ := AssembleScript(dummy + sigs[0] + " " + sigs[1])
+		l, _ := AssembleScript(lock)
+		vm := &scriptVM{tx: tr, hash: tr.Hash()}
+		if err := vm.run(unlock); err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.run(l); err != nil {
+			t.Fatal(err)
+		}
+		want := [][]byte{{1}}
+		if dummy != "" {
+			want = [][]byte{{7}, {1}}
+		}
+		if len(vm.stack) != len(want) || !bytes.Equal(vm.stack[len(vm.stack)-1], []byte{1}) || !bytes.Equal(vm.stack[0], want[0]) {
+			t.Errorf("stack after OP_CHECKMULTISIG with %q is %x, want %x", dummy, vm.stack, want)
+		}
+	}
+}
+
+func TestScriptLockTime(t *testing.T) {
+	const time = LOCKTIME_THRESHOLD + 1000
+	lock := func(n string) string { return n + " OP_CHECKLOCKTIMEVERIFY OP_DROP 1" }
+
+	tests := []struct {
+		txLockTime uint32
+		tests      []scriptTest
+	}{
+		{100, []scriptTest{
+			{"height reached", "", lock("100"), true},
+			{"height passed", "", lock("99"), true},
+			{"height not reached", "", lock("101"), false},
+			{"time against height", "", lock("500001000"), false},
+			{"negative", "", lock("-1"), false},
+			{"empty stack", "", "OP_CHECKLOCKTIMEVERIFY", false},
+		}},
+		{time, []scriptTest{
+			{"time reached", "", lock("500001000"), true},
+			{"time not reached", "", lock("500001001"), false},
+			{"height against time", "", lock("100"), false},
+		}},
+		{0xffffffff, []scriptTest{
+			{"five byte number", "", lock("0xffffffff00"), true},
+			{"six byte number", "", lock("0xffffffff0000"), false},
+		}},
+		{0, []scriptTest{
+			{"no lock time", "", lock("0"), true},
+			{"lock time not set", "", lock("1"), false},
+		}},
+	}
+	for _, tt := range tests {
+		tr := testTransaction()
+		tr.Header.LockTime = tt.txLockTime
+		runScriptTests(t, &tr, tt.tests)
+	}
+
+	// A transaction passing OP_CHECKLOCKTIMEVERIFY for n only goes in a block
+	// after n
+	tr := testTransaction()
+	tr.Header.LockTime = 100
+	if tr.IsFinal(100, 0) || !tr.IsFinal(101, 0) {
+		t.Errorf("height lock time 100 final at 100 or not at 101")
+	}
+	tr.Header.LockTime = time
+	if tr.IsFinal(1<<30, time) || !tr.IsFinal(0, time+1) {
+		t.Errorf("time lock time final at its time or not after")
+	}
+	tr.Header.LockTime = 0
+	if !tr.IsFinal(0, 0) {
+		t.Errorf("no lock time not final")
+	}
+}
+
+func TestScriptHashLocks(t *testing.T) {
+	preimage := []byte("secret")
+	h := sha256.Sum256(preimage)
+	hh := sha256.Sum256(h[:])
+
+	tr := testTransaction()
+	runScriptTests(t, &tr, []scriptTest{
+		{"sha256", asmData(preimage), "OP_SHA256 " + asmData(h[:]) + " OP_EQUAL", true},
+		{"sha256 wrong preimage", asmData([]byte("guess")), "OP_SHA256 " + asmData(h[:]) + " OP_EQUAL", false},
+		{"hash256", asmData(preimage), "OP_HASH256 " + asmData(hh[:]) + " OP_EQUAL", true},
+		{"hash256 is not sha256", asmData(preimage), "OP_HASH256 " + asmData(h[:]) + " OP_EQUAL", false},
+		{"keyhash", asmData(preimage), "OP_KEYHASH " + asmData(KeyHash(preimage)) + " OP_EQUAL", true},
+		{"equalverify", asmData(preimage), "OP_SHA256 " + asmData(h[:]) + " OP_EQUALVERIFY 1", true},
+		{"equalverify fails", asmData(h[:]), "OP_SHA256 " + asmData(h[:]) + " OP_EQUALVERIFY 1", false},
+		{"size", asmData(preimage), "OP_SIZE 6 OP_NUMEQUALVERIFY OP_SHA256 " + asmData(h[:]) + " OP_EQUAL", true},
+		{"no preimage", "", "OP_SHA256 " + asmData(h[:]) + " OP_EQUAL", false},
+	})
+}
+
+func TestScriptConditionals(t *testing.T) {
+	tr := testTransaction()
+	runScriptTests(t, &tr, []scriptTest{
+		{"if taken", "1", "OP_IF 1 OP_ELSE 0 OP_ENDIF", true},
+		{"else taken", "0", "OP_IF 0 OP_ELSE 1 OP_ENDIF", true},
+		{"notif", "0", "OP_NOTIF 1 OP_ELSE 0 OP_ENDIF", true},
+		{"nested", "0 1", "OP_IF OP_IF 0 OP_ELSE 1 OP_ENDIF OP_ELSE 0 OP_ENDIF", true},
+		{"nested inner false", "0 1", "OP_IF OP_IF 1 OP_ENDIF OP_ELSE 1 OP_ENDIF", false},
+		{"nested in skipped branch pops nothing", "1 0", "OP_IF OP_IF 0 OP_ENDIF OP_ELSE OP_VERIFY 1 OP_ENDIF", true},
+		{"skipped branch not run", "0", "OP_IF OP_RETURN OP_ELSE 1 OP_ENDIF", true},
+		{"skipped nested branch not run", "0", "OP_IF OP_IF OP_RETURN OP_ENDIF OP_ELSE 1 OP_ENDIF", true},
+		{"run branch returns", "1", "OP_IF OP_RETURN OP_ELSE 1 OP_ENDIF", false},
+		{"second else", "1", "OP_IF 1 OP_ELSE 0 OP_ELSE OP_ENDIF", true},
+		{"negative zero is false", "0x80", "OP_IF 0 OP_ELSE 1 OP_ENDIF", true},
+		{"no endif", "1", "OP_IF 1", false},
+		{"else without if", "1", "OP_ELSE", false},
+		{"endif without if", "1", "OP_ENDIF", false},
+		{"if on empty stack", "", "OP_IF 1 OP_ENDIF", false},
+		{"verify", "1", "OP_VERIFY 1", true},
+		{"verify fails", "0", "OP_VERIFY 1", false},
+		{"false result", "", "0", false},
+		{"empty result", "", "", false},
+	})
+}
+
+func TestScriptNumbers(t *testing.T) {
+	tests := []struct {
+		n int64
+		d string
+	}{
+		{0, ""}, {1, "01"}, {-1, "81"}, {127, "7f"}, {128, "8000"}, {-128, "8080"},
+		{255, "ff00"}, {256, "0001"}, {-256, "0081"}, {1 << 31, "0000008000"},
+	}
+	for _, tt := range tests {
+		if d := hex.EncodeToString(scriptNum(tt.n)); d != tt.d {
+			t.Errorf("scriptNum(%d) = %s, want %s", tt.n, d, tt.d)
+		}
+		d, _ := hex.DecodeString(tt.d)
+		if n, err := parseScriptNum(d, 5); err != nil || n != tt.n {
+			t.Errorf("parseScriptNum(%s) = %d, %v, want %d", tt.d, n, err, tt.n)
+		}
+	}
+
+	for _, bad := range []string{"00", "80", "0100", "0080", "ff0000", "0000008000"} {
+		d, _ := hex.DecodeString(bad)
+		if _, err := parseScriptNum(d, 4); err == nil {
+			t.Errorf("parseScriptNum(%s) succeeds", bad)
+		}
+	}
+
+	tr := testTransaction()
+	runScriptTests(t, &tr, []scriptTest{
+		{"add", "2 3", "OP_ADD 5 OP_NUMEQUAL", true},
+		{"sub to negative", "2 3", "OP_SUB -1 OP_NUMEQUAL", true},
+		{"lessthan", "2 3", "OP_LESSTHAN", true},
+		{"greaterthan", "2 3", "OP_GREATERTHAN OP_NOT", true},
+		{"non minimal operand", "0x0200 3", "OP_ADD 5 OP_NUMEQUAL", false},
+		{"negative zero operand", "0x80", "OP_NOT", false},
+		{"five byte operand", "0x0000008000 1", "OP_ADD OP_DROP 1", false},
+		{"four byte result", "0x0000807f 0x0000807f", "OP_ADD OP_SIZE 5 OP_NUMEQUAL", true},
+	})
+}
+
+func TestScriptLimits(t *testing.T) {
+	tr := testTransaction()
+	runScriptTests(t, &tr, []scriptTest{
+		{"most ops", "", strings.Repeat("OP_NOP ", SCRIPT_MAX_OPS-1) + "1", true},
+		{"too many ops", "", strings.Repeat("OP_NOP ", SCRIPT_MAX_OPS) + "1", false},
+		{"skipped ops count", "0", "OP_IF " + strings.Repeat("OP_NOP ", SCRIPT_MAX_OPS) + "OP_ENDIF 1", false},
+		{"largest push", asmData(make([]byte, SCRIPT_MAX_ELEMENT_SIZE)), "OP_SIZE " + "0x0802" + " OP_NUMEQUAL", true},
+		{"drop and underflow", "", "OP_DROP 1", false},
+		{"dup underflow", "", "OP_DUP", false},
+		{"swap underflow", "1", "OP_SWAP", false},
+		{"over", "1 2", "OP_OVER 1 OP_NUMEQUALVERIFY OP_DROP", true},
+	})
+
+	tooLarge := (&ScriptBuilder{}).AddData(make([]byte, SCRIPT_MAX_ELEMENT_SIZE+1)).Script()
+	if err := CheckScript(tooLarge, false); err == nil {
+		t.Errorf("push of %d bytes passes CheckScript", SCRIPT_MAX_ELEMENT_SIZE+1)
+	}
+	if err := VerifyScript(nil, append(tooLarge, OP_DROP, OP_1), &tr, tr.Hash()); err == nil {
+		t.Errorf("push of %d bytes runs", SCRIPT_MAX_ELEMENT_SIZE+1)
+	}
+
+	big := bytes.Repeat([]byte{OP_NOP}, SCRIPT_MAX_SIZE+1)
+	if err := CheckScript(big, false); err == nil {
+		t.Errorf("script of %d bytes passes CheckScript", len(big))
+	}
+	if err := CheckScript([]byte{OP_PUSHDATA1, 5, 1}, false); err == nil {
+		t.Errorf("truncated push passes CheckScript")
+	}
+
+	vm := &scriptVM{tx: &tr, hash: tr.Hash(), stack: make([][]byte, SCRIPT_MAX_STACK_SIZE-1)}
+	if err := vm.run([]byte{OP_1}); err != nil {
+		t.Errorf("filling the stack fails: %v", err)
+	}
+	if err := vm.run([]byte{OP_1}); err == nil {
+		t.Errorf("pushing on a full stack succeeds")
+	}
+}
@@ -0,0 +1,442 @@
+package bitcoin
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"math/bits"
+)
+
+// secp256k1 is the curve y² = x³ + 7 over the field of p. crypto/elliptic
+// only implements curves with a = -3, hence the arithmetic below. Secret
+// scalars go through it, so nothing in it branches or indexes memory on the
+// values: field and scalar elements are four 64-bit limbs in Montgomery
+// form, points are projective (X/Z, Y/Z) with the complete addition formula
+// of Renes, Costello and Batina, and scalar multiplication is a Montgomery
+// ladder over all 256 bits.
+var (
+	secp256k1P, _  = new(big.Int).SetString("fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f", 16)
+	secp256k1N, _  = new(big.Int).SetString("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", 16)
+	secp256k1Gx, _ = new(big.Int).SetString("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798", 16)
+	secp256k1Gy, _ = new(big.Int).SetString("483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8", 16)
+
+	secp256k1HalfN = new(big.Int).Rsh(secp256k1N, 1)
+
+	secp256k1Field = newSecp256k1Modulus(secp256k1P)
+	secp256k1Order = newSecp256k1Modulus(secp256k1N)
+	secp256k1B3    = secp256k1Field.fromBig(big.NewInt(21))
+)
+
+// secp256k1Element is a number modulo p or n, least significant limb first.
+type secp256k1Element [4]uint64
+
+func secp256k1Limbs(b []byte) secp256k1Element {
+	b = FitBytes(b, 32)
+	var e secp256k1Element
+	for i := range e {
+		e[i] = binary.BigEndian.Uint64(b[24-8*i:])
+	}
+	return e
+}
+
+func (e secp256k1Element) bytes() []byte {
+	b := make([]byte, 32)
+	for i, l := range e {
+		binary.BigEndian.PutUint64(b[24-8*i:], l)
+	}
+	return b
+}
+
+func (e secp256k1Element) isZero() uint64 {
+	z := e[0] | e[1] | e[2] | e[3]
+	return 1 ^ (z|-z)>>63
+}
+
+// secp256k1Select is a if bit is 1 and b if it is 0.
+func secp256k1Select(bit uint64, a, b secp256k1Element) secp256k1Element {
+	mask := -bit
+	for i := range a {
+		a[i] = a[i]&mask | b[i]&^mask
+	}
+	return a
+}
+
+// secp256k1Modulus does Montgomery arithmetic modulo the odd m, R being
+// 2^256.
+type secp256k1Modulus struct {
+	m   secp256k1Element
+	inv uint64           // -m⁻¹ mod 2^64
+	rr  secp256k1Element // R² mod m
+	one secp256k1Element // R mod m
+}
+
+func newSecp256k1Modulus(m *big.Int) *secp256k1Modulus {
+	md := &secp256k1Modulus{m: secp256k1Limbs(m.Bytes())}
+
+	inv := uint64(1)
+	for i := 0; i < 6; i++ {
+		inv *= 2 - md.m[0]*inv
+	}
+	md.inv = -inv
+
+	r := new(big.Int).Lsh(big.NewInt(1), 256)
+	md.one = secp256k1Limbs(new(big.Int).Mod(r, m).Bytes())
+	md.rr = secp256k1Limbs(r.Mod(r.Mul(r, r), m).Bytes())
+	return md
+}
+
+// less is 1 if a is below m, that is a canonical element.
+func (md *secp256k1Modulus) less(a secp256k1Element) uint64 {
+	var borrow uint64
+	for i := range a {
+		_, borrow = bits.Sub64(a[i], md.m[i], borrow)
+	}
+	return borrow
+}
+
+// reduce takes carry·R + t, below 2m, down below m.
+func (md *secp256k1Modulus) reduce(t secp256k1Element, carry uint64) secp256k1Element {
+	var s secp256k1Element
+	var borrow uint64
+	for i := range t {
+		s[i], borrow = bits.Sub64(t[i], md.m[i], borrow)
+	}
+	return secp256k1Select(carry|(borrow^1), s, t)
+}
+
+func (md *secp256k1Modulus) add(a, b secp256k1Element) secp256k1Element {
+	var carry uint64
+	for i := range a {
+		a[i], carry = bits.Add64(a[i], b[i], carry)
+	}
+	return md.reduce(a, carry)
+}
+
+func (md *secp256k1Modulus) sub(a, b secp256k1Element) secp256k1Element {
+	var borrow, carry uint64
+	for i := range a {
+		a[i], borrow = bits.Sub64(a[i], b[i], borrow)
+	}
+	mask := -borrow
+	for i := range a {
+		a[i], carry = bits.Add64(a[i], md.m[i]&mask, carry)
+	}
+	return a
+}
+
+// mul is a·b/R mod m, so the product of two elements in Montgomery form.
+func (md *secp256k1Modulus) mul(a, b secp256k1Element) secp256k1Element {
+	var t [6]uint64
+	for i := range b {
+		var c, carry uint64
+		for j := range a {
+			hi, lo := bits.Mul64(a[j], b[i])
+			lo, carry = bits.Add64(lo, t[j], 0)
+			hi += carry
+			lo, carry = bits.Add64(lo, c, 0)
+			t[j], c = lo, hi+carry
+		}
+		t[4], carry = bits.Add64(t[4], c, 0)
+		t[5] = carry
+
+		u := t[0] * md.inv
+		hi, lo := bits.Mul64(u, md.m[0])
+		_, carry = bits.Add64(lo, t[0], 0)
+		c = hi + carry
+		for j := 1; j < 4; j++ {
+			hi, lo := bits.Mul64(u, md.m[j])
+			lo, carry = bits.Add64(lo, t[j], 0)
+			hi += carry
+			lo, carry = bits.Add64(lo, c, 0)
+			t[j-1], c = lo, hi+carry
+		}
+		t[3], carry = bits.Add64(t[4], c, 0)
+		t[4] = t[5] + carry
+	}
+	return md.reduce(secp256k1Element{t[0], t[1], t[2], t[3]}, t[4])
+}
+
+// exp raises a to the public exponent e.
+func (md *secp256k1Modulus) exp(a secp256k1Element, e *big.Int) secp256k1Element {
+	r := md.one
+	for i := e.BitLen() - 1; i >= 0; i-- {
+		r = md.mul(r, r)
+		if e.Bit(i) == 1 {
+			r = md.mul(r, a)
+		}
+	}
+	return r
+}
+
+// inverse is a⁻¹ by Fermat's little theorem, m being prime.
+func (md *secp256k1Modulus) inverse(a secp256k1Element) secp256k1Element {
+	m := new(big.Int).SetBytes(md.m.bytes())
+	return md.exp(a, m.Sub(m, big.NewInt(2)))
+}
+
+func (md *secp256k1Modulus) toMont(a secp256k1Element) secp256k1Element {
+	return md.mul(a, md.rr)
+}
+
+func (md *secp256k1Modulus) fromMont(a secp256k1Element) secp256k1Element {
+	return md.mul(a, secp256k1Element{1})
+}
+
+func (md *secp256k1Modulus) fromBig(a *big.Int) secp256k1Element {
+	return md.toMont(secp256k1Limbs(a.Bytes()))
+}
+
+func (md *secp256k1Modulus) toBig(a secp256k1Element) *big.Int {
+	return new(big.Int).SetBytes(md.fromMont(a).bytes())
+}
+
+type secp256k1Point struct {
+	X, Y, Z secp256k1Element
+}
+
+func secp256k1Infinity() secp256k1Point {
+	return secp256k1Point{Y: secp256k1Field.one}
+}
+
+func secp256k1Affine(x, y *big.Int) secp256k1Point {
+	f := secp256k1Field
+	return secp256k1Point{f.fromBig(x), f.fromBig(y), f.one}
+}
+
+func (pt secp256k1Point) infinity() bool {
+	return pt.Z.isZero() == 1
+}
+
+func (pt secp256k1Point) affine() (*big.Int, *big.Int) {
+	f := secp256k1Field
+	zinv := f.inverse(pt.Z)
+	return f.toBig(f.mul(pt.X, zinv)), f.toBig(f.mul(pt.Y, zinv))
+}
+
+// add is algorithm 7 of "Complete addition formulas for prime order elliptic
+// curves", which also doubles and handles the point at infinity.
+func (pt secp256k1Point) add(q secp256k1Point) secp256k1Point {
+	f := secp256k1Field
+
+	t0 := f.mul(pt.X, q.X)
+	t1 := f.mul(pt.Y, q.Y)
+	t2 := f.mul(pt.Z, q.Z)
+	t3 := f.mul(f.add(pt.X, pt.Y), f.add(q.X, q.Y))
+	t3 = f.sub(t3, f.add(t0, t1))
+	t4 := f.mul(f.add(pt.Y, pt.Z), f.add(q.Y, q.Z))
+	t4 = f.sub(t4, f.add(t1, t2))
+	y3 := f.mul(f.add(pt.X, pt.Z), f.add(q.X, q.Z))
+	y3 = f.sub(y3, f.add(t0, t2))
+	t0 = f.add(f.add(t0, t0), t0)
+	t2 = f.mul(secp256k1B3, t2)
+	z3 := f.add(t1, t2)
+	t1 = f.sub(t1, t2)
+	y3 = f.mul(secp256k1B3, y3)
+	x3 := f.sub(f.mul(t3, t1), f.mul(t4, y3))
+	y3 = f.add(f.mul(t1, z3), f.mul(y3, t0))
+	z3 = f.add(f.mul(z3, t4), f.mul(t0, t3))
+
+	return secp256k1Point{x3, y3, z3}
+}
+
+func secp256k1Swap(bit uint64, a, b secp256k1Point) (secp256k1Point, secp256k1Point) {
+	return secp256k1Point{secp256k1Select(bit, b.X, a.X), secp256k1Select(bit, b.Y, a.Y), secp256k1Select(bit, b.Z, a.Z)},
+		secp256k1Point{secp256k1Select(bit, a.X, b.X), secp256k1Select(bit, a.Y, b.Y), secp256k1Select(bit, a.Z, b.Z)}
+}
+
+// mul multiplies pt by the 32 bytes big endian scalar k in the same time
+// whatever k is.
+func (pt secp256k1Point) mul(k []byte) secp256k1Point {
+	k = FitBytes(k, 32)
+	r0, r1 := secp256k1Infinity(), pt
+	for i := 0; i < 256; i++ {
+		bit := uint64(k[i/8]>>(7-i%8)) & 1
+		r0, r1 = secp256k1Swap(bit, r0, r1)
+		r1 = r0.add(r1)
+		r0 = r0.add(r0)
+		r0, r1 = secp256k1Swap(bit, r0, r1)
+	}
+	return r0
+}
+
+func secp256k1Base() secp256k1Point {
+	return secp256k1Affine(secp256k1Gx, secp256k1Gy)
+}
+
+// secp256k1Compress encodes a point as its x coordinate prefixed by 2 or 3
+// for an even or odd y.
+func secp256k1Compress(x, y *big.Int) []byte {
+	return append([]byte{byte(2 + y.Bit(0))}, x.FillBytes(make([]byte, 32))...)
+}
+
+func secp256k1Decompress(public []byte) (*big.Int, *big.Int, error) {
+	if len(public) != 33 || (public[0] != 2 && public[0] != 3) {
+		return nil, nil, errors.New("Invalid compressed public key")
+	}
+	p := secp256k1P
+
+	x := new(big.Int).SetBytes(public[1:])
+	if x.Cmp(p) >= 0 {
+		return nil, nil, errors.New("Invalid compressed public key")
+	}
+
+	// p = 3 mod 4, so a square root of a is a^((p+1)/4)
+	rhs := new(big.Int).Exp(x, big.NewInt(3), p)
+	rhs.Add(rhs, big.NewInt(7))
+	rhs.Mod(rhs, p)
+	y := new(big.Int).Exp(rhs, new(big.Int).Rsh(new(big.Int).Add(p, big.NewInt(1)), 2), p)
+	if new(big.Int).Exp(y, big.NewInt(2), p).Cmp(rhs) != 0 {
+		return nil, nil, errors.New("Point not on curve")
+	}
+	if y.Bit(0) != uint(public[0]-2) {
+		y.Sub(p, y)
+	}
+	return x, y, nil
+}
+
+// secp256k1Scheme signs with ECDSA over secp256k1. Public keys are 33 bytes
+// compressed points and signatures are r||s on 32 bytes each, with s in the
+// lower half of the order so a signature has a single valid encoding.
+type secp256k1Scheme struct{}
+
+func (secp256k1Scheme) GenerateKey() (*Keypair, error) {
+	d, err := rand.Int(rand.Reader, new(big.Int).Sub(secp256k1N, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	d.Add(d, big.NewInt(1))
+	return secp256k1Scheme{}.FromPrivate(d.Bytes())
+}
+
+// secp256k1PrivateKey checks that private is a scalar in [1, n) and returns
+// it on 32 bytes.
+func secp256k1PrivateKey(private []byte) ([]byte, error) {
+	if len(private) > 32 {
+		return nil, errors.New("Invalid private key")
+	}
+	d := secp256k1Limbs(private)
+	if d.isZero()|(secp256k1Order.less(d)^1) != 0 {
+		return nil, errors.New("Invalid private key")
+	}
+	return d.bytes(), nil
+}
+
+func (secp256k1Scheme) FromPrivate(private []byte) (*Keypair, error) {
+	d, err := secp256k1PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	x, y := secp256k1Base().mul(d).affine()
+	return &Keypair{Scheme: SCHEME_SECP256K1, Public: secp256k1Compress(x, y), Private: d}, nil
+}
+
+// rfc6979Nonces draws the nonces of the signatures of hash by the 32 bytes
+// private key x as RFC 6979 does with HMAC-SHA256, so that they are secret
+// without depending on a random source, and signing twice gives the same
+// signature.
+type rfc6979Nonces struct {
+	k, v []byte
+}
+
+func newRFC6979Nonces(x, hash []byte) *rfc6979Nonces {
+	h := new(big.Int).SetBytes(FitBytes(hash, 32))
+	h1 := h.Mod(h, secp256k1N).FillBytes(make([]byte, 32))
+
+	g := &rfc6979Nonces{k: make([]byte, 32), v: bytes.Repeat([]byte{1}, 32)}
+	for _, b := range []byte{0, 1} {
+		g.k = g.mac(g.v, []byte{b}, x, h1)
+		g.v = g.mac(g.v)
+	}
+	return g
+}
+
+func (g *rfc6979Nonces) mac(data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, g.k)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// next returns the next candidate nonce, which the caller must check lies in
+// [1, n).
+func (g *rfc6979Nonces) next() []byte {
+	g.v = g.mac(g.v)
+	k := g.v
+	g.k = g.mac(g.v, []byte{0})
+	g.v = g.mac(g.v)
+	return k
+}
+
+func (secp256k1Scheme) Sign(private, hash []byte) ([]byte, error) {
+	x, err := secp256k1PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	o := secp256k1Order
+	n := secp256k1N
+	z := new(big.Int).SetBytes(hash)
+	zd := o.fromBig(z.Mod(z, n))
+	d := o.toMont(secp256k1Limbs(x))
+
+	nonces := newRFC6979Nonces(x, hash)
+	for {
+		kb := nonces.next()
+		k := secp256k1Limbs(kb)
+		if k.isZero()|(o.less(k)^1) != 0 {
+			continue
+		}
+
+		rx, _ := secp256k1Base().mul(kb).affine()
+		r := rx.Mod(rx, n)
+		if r.Sign() == 0 {
+			continue
+		}
+
+		rdz := o.add(zd, o.mul(o.fromBig(r), d))
+		s := o.toBig(o.mul(o.inverse(o.toMont(k)), rdz))
+		if s.Sign() == 0 {
+			continue
+		}
+		if s.Cmp(secp256k1HalfN) > 0 {
+			s.Sub(n, s)
+		}
+
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...), nil
+	}
+}
+func (secp256k1Scheme) Verify(public, sig, hash []byte) bool {
+	public, sig = fixedWidth(public, 33), fixedWidth(sig, 64)
+	if public == nil || sig == nil {
+		return false
+	}
+	qx, qy, err := secp256k1Decompress(public)
+	if err != nil {
+		return false
+	}
+
+	n := secp256k1N
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if r.Sign() == 0 || r.Cmp(n) >= 0 || s.Sign() == 0 || s.Cmp(secp256k1HalfN) > 0 {
+		return false
+	}
+
+	z := new(big.Int).SetBytes(hash)
+	w := new(big.Int).ModInverse(s, n)
+	u1 := z.Mul(z, w)
+	u1.Mod(u1, n)
+	u2 := w.Mul(w, r)
+	u2.Mod(u2, n)
+
+	pt := secp256k1Base().mul(u1.Bytes()).add(secp256k1Affine(qx, qy).mul(u2.Bytes()))
+	if pt.infinity() {
+		return false
+	}
+	x, _ := pt.affine()
+	return x.Mod(x, n).Cmp(r) == 0
+}
@@ -0,0 +1,113 @@
+package bitcoin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+func TestSecp256k1PublicKeys(t *testing.T) {
+	tests := []struct{ private, public string }{
+		{"01", "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"},
+		{"02", "02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5"},
+		{"03", "02f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9"},
+		{"fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364140", "0379be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"},
+	}
+	for _, tt := range tests {
+		kp, err := secp256k1Scheme{}.FromPrivate(hexBytes(tt.private))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(kp.Public); got != tt.public {
+			t.Errorf("public key of %s is %s, want %s", tt.private, got, tt.public)
+		}
+	}
+
+	for _, private := range []string{"00", "fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", "01" + hex.EncodeToString(make([]byte, 32))} {
+		if _, err := (secp256k1Scheme{}).FromPrivate(hexBytes(private)); err == nil {
+			t.Errorf("private key %s is accepted", private)
+		}
+	}
+}
+
+// The vectors of deterministic secp256k1 signatures used across Bitcoin
+// libraries, with the message hashed once by sha256 and s made low.
+func TestSecp256k1SignKnownAnswers(t *testing.T) {
+	tests := []struct{ private, message, nonce, signature string }{
+		{"0000000000000000000000000000000000000000000000000000000000000001", "Satoshi Nakamoto",
+			"8f8a276c19f4149656b280621e358cce24f5f52542772691ee69063b74f15d15",
+			"934b1ea10a4b3c1757e2b0c017d0b6143ce3c9a7e6a4a49860d7a6ab210ee3d82442ce9d2b916064108014783e923ec36b49743e2ffa1c4496f01a512aafd9e5"},
+		{"0000000000000000000000000000000000000000000000000000000000000001", "All those moments will be lost in time, like tears in rain. Time to die...",
+			"38aa22d72376b4dbc472e06c3ba403ee0a394da63fc58d88686c611aba98d6b3",
+			"8600dbd41e348fe5c9465ab92d23e3db8b98b873beecd930736488696438cb6b547fe64427496db33bf66019dacbf0039c04199abb0122918601db38a72cfc21"},
+		{"f8b8af8ce3c7cca5e300d33939540c10d45ce001b8f252bfbc57ba0342904181", "Alan Turing", "",
+			"7063ae83e7f62bbb171798131b4a0564b956930092b33b07b395615d9ec7e15c58dfcc1e00a35e1572f366ffe34ba0fc47db1e7189759b9fb233c5b05ab388ea"},
+	}
+	for _, tt := range tests {
+		private := hexBytes(tt.private)
+		hash := sha256.Sum256([]byte(tt.message))
+
+		if tt.nonce != "" {
+			if k := hex.EncodeToString(newRFC6979Nonces(private, hash[:]).next()); k != tt.nonce {
+				t.Errorf("%q: nonce %s, want %s", tt.message, k, tt.nonce)
+			}
+		}
+
+		sig, err := secp256k1Scheme{}.Sign(private, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(sig); got != tt.signature {
+			t.Errorf("%q: signature %s, want %s", tt.message, got, tt.signature)
+		}
+
+		kp, _ := secp256k1Scheme{}.FromPrivate(private)
+		if !(secp256k1Scheme{}).Verify(kp.Public, sig, hash[:]) {
+			t.Errorf("%q: signature does not verify", tt.message)
+		}
+	}
+}
+
+func TestSecp256k1VerifyRejects(t *testing.T) {
+	kp, _ := secp256k1Scheme{}.GenerateKey()
+	other, _ := secp256k1Scheme{}.GenerateKey()
+	hash := sha256.Sum256([]byte("message"))
+	sig, _ := secp256k1Scheme{}.Sign(kp.Private, hash[:])
+
+	edit := func(f func(sig []byte)) []byte {
+		s := append([]byte{}, sig...)
+		f(s)
+		return s
+	}
+	highS := func(sig []byte) {
+		s := new(big.Int).SetBytes(sig[32:])
+		s.Sub(secp256k1N, s).FillBytes(sig[32:])
+	}
+
+	tests := []struct {
+		name        string
+		public, sig []byte
+		hash        []byte
+	}{
+		{"other message", kp.Public, sig, make([]byte, 32)},
+		{"other key", other.Public, sig, hash[:]},
+		{"changed r", kp.Public, edit(func(sig []byte) { sig[0] ^= 1 }), hash[:]},
+		{"changed s", kp.Public, edit(func(sig []byte) { sig[63] ^= 1 }), hash[:]},
+		{"high s", kp.Public, edit(highS), hash[:]},
+		{"zero r", kp.Public, edit(func(sig []byte) { copy(sig[:32], make([]byte, 32)) }), hash[:]},
+		{"short", kp.Public, sig[:63], hash[:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if (secp256k1Scheme{}).Verify(tt.public, tt.sig, tt.hash) {
+				t.Errorf("signature verifies")
+			}
+		})
+	}
+
+	again, _ := secp256k1Scheme{}.Sign(kp.Private, hash[:])
+	if hex.EncodeToString(again) != hex.EncodeToString(sig) {
+		t.Errorf("signing twice gives two signatures")
+	}
+}
@@ -0,0 +1,276 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+type storeEntry struct {
+	Hash   []byte
+	Offset int64
+	Length uint32
+}
+
+func (e *storeEntry) MarshalBinary() ([]byte, error) {
+	bs := &bytes.Buffer{}
+
+	bs.Write(FitBytes(e.Hash, 32))
+	binary.Write(bs, binary.LittleEndian, e.Offset)
+	binary.Write(bs, binary.LittleEndian, e.Length)
+
+	return bs.Bytes(), nil
+}
+
+func (e *storeEntry) UnMarshalBinary(d []byte) error {
+	if len(d) < BLOCKSTORE_INDEX_ENTRY_SIZE {
+		return errors.New("Insuficient index entry size")
+	}
+	buf := bytes.NewBuffer(d)
+
+	e.Hash = buf.Next(32)
+	binary.Read(bytes.NewBuffer(buf.Next(8)), binary.LittleEndian, &e.Offset)
+	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &e.Length)
+
+	return nil
+}
+
+// BlockStore keeps blocks in an append-only file, each record prefixed by its
+// length, and an index file of fixed size entries in height order.
+type BlockStore struct {
+	blocks *os.File
+	index  *os.File
+
+	entries []storeEntry
+	hashes  map[string]int
+}
+
+func OpenBlockStore(dir string) (*BlockStore, error) {
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &BlockStore{hashes: map[string]int{}}
+
+	s.blocks, err = os.OpenFile(filepath.Join(dir, BLOCKSTORE_BLOCKS_FILE), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s.index, err = os.OpenFile(filepath.Join(dir, BLOCKSTORE_INDEX_FILE), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		s.blocks.Close()
+		return nil, err
+	}
+
+	err = s.load()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *BlockStore) load() error {
+
+	blocksInfo, err := s.blocks.Stat()
+	if err != nil {
+		return err
+	}
+	d, err := io.ReadAll(s.index)
+	if err != nil {
+		return err
+	}
+
+	// Keep index entries while they point inside the block file
+	var end int64
+	indexed := 0
+	for len(d) >= BLOCKSTORE_INDEX_ENTRY_SIZE {
+		e := storeEntry{}
+		e.UnMarshalBinary(d[:BLOCKSTORE_INDEX_ENTRY_SIZE])
+		d = d[BLOCKSTORE_INDEX_ENTRY_SIZE:]
+
+		if e.Offset != end || e.Offset+4+int64(e.Length) > blocksInfo.Size() {
+			break
+		}
+		s.addEntry(e)
+		indexed++
+		end = e.Offset + 4 + int64(e.Length)
+	}
+
+	// Recover blocks written after the last index entry
+	for end < blocksInfo.Size() {
+		d, err := s.readRecord(end)
+		if err != nil {
+			break
+		}
+		b := new(Block)
+		err = b.UnMarshalBinary(d)
+		if err != nil {
+			break
+		}
+		s.addEntry(storeEntry{b.Hash(), end, uint32(len(d))})
+		end += 4 + int64(len(d))
+	}
+
+	for i := indexed; i < len(s.entries); i++ {
+		eb, _ := s.entries[i].MarshalBinary()
+		if _, err := s.index.WriteAt(eb, int64(i*BLOCKSTORE_INDEX_ENTRY_SIZE)); err != nil {
+			return err
+		}
+	}
+
+	return s.truncate(end)
+}
+
+// truncate drops everything past the given block file offset and the index
+// entries past the ones in memory, leaving the entries before them in place.
+// The block file goes first: should we crash in between, index entries
+// pointing past its end are dropped by the next load, whereas blocks past the
+// last index entry would be recovered.
+func (s *BlockStore) truncate(end int64) error {
+	if err := s.blocks.Truncate(end); err != nil {
+		return err
+	}
+	if err := s.blocks.Sync(); err != nil {
+		return err
+	}
+	if err := s.index.Truncate(int64(len(s.entries) * BLOCKSTORE_INDEX_ENTRY_SIZE)); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
+func (s *BlockStore) addEntry(e storeEntry) {
+	s.hashes[string(e.Hash)] = len(s.entries)
+	s.entries = append(s.entries, e)
+}
+
+func (s *BlockStore) readRecord(offset int64) ([]byte, error) {
+
+	var l uint32
+	lb := make([]byte, 4)
+	_, err := s.blocks.ReadAt(lb, offset)
+	if err != nil {
+		return nil, err
+	}
+	binary.Read(bytes.NewBuffer(lb), binary.LittleEndian, &l)
+
+	info, err := s.blocks.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if offset+4+int64(l) > info.Size() {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	d := make([]byte, l)
+	_, err = s.blocks.ReadAt(d, offset+4)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (s *BlockStore) end() int64 {
+	l := len(s.entries)
+	if l == 0 {
+		return 0
+	}
+	return s.entries[l-1].Offset + 4 + int64(s.entries[l-1].Length)
+}
+
+func (s *BlockStore) Height() int {
+	return len(s.entries)
+}
+
+func (s *BlockStore) Put(b Block) error {
+
+	d, err := b.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	bs := &bytes.Buffer{}
+	binary.Write(bs, binary.LittleEndian, uint32(len(d)))
+	bs.Write(d)
+
+	e := storeEntry{FitBytes(b.Hash(), 32), s.end(), uint32(len(d))}
+	_, err = s.blocks.WriteAt(bs.Bytes(), e.Offset)
+	if err != nil {
+		return err
+	}
+	// The block must be on disk before the index entry pointing at it
+	if err := s.blocks.Sync(); err != nil {
+		return err
+	}
+
+	eb, _ := e.MarshalBinary()
+	_, err = s.index.WriteAt(eb, int64(len(s.entries)*BLOCKSTORE_INDEX_ENTRY_SIZE))
+	if err != nil {
+		return err
+	}
+
+	s.addEntry(e)
+
+	return nil
+}
+
+func (s *BlockStore) Get(height int) (*Block, error) {
+
+	if height < 0 || height >= len(s.entries) {
+		return nil, errors.New("Block height out of range")
+	}
+
+	d, err := s.readRecord(s.entries[height].Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	b := new(Block)
+	err = b.UnMarshalBinary(d)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (s *BlockStore) GetByHash(hash []byte) (*Block, error) {
+	height, ok := s.HeightOf(hash)
+	if !ok {
+		return nil, errors.New("Block not found")
+	}
+	return s.Get(height)
+}
+
+func (s *BlockStore) HeightOf(hash []byte) (int, bool) {
+	height, ok := s.hashes[string(FitBytes(hash, 32))]
+	return height, ok
+}
+
+// Truncate removes every block at or above the given height.
+func (s *BlockStore) Truncate(height int) error {
+
+	if height < 0 || height >= len(s.entries) {
+		return nil
+	}
+
+	for _, e := range s.entries[height:] {
+		delete(s.hashes, string(e.Hash))
+	}
+	s.entries = s.entries[:height]
+
+	return s.truncate(s.end())
+}
+
+func (s *BlockStore) Close() error {
+	s.index.Close()
+	return s.blocks.Close()
+}
@@ -0,0 +1,100 @@
+package bitcoin
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func storeBlocks(t *testing.T, s *BlockStore, n int) []Block {
+	t.Helper()
+	blocks := []Block{}
+	for i := 0; i < n; i++ {
+		b := testBlock()
+		b.Nonce = uint32(i)
+		if err := s.Put(b); err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+func checkStore(t *testing.T, dir string, blocks []Block) {
+	t.Helper()
+	s, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.Height() != len(blocks) {
+		t.Fatalf("height %d, want %d", s.Height(), len(blocks))
+	}
+	for i, b := range blocks {
+		got, err := s.Get(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Hash(), b.Hash()) {
+			t.Errorf("block %d hash %x, want %x", i, got.Hash(), b.Hash())
+		}
+	}
+}
+
+func TestBlockStoreTruncate(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := storeBlocks(t, s, 5)
+
+	if err := s.Truncate(3); err != nil {
+		t.Fatal(err)
+	}
+	b := testBlock()
+	b.Nonce = 100
+	if err := s.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	checkStore(t, dir, append(blocks[:3], b))
+}
+
+// TestBlockStoreInterruptedTruncate reopens a store whose block file was
+// truncated but not its index, as after a crash in Truncate.
+func TestBlockStoreInterruptedTruncate(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := storeBlocks(t, s, 5)
+	end := s.entries[3].Offset
+	s.Close()
+
+	if err := os.Truncate(filepath.Join(dir, BLOCKSTORE_BLOCKS_FILE), end); err != nil {
+		t.Fatal(err)
+	}
+	checkStore(t, dir, blocks[:3])
+}
+
+// TestBlockStoreRecoversUnindexedBlocks reopens a store whose last index
+// entries were lost, as after a crash in Put.
+func TestBlockStoreRecoversUnindexedBlocks(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := storeBlocks(t, s, 5)
+	s.Close()
+
+	if err := os.Truncate(filepath.Join(dir, BLOCKSTORE_INDEX_FILE), 2*BLOCKSTORE_INDEX_ENTRY_SIZE+5); err != nil {
+		t.Fatal(err)
+	}
+	checkStore(t, dir, blocks)
+}
@@ -0,0 +1,240 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"time"
+)
+
+// BlockRequest asks a peer for at most Count of its blocks from Height on,
+// ending at the block with Hash when it is set. The latest blocks of the range
+// are sent when it is larger than Count.
+type BlockRequest struct {
+	Hash   []byte
+	Height uint32
+	Count  uint32
+}
+
+func (r *BlockRequest) MarshalBinary() ([]byte, error) {
+	bs := &bytes.Buffer{}
+
+	bs.Write(FitBytes(r.Hash, 32))
+	binary.Write(bs, binary.LittleEndian, r.Height)
+	binary.Write(bs, binary.LittleEndian, r.Count)
+
+	return bs.Bytes(), nil
+}
+
+func (r *BlockRequest) UnMarshalBinary(d []byte) error {
+	if len(d) < BLOCK_REQUEST_SIZE {
+		return errors.New("Insuficient block request size")
+	}
+	buf := bytes.NewBuffer(d)
+
+	r.Hash = buf.Next(32)
+	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &r.Height)
+	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &r.Count)
+
+	return nil
+}
+
+// SyncMessage asks a newly connected peer for its latest blocks.
+func SyncMessage() Message {
+	r := BlockRequest{Count: BLOCK_SYNC_BATCH}
+
+	mes := NewMessage(MESSAGE_GET_BLOCK)
+	mes.From = []byte(Core.Network.Address)
+	mes.Data, _ = r.MarshalBinary()
+	return *mes
+}
+
+// RequestBlocks asks a peer for the batch of blocks ending at hash, or at its
+// tip when no hash is given. Blocks that still don't connect trigger a request
+// for the batch before them, until the branch meets our tree.
+func (bl *BlockChain) RequestBlocks(peer *Node, hash []byte) {
+	if peer == nil {
+		return
+	}
+
+	r := BlockRequest{Hash: hash, Height: 0, Count: BLOCK_SYNC_BATCH}
+
+	mes := NewMessage(MESSAGE_GET_BLOCK)
+	mes.From = []byte(Core.Network.Address)
+	mes.Data, _ = r.MarshalBinary()
+
+	log.Println("Requesting blocks from height", r.Height)
+	go peer.Queue(*mes)
+}
+
+func (bl *BlockChain) HandleBlockRequest(msg Message) {
+	r := new(BlockRequest)
+	err := r.UnMarshalBinary(msg.Data)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	end := len(bl.BlockSlice)
+	if !bytes.Equal(r.Hash, make([]byte, 32)) {
+		height, ok := bl.Store.HeightOf(r.Hash)
+		if !ok {
+			return
+		}
+		end = height + 1
+	}
+
+	count := int(r.Count)
+	if count > BLOCK_SYNC_BATCH {
+		count = BLOCK_SYNC_BATCH
+	}
+	start := int(r.Height)
+	if end-start > count {
+		start = end - count
+	}
+	if start >= end {
+		return
+	}
+
+	blocks := append(BlockSlice{}, bl.BlockSlice[start:end]...)
+	go func() {
+		for _, b := range blocks {
+			mes := NewMessage(MESSAGE_SEND_BLOCK)
+			mes.From = []byte(Core.Network.Address)
+			mes.Data, _ = b.MarshalBinary()
+			msg.Peer.Queue(*mes)
+		}
+	}()
+}
+
+// RequestTransactions asks a peer for the transactions with the given hashes.
+func (bl *BlockChain) RequestTransactions(peer *Node, hashes [][]byte) {
+	if peer == nil || len(hashes) == 0 {
+		return
+	}
+
+	messages := []Message{}
+	for _, hash := range hashes {
+		mes := NewMessage(MESSAGE_GET_TRANSACTION)
+		mes.From = []byte(Core.Network.Address)
+		mes.Data = FitBytes(hash, 32)
+		messages = append(messages, *mes)
+	}
+	go func() {
+		for _, mes := range messages {
+			peer.Queue(mes)
+		}
+	}()
+}
+
+// HandleTransactionAnnouncement requests from the peer of a
+// MESSAGE_INV_TRANSACTION the announced transactions we don't have yet.
+func (bl *BlockChain) HandleTransactionAnnouncement(msg Message) {
+	unknown := [][]byte{}
+	for d := msg.Data; len(d) >= 32; d = d[32:] {
+		if bl.FindTransaction(d[:32]) == nil {
+			unknown = append(unknown, d[:32])
+		}
+	}
+	bl.RequestTransactions(msg.Peer, unknown)
+}
+
+// HandleTransactionRequest answers a MESSAGE_GET_TRANSACTION with the
+// transaction of the requested hash, from the mempool or the chain.
+func (bl *BlockChain) HandleTransactionRequest(msg Message) {
+	if len(msg.Data) < 32 {
+		log.Println("Insuficient transaction request size")
+		return
+	}
+
+	t := bl.FindTransaction(msg.Data[:32])
+	if t == nil {
+		return
+	}
+
+	mes := NewMessage(MESSAGE_SEND_TRANSACTION)
+	mes.From = []byte(Core.Network.Address)
+	mes.Data, _ = t.MarshalBinary()
+
+	go msg.Peer.Queue(*mes)
+}
+
+// AddOrphan keeps a block whose parent we don't have yet. It returns false if
+// the block was already waiting or is not plausible. When the pool is full an
+// orphan picked at random, as the map order is, makes room for it.
+func (bl *BlockChain) AddOrphan(b *Block) bool {
+	hash := string(FitBytes(b.Hash(), 32))
+	if _, ok := bl.orphans[hash]; ok {
+		return false
+	}
+	if !bl.plausibleOrphan(b) {
+		log.Println("Implausible orphan block")
+		return false
+	}
+
+	if len(bl.orphans) >= BLOCK_MAX_ORPHANS {
+		for h := range bl.orphans {
+			bl.removeOrphan(h)
+			break
+		}
+	}
+	prev := string(FitBytes(b.PrevBlock, 32))
+	bl.orphans[hash] = b
+	bl.orphanKids[prev] = append(bl.orphanKids[prev], hash)
+	return true
+}
+
+// plausibleOrphan tells whether b could extend our chain: its target may be
+// at most 4 times easier than the one of our tip, as one retarget of NextBits
+// allows, and its time not too far in the future. Cheap blocks that can't be
+// connected are not worth keeping.
+func (bl *BlockChain) plausibleOrphan(b *Block) bool {
+	if int64(b.Timestamp) > time.Now().Unix()+BLOCK_MAX_FUTURE_TIME {
+		return false
+	}
+	if bl.Tip == nil {
+		return true
+	}
+	easiest := CompactToBig(bl.Tip.Bits)
+	easiest.Lsh(easiest, 2)
+	return b.Target().Cmp(easiest) <= 0
+}
+
+func (bl *BlockChain) removeOrphan(hash string) {
+	b, ok := bl.orphans[hash]
+	if !ok {
+		return
+	}
+	delete(bl.orphans, hash)
+
+	prev := string(FitBytes(b.PrevBlock, 32))
+	kids := bl.orphanKids[prev]
+	for i, h := range kids {
+		if h == hash {
+			kids = append(kids[:i:i], kids[i+1:]...)
+			break
+		}
+	}
+	if len(kids) == 0 {
+		delete(bl.orphanKids, prev)
+	} else {
+		bl.orphanKids[prev] = kids
+	}
+}
+
+func (bl *BlockChain) IsOrphan(hash []byte) bool {
+	_, ok := bl.orphans[string(FitBytes(hash, 32))]
+	return ok
+}
+
+// NextOrphans removes and returns the orphans that build on hash.
+func (bl *BlockChain) NextOrphans(hash []byte) []*Block {
+	blocks := []*Block{}
+	for _, h := range bl.orphanKids[string(FitBytes(hash, 32))] {
+		blocks = append(blocks, bl.orphans[h])
+		delete(bl.orphans, h)
+	}
+	delete(bl.orphanKids, string(FitBytes(hash, 32)))
+	return blocks
+}
@@ -0,0 +1,180 @@
+package bitcoin
+
+import (
+	"bytes"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func testOrphans() *BlockChain {
+	tip := &BlockNode{Block: testBlock()}
+	return &BlockChain{Tip: tip, orphans: map[string]*Block{}, orphanKids: map[string][]string{}}
+}
+
+func TestOrphansKeepCompetingChildren(t *testing.T) {
+	bl := testOrphans()
+	a, b := testBlock(), testBlock()
+	b.Nonce++
+
+	if !bl.AddOrphan(&a) || !bl.AddOrphan(&b) {
+		t.Fatal("adding an orphan fails")
+	}
+	if bl.AddOrphan(&a) {
+		t.Errorf("adding an orphan twice succeeds")
+	}
+	if !bl.IsOrphan(a.Hash()) || !bl.IsOrphan(b.Hash()) {
+		t.Errorf("competing orphans are not both kept")
+	}
+
+	kids := bl.NextOrphans(a.PrevBlock)
+	if len(kids) != 2 || !bytes.Equal(kids[0].Hash(), a.Hash()) || !bytes.Equal(kids[1].Hash(), b.Hash()) {
+		t.Errorf("next orphans %v, want both children", kids)
+	}
+	if len(bl.orphans) != 0 || len(bl.orphanKids) != 0 {
+		t.Errorf("orphans left after taking them")
+	}
+}
+
+func TestOrphansEvictOne(t *testing.T) {
+	bl := testOrphans()
+	blocks := make([]Block, BLOCK_MAX_ORPHANS+1)
+	for i := range blocks {
+		blocks[i] = testBlock()
+		blocks[i].Nonce = uint32(i)
+		blocks[i].PrevBlock = FitBytes([]byte{byte(i % 3)}, 32)
+		bl.AddOrphan(&blocks[i])
+	}
+
+	if len(bl.orphans) != BLOCK_MAX_ORPHANS {
+		t.Fatalf("%d orphans, want %d", len(bl.orphans), BLOCK_MAX_ORPHANS)
+	}
+	if !bl.IsOrphan(blocks[BLOCK_MAX_ORPHANS].Hash()) {
+		t.Errorf("the last orphan is not kept")
+	}
+	kids := 0
+	for _, hashes := range bl.orphanKids {
+		kids += len(hashes)
+	}
+	if kids != BLOCK_MAX_ORPHANS {
+		t.Errorf("%d orphans indexed by parent, want %d", kids, BLOCK_MAX_ORPHANS)
+	}
+}
+
+func TestOrphansImplausible(t *testing.T) {
+	bl := testOrphans()
+	tipTarget := bl.Tip.Target()
+
+	tests := []struct {
+		name string
+		edit func(b *Block)
+		ok   bool
+	}{
+		{"same target", func(b *Block) {}, true},
+		{"harder target", func(b *Block) { b.Bits = BigToCompact(new(big.Int).Rsh(tipTarget, 8)) }, true},
+		{"4 times easier", func(b *Block) { b.Bits = BigToCompact(new(big.Int).Lsh(tipTarget, 2)) }, true},
+		{"8 times easier", func(b *Block) { b.Bits = BigToCompact(new(big.Int).Lsh(tipTarget, 3)) }, false},
+		{"far future", func(b *Block) { b.Timestamp = uint32(time.Now().Unix() + BLOCK_MAX_FUTURE_TIME + 60) }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testBlock()
+			tt.edit(&b)
+			if bl.AddOrphan(&b) != tt.ok {
+				t.Errorf("AddOrphan = %v, want %v", !tt.ok, tt.ok)
+			}
+		})
+	}
+}
+
+// testNodes connects two nodes over loopback, with their writers running.
+func testNodes(t *testing.T) (*Node, *Node) {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("no loopback:", err)
+	}
+	defer l.Close()
+
+	dialed, err := net.DialTCP("tcp4", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := NewNode(dialed), NewNode(accepted)
+	for _, node := range []*Node{a, b} {
+		go node.write()
+	}
+	t.Cleanup(func() {
+		for _, node := range []*Node{a, b} {
+			close(node.closed)
+			node.TCPConn.Close()
+		}
+	})
+	return a, b
+}
+
+func TestTransactionRequestRoundTrip(t *testing.T) {
+	network := Core.Network
+	Core.Network = &Network{Address: "192.0.2.1:8333"}
+	defer func() { Core.Network = network }()
+
+	known := mempoolTransaction(bytes.Repeat([]byte{1}, 32), 0, COIN, []byte("known"))
+	unknown := mempoolTransaction(bytes.Repeat([]byte{2}, 32), 0, COIN, []byte("unknown"))
+
+	announcer := &BlockChain{Mempool: NewMempool(), transactions: map[string]int{}}
+	requester := &BlockChain{Mempool: NewMempool(), transactions: map[string]int{}}
+	for _, tr := range []Transaction{known, unknown} {
+		if err := announcer.Mempool.Add(tr, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := requester.Mempool.Add(known, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	toAnnouncer, toRequester := testNodes(t)
+
+	inv := NewMessage(MESSAGE_INV_TRANSACTION)
+	inv.Data = append(FitBytes(known.Hash(), 32), FitBytes(unknown.Hash(), 32)...)
+	inv.Peer = toAnnouncer
+	requester.HandleTransactionAnnouncement(*inv)
+
+	// Only the unknown transaction is requested
+	toRequester.SetReadDeadline(time.Now().Add(5 * time.Second))
+	req, err := ReadMessage(toRequester.reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Identifier != MESSAGE_GET_TRANSACTION || !bytes.Equal(req.Data, FitBytes(unknown.Hash(), 32)) {
+		t.Fatalf("request %d for %x, want the unknown transaction", req.Identifier, req.Data)
+	}
+	toRequester.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if extra, err := ReadMessage(toRequester.reader); err == nil {
+		t.Errorf("unexpected request %d for %x", extra.Identifier, extra.Data)
+	}
+
+	req.Peer = toRequester
+	announcer.HandleTransactionRequest(*req)
+
+	toAnnouncer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := ReadMessage(toAnnouncer.reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Identifier != MESSAGE_SEND_TRANSACTION {
+		t.Fatalf("reply %d, want MESSAGE_SEND_TRANSACTION", reply.Identifier)
+	}
+	tr := new(Transaction)
+	if _, err := tr.UnMarshalBinary(reply.Data); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tr.Hash(), unknown.Hash()) {
+		t.Errorf("received %x, want %x", tr.Hash(), unknown.Hash())
+	}
+}
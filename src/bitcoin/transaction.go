@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"math"
+	"math/big"
 	"reflect"
 	"time"
 )
@@ -14,66 +15,247 @@ type Transaction struct {
 	Header    TransactionHeader
 	Signature []byte
 	Payload   []byte
+	Inputs    []TransactionInput
+	Outputs   []TransactionOutput
 	From      []byte
 }
 
 type TransactionHeader struct {
+	Version       uint32
 	From          []byte
 	To            []byte
 	Timestamp     uint32
 	Nonce         uint32
 	PayloadHash   []byte
 	PayloadLength uint32
+	InputCount    uint32
+	OutputCount   uint32
+	LockTime      uint32
+}
+
+// TransactionInput spends the output Index of the transaction PrevTransaction.
+// Script unlocks that output, usually with signatures over the transaction
+// hash.
+type TransactionInput struct {
+	PrevTransaction []byte
+	Index           uint32
+	Script          []byte
+}
+
+// TransactionOutput locks Amount with Script, see script.go.
+type TransactionOutput struct {
+	Amount uint64
+	Script []byte
+}
+
+func (in *TransactionInput) MarshalBinary() ([]byte, error) {
+	if len(in.Script) > math.MaxUint16 {
+		return nil, errors.New("Input script too long")
+	}
+	bs := &bytes.Buffer{}
+
+	bs.Write(FitBytes(in.PrevTransaction, 32))
+	binary.Write(bs, binary.LittleEndian, in.Index)
+	binary.Write(bs, binary.LittleEndian, uint16(len(in.Script)))
+	bs.Write(in.Script)
+
+	return bs.Bytes(), nil
+}
+
+func (in *TransactionInput) UnMarshalBinary(d []byte) ([]byte, error) {
+	if len(d) < TRANSACTION_INPUT_SIZE {
+		return nil, errors.New("Insuficient transaction input size")
+	}
+	buf := bytes.NewBuffer(d)
+
+	var l uint16
+	in.PrevTransaction = buf.Next(32)
+	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &in.Index)
+	binary.Read(bytes.NewBuffer(buf.Next(2)), binary.LittleEndian, &l)
+	if int(l) > buf.Len() {
+		return nil, errors.New("Insuficient transaction input size")
+	}
+	in.Script = buf.Next(int(l))
+
+	return buf.Bytes(), nil
+}
+
+func (out *TransactionOutput) MarshalBinary() ([]byte, error) {
+	if len(out.Script) > math.MaxUint16 {
+		return nil, errors.New("Output script too long")
+	}
+	bs := &bytes.Buffer{}
+
+	binary.Write(bs, binary.LittleEndian, out.Amount)
+	binary.Write(bs, binary.LittleEndian, uint16(len(out.Script)))
+	bs.Write(out.Script)
+
+	return bs.Bytes(), nil
+}
+
+func (out *TransactionOutput) UnMarshalBinary(d []byte) ([]byte, error) {
+	if len(d) < TRANSACTION_OUTPUT_SIZE {
+		return nil, errors.New("Insuficient transaction output size")
+	}
+	buf := bytes.NewBuffer(d)
+
+	var l uint16
+	binary.Read(bytes.NewBuffer(buf.Next(8)), binary.LittleEndian, &out.Amount)
+	binary.Read(bytes.NewBuffer(buf.Next(2)), binary.LittleEndian, &l)
+	if int(l) > buf.Len() {
+		return nil, errors.New("Insuficient transaction output size")
+	}
+	out.Script = buf.Next(int(l))
+
+	return buf.Bytes(), nil
+}
+
+// KeyHash is the key hash a PayToKeyHash output is locked to, or nil.
+func (out *TransactionOutput) KeyHash() []byte {
+	return ScriptKeyHash(out.Script)
 }
 
 func NewTransaction(from, to, payload []byte) *Transaction {
 	t := Transaction{
 		Header: TransactionHeader{
-			From: from,
-			To:   to,
+			Version: CONSENSUS_VERSION,
+			From:    from,
+			To:      to,
 		},
-		Payload: payload,
 	}
 
 	t.Header.Timestamp = uint32(time.Now().Unix())
+	t.SetPayload(payload)
+
+	return &t
+}
+
+func (t *Transaction) SetPayload(payload []byte) {
+	t.Payload = payload
+
 	hash := sha256.New()
 	hash.Write(payload)
 	t.Header.PayloadHash = hash.Sum(nil)
 	t.Header.PayloadLength = uint32(len(t.Payload))
+}
 
-	return &t
+// NewCoinbase creates the transaction of the miner keypair locking amount
+// with script in the block at height. The height in the payload keeps
+// coinbase hashes unique.
+func NewCoinbase(keypair *Keypair, height int, amount uint64, script []byte) *Transaction {
+	t := NewTransaction(keypair.Public, keypair.Public, coinbasePayload(height))
+	t.Header.Version = keypair.Scheme
+	t.AddOutput(amount, script)
+	t.Header.Nonce = t.GenerateNonce(TRANSACTION_POW)
+	t.Signature = t.Sign(keypair)
+
+	return t
+}
+
+// IsCoinbase reports whether t creates value out of nothing, which only the
+// first transaction of a block may do.
+func (t *Transaction) IsCoinbase() bool {
+	return len(t.Inputs) == 0 && len(t.Outputs) > 0
 }
 
+// Hash identifies the transaction and is the digest its signatures sign. It
+// covers the header, the outputs spent and the outputs created, so input
+// scripts and the signature are left out.
 func (t *Transaction) Hash() []byte {
 	headerBytes, _ := t.Header.MarshalBinary()
 	hash := sha256.New()
 	hash.Write(headerBytes)
 
+	for _, in := range t.Inputs {
+		hash.Write(FitBytes(in.PrevTransaction, 32))
+		binary.Write(hash, binary.LittleEndian, in.Index)
+	}
+	for _, out := range t.Outputs {
+		ob, _ := out.MarshalBinary()
+		hash.Write(ob)
+	}
+
 	return hash.Sum(nil)
 }
 
+// WitnessHash covers the whole encoding of the transaction, signatures
+// included. Blocks commit to it so that nobody relaying a block can change
+// its signatures without changing its hash.
+func (t *Transaction) WitnessHash() []byte {
+	d, _ := t.MarshalBinary()
+	hash := sha256.Sum256(d)
+	return hash[:]
+}
+
 func (t *Transaction) Sign(keypair *Keypair) []byte {
 
 	s, _ := keypair.Sign(t.Hash())
 	return s
 }
 
-func (t *Transaction) VerifyTransaction(pow []byte) bool {
+// SignInputs unlocks every input with a signature of keypair, which must own
+// the PayToKeyHash outputs they spend.
+func (t *Transaction) SignInputs(keypair *Keypair) {
+	hash := t.Hash()
+	for i := range t.Inputs {
+		sig, _ := keypair.Sign(hash)
+		t.Inputs[i].Script = SignatureScript(sig, keypair.Public)
+	}
+}
+
+func (t *Transaction) AddInput(prevTransaction []byte, index uint32) {
+	t.Inputs = append(t.Inputs, TransactionInput{PrevTransaction: prevTransaction, Index: index})
+	t.Header.InputCount = uint32(len(t.Inputs))
+}
+
+func (t *Transaction) AddOutput(amount uint64, script []byte) {
+	t.Outputs = append(t.Outputs, TransactionOutput{Amount: amount, Script: script})
+	t.Header.OutputCount = uint32(len(t.Outputs))
+}
+
+// VerifyTransaction checks what does not depend on the outputs spent: the
+// payload, proof of work, sender signature and that scripts are well formed.
+// The scripts run against the spent outputs in UTXOSet.CheckTransaction.
+func (t *Transaction) VerifyTransaction(pow *big.Int) bool {
 
 	headerHash := t.Hash()
 	hash := sha256.New()
 	hash.Write(t.Payload)
 	payloadHash := hash.Sum(nil)
 
+	for _, in := range t.Inputs {
+		if CheckScript(in.Script, true) != nil {
+			return false
+		}
+	}
+	for _, out := range t.Outputs {
+		if CheckScript(out.Script, false) != nil {
+			return false
+		}
+	}
+
 	return reflect.DeepEqual(payloadHash, t.Header.PayloadHash) &&
 		CheckProofOfWork(pow, headerHash) &&
-		SignatureVerify(t.Header.From, t.Signature, headerHash)
+		SignatureVerify(t.Header.Version, t.Header.From, t.Signature, headerHash)
+
+}
 
+// IsFinal tells whether t may go in the block at height with timestamp, its
+// LockTime being a height or a time before it.
+func (t *Transaction) IsFinal(height int, timestamp uint32) bool {
+	lockTime := t.Header.LockTime
+	if lockTime == 0 {
+		return true
+	}
+	if lockTime < LOCKTIME_THRESHOLD {
+		return int64(lockTime) < int64(height)
+	}
+	return lockTime < timestamp
 }
 
-func (t Transaction) GenerateNonce(prefix []byte) uint32 {
+func (t Transaction) GenerateNonce(target *big.Int) uint32 {
 	for {
-		if CheckProofOfWork(prefix, t.Hash()) {
+		if CheckProofOfWork(target, t.Hash()) {
 			break
 		}
 		t.Header.Nonce++
@@ -84,54 +266,114 @@ func (t Transaction) GenerateNonce(prefix []byte) uint32 {
 func (th *TransactionHeader) MarshalBinary() ([]byte, error) {
 	buf := &bytes.Buffer{}
 
+	binary.Write(buf, binary.LittleEndian, th.Version)
 	buf.Write(FitBytes(th.From, NETWORK_KEY_SIZE))
 	buf.Write(FitBytes(th.To, NETWORK_KEY_SIZE))
 	binary.Write(buf, binary.LittleEndian, th.Timestamp)
-	buf.Write(th.PayloadHash[:32])
+	buf.Write(FitBytes(th.PayloadHash, 32))
 	binary.Write(buf, binary.LittleEndian, th.PayloadLength)
 	binary.Write(buf, binary.LittleEndian, th.Nonce)
+	binary.Write(buf, binary.LittleEndian, th.InputCount)
+	binary.Write(buf, binary.LittleEndian, th.OutputCount)
+	binary.Write(buf, binary.LittleEndian, th.LockTime)
 
 	return buf.Bytes(), nil
 }
 
 func (th *TransactionHeader) UnMarshalBinary(d []byte) error {
+	if len(d) != TRANSACTION_HEADER_SIZE {
+		return errors.New("Wrong transaction header size")
+	}
 	buf := bytes.NewBuffer(d)
+	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &th.Version)
 	th.From = buf.Next(NETWORK_KEY_SIZE)
 	th.To = buf.Next(NETWORK_KEY_SIZE)
 	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &th.Timestamp)
 	th.PayloadHash = buf.Next(32)
 	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &th.PayloadLength)
 	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &th.Nonce)
+	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &th.InputCount)
+	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &th.OutputCount)
+	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &th.LockTime)
 
+	if _, err := GetSignatureScheme(th.Version); err != nil {
+		return errors.New("Unknown transaction version")
+	}
 	return nil
 }
 
+// MarshalBinary writes the header, the signature, the payload, the inputs and
+// the outputs, whose numbers and sizes must match the header. From only
+// concerns the peer the transaction came from and is left out.
 func (t *Transaction) MarshalBinary() ([]byte, error) {
+	if int(t.Header.PayloadLength) != len(t.Payload) ||
+		int(t.Header.InputCount) != len(t.Inputs) || int(t.Header.OutputCount) != len(t.Outputs) {
+		return nil, errors.New("Transaction header does not match its content")
+	}
 
 	bs := &bytes.Buffer{}
 
 	thBytes, _ := t.Header.MarshalBinary()
-	if len(thBytes) != TRANSACTION_HEADER_SIZE {
-		return nil, errors.New("Wrong Byte length")
-	}
 	bs.Write(thBytes)
 	bs.Write(FitBytes(t.Signature, NETWORK_KEY_SIZE))
 	bs.Write(t.Payload)
-	bs.Write(FitBytes(t.From, IP_SIZE))
+	for _, in := range t.Inputs {
+		ib, err := in.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		bs.Write(ib)
+	}
+	for _, out := range t.Outputs {
+		ob, err := out.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		bs.Write(ob)
+	}
 
 	return bs.Bytes(), nil
 }
 
+// UnMarshalBinary reads a transaction from the start of d and returns the
+// bytes after it.
 func (t *Transaction) UnMarshalBinary(d []byte) ([]byte, error) {
+	if len(d) < TRANSACTION_HEADER_SIZE+NETWORK_KEY_SIZE {
+		return nil, errors.New("Insuficient transaction size")
+	}
 
 	bf := bytes.NewBuffer(d)
-	thBytes := bf.Next(TRANSACTION_HEADER_SIZE)
-	t.Header.UnMarshalBinary(thBytes)
+	if err := t.Header.UnMarshalBinary(bf.Next(TRANSACTION_HEADER_SIZE)); err != nil {
+		return nil, err
+	}
 	t.Signature = bf.Next(NETWORK_KEY_SIZE)
+	if int(t.Header.PayloadLength) > bf.Len() {
+		return nil, errors.New("Insuficient transaction size")
+	}
 	t.Payload = bf.Next(int(t.Header.PayloadLength))
-	t.From = bf.Next(IP_SIZE)
 
-	return bf.Next(math.MaxInt64), nil
+	if int(t.Header.InputCount)*TRANSACTION_INPUT_SIZE+int(t.Header.OutputCount)*TRANSACTION_OUTPUT_SIZE > bf.Len() {
+		return nil, errors.New("Insuficient transaction size")
+	}
+	var err error
+	rest := bf.Bytes()
+	t.Inputs, t.Outputs = nil, nil
+	for i := 0; i < int(t.Header.InputCount); i++ {
+		in := TransactionInput{}
+		if rest, err = in.UnMarshalBinary(rest); err != nil {
+			return nil, err
+		}
+		t.Inputs = append(t.Inputs, in)
+	}
+	for i := 0; i < int(t.Header.OutputCount); i++ {
+		out := TransactionOutput{}
+		if rest, err = out.UnMarshalBinary(rest); err != nil {
+			return nil, err
+		}
+		t.Outputs = append(t.Outputs, out)
+	}
+
+	return rest, nil
 }
 
 type TransactionSlice []Transaction
@@ -150,6 +392,16 @@ func (slice TransactionSlice) Exists(tr Transaction) bool {
 	return false
 }
 
+func (slice TransactionSlice) Find(hash []byte) *Transaction {
+	for i := range slice {
+		if bytes.Equal(slice[i].Hash(), hash) {
+			return &slice[i]
+		}
+	}
+
+	return nil
+}
+
 func (slice TransactionSlice) AddTransaction(tr Transaction) TransactionSlice {
 	for i, t := range slice {
 		if t.Header.Timestamp > tr.Header.Timestamp {
@@ -176,7 +428,7 @@ func (slice *TransactionSlice) MarshalBinary() ([]byte, error) {
 func (slice *TransactionSlice) UnMarshalBinary(d []byte) error {
 	remaining := d
 
-	for len(remaining) > TRANSACTION_HEADER_SIZE+NETWORK_KEY_SIZE {
+	for len(remaining) > 0 {
 		t := new(Transaction)
 		rem, err := t.UnMarshalBinary(remaining)
 
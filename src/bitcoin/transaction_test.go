@@ -0,0 +1,201 @@
+package bitcoin
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func testTransaction() Transaction {
+	tr := Transaction{Header: TransactionHeader{
+		Version:   CONSENSUS_VERSION,
+		From:      bytes.Repeat([]byte{0x55}, NETWORK_KEY_SIZE),
+		To:        bytes.Repeat([]byte{0x66}, NETWORK_KEY_SIZE),
+		Timestamp: 1514764801,
+		Nonce:     9,
+		LockTime:  100,
+	}}
+	tr.SetPayload([]byte("payload"))
+	tr.AddInput(bytes.Repeat([]byte{0x77}, 32), 1)
+	tr.AddInput(bytes.Repeat([]byte{0x88}, 32), 0)
+	tr.Inputs[0].Script = SignatureScript(bytes.Repeat([]byte{0x99}, 71), bytes.Repeat([]byte{0xaa}, 33))
+	tr.AddOutput(3*COIN, PayToKeyHash(bytes.Repeat([]byte{0xbb}, ADDRESS_HASH_SIZE)))
+	tr.AddOutput(0, []byte{OP_RETURN})
+	tr.Signature = bytes.Repeat([]byte{0xcc}, NETWORK_KEY_SIZE)
+	return tr
+}
+
+// roundTripTransaction decodes the encoding of tr followed by extra bytes,
+// which must be returned as they are, and encodes the result again.
+func roundTripTransaction(t *testing.T, tr Transaction) {
+	t.Helper()
+	d, err := tr.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := Transaction{}
+	rest, err := decoded.UnMarshalBinary(append(append([]byte{}, d...), 1, 2, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, []byte{1, 2, 3}) {
+		t.Errorf("decoding leaves %x, want 010203", rest)
+	}
+	again, err := decoded.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(again, d) {
+		t.Errorf("encoding does not round trip:\n got %x\nwant %x", again, d)
+	}
+	if !bytes.Equal(decoded.Hash(), tr.Hash()) || !bytes.Equal(decoded.WitnessHash(), tr.WitnessHash()) {
+		t.Errorf("hashes change in the round trip")
+	}
+}
+
+func TestTransactionRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(tr *Transaction)
+	}{
+		{"payment", func(tr *Transaction) {}},
+		{"empty payload", func(tr *Transaction) { tr.SetPayload(nil) }},
+		{"no inputs", func(tr *Transaction) { tr.Inputs, tr.Header.InputCount = nil, 0 }},
+		{"no outputs", func(tr *Transaction) { tr.Outputs, tr.Header.OutputCount = nil, 0 }},
+		{"empty scripts", func(tr *Transaction) { tr.Inputs[0].Script, tr.Outputs[0].Script = nil, nil }},
+		{"longest script", func(tr *Transaction) { tr.Outputs[0].Script = make([]byte, math.MaxUint16) }},
+		{"p224 version", func(tr *Transaction) { tr.Header.Version = SCHEME_P224 }},
+		{"coinbase", func(tr *Transaction) {
+			*tr = *NewCoinbase(&Keypair{Public: make([]byte, NETWORK_KEY_SIZE), Scheme: CONSENSUS_VERSION}, 3, COIN, nil)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := testTransaction()
+			tt.edit(&tr)
+			roundTripTransaction(t, tr)
+		})
+	}
+}
+
+func TestTransactionMarshalRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(tr *Transaction)
+	}{
+		{"input count", func(tr *Transaction) { tr.Header.InputCount++ }},
+		{"output count", func(tr *Transaction) { tr.Header.OutputCount-- }},
+		{"payload length", func(tr *Transaction) { tr.Payload = tr.Payload[1:] }},
+		{"input script too long", func(tr *Transaction) { tr.Inputs[1].Script = make([]byte, math.MaxUint16+1) }},
+		{"output script too long", func(tr *Transaction) { tr.Outputs[1].Script = make([]byte, math.MaxUint16+1) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := testTransaction()
+			tt.edit(&tr)
+			if _, err := tr.MarshalBinary(); err == nil {
+				t.Errorf("encoding succeeds")
+			}
+		})
+	}
+}
+
+func TestTransactionUnMarshalRejects(t *testing.T) {
+	tr := testTransaction()
+	d, _ := tr.MarshalBinary()
+
+	unknownVersion := append([]byte{}, d...)
+	unknownVersion[0] = 0xff
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated header", d[:TRANSACTION_HEADER_SIZE-1]},
+		{"truncated signature", d[:TRANSACTION_HEADER_SIZE+NETWORK_KEY_SIZE-1]},
+		{"truncated payload", d[:TRANSACTION_HEADER_SIZE+NETWORK_KEY_SIZE+3]},
+		{"truncated input", d[:TRANSACTION_HEADER_SIZE+NETWORK_KEY_SIZE+len(tr.Payload)+TRANSACTION_INPUT_SIZE+1]},
+		{"truncated output", d[:len(d)-1]},
+		{"unknown version", unknownVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := new(Transaction).UnMarshalBinary(tt.data); err == nil {
+				t.Errorf("decoding succeeds")
+			}
+		})
+	}
+}
+
+func TestTransactionSliceRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		slice TransactionSlice
+	}{
+		{"empty", TransactionSlice{}},
+		{"one", TransactionSlice{testTransaction()}},
+		{"three", TransactionSlice{testTransaction(), testTransaction(), testTransaction()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := tt.slice.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := TransactionSlice{}
+			if err := decoded.UnMarshalBinary(d); err != nil {
+				t.Fatal(err)
+			}
+			if len(decoded) != len(tt.slice) {
+				t.Fatalf("decoded %d transactions, want %d", len(decoded), len(tt.slice))
+			}
+			again, _ := decoded.MarshalBinary()
+			if !bytes.Equal(again, d) {
+				t.Errorf("encoding does not round trip")
+			}
+		})
+	}
+}
+
+func TestTransactionGolden(t *testing.T) {
+	tr := testTransaction()
+	d, err := tr.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "transaction.golden", d)
+
+	decoded := Transaction{}
+	if _, err := decoded.UnMarshalBinary(readGolden(t, "transaction.golden")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Hash(), tr.Hash()) {
+		t.Errorf("golden transaction hash %x, want %x", decoded.Hash(), tr.Hash())
+	}
+}
+
+// FuzzTransactionUnMarshal checks that decoding never panics and that the
+// bytes it consumes are the canonical encoding of the result.
+func FuzzTransactionUnMarshal(f *testing.F) {
+	f.Add(readGolden(f, "transaction.golden"))
+	coinbase, _ := (*Params.Genesis.TransactionSlice)[0].MarshalBinary()
+	f.Add(coinbase)
+
+	f.Fuzz(func(t *testing.T, d []byte) {
+		tr := Transaction{}
+		rest, err := tr.UnMarshalBinary(d)
+		if err != nil {
+			return
+		}
+		again, err := tr.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again, d[:len(d)-len(rest)]) {
+			t.Errorf("decoded transaction encodes to\n%x\nnot\n%x", again, d[:len(d)-len(rest)])
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package bitcoin
+
+import (
+	"bytes"
+	"math/big"
+)
+
+// BlockNode is a block placed in the block tree together with the proof of
+// work accumulated from the first block up to it. Invalid is set once its
+// transactions failed to apply.
+type BlockNode struct {
+	Block
+	Hash    []byte
+	Parent  *BlockNode
+	Height  int
+	Work    *big.Int
+	Invalid bool
+}
+
+type BlockTree map[string]*BlockNode
+
+func (t BlockTree) Exists(hash []byte) bool {
+	return t[string(FitBytes(hash, 32))] != nil
+}
+
+func (t BlockTree) Get(hash []byte) *BlockNode {
+	return t[string(FitBytes(hash, 32))]
+}
+
+// Add places b under its parent. It returns nil when the parent is unknown.
+func (t BlockTree) Add(b Block) *BlockNode {
+	node := &BlockNode{Block: b, Hash: FitBytes(b.Hash(), 32), Height: 0, Work: BlockWork(b)}
+
+	prev := FitBytes(b.PrevBlock, 32)
+	if !bytes.Equal(prev, make([]byte, 32)) {
+		node.Parent = t.Get(prev)
+		if node.Parent == nil {
+			return nil
+		}
+		node.Height = node.Parent.Height + 1
+		node.Work.Add(node.Work, node.Parent.Work)
+	}
+
+	t[string(node.Hash)] = node
+	return node
+}
+
+// Heavier reports whether node carries more work than other. A nil node
+// carries none.
+func (node *BlockNode) Heavier(other *BlockNode) bool {
+	if other == nil {
+		return node != nil
+	}
+	return node != nil && node.Work.Cmp(other.Work) > 0
+}
@@ -1,5 +1,11 @@
 package bitcoin
 
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
 func FitBytes(bs []byte, l int) []byte {
 	if len(bs) < l {
 		for len(bs) < l {
@@ -19,3 +25,17 @@ func ArrayOfBytes(len int, unit byte) []byte {
 
 	return bs
 }
+
+// writeBytes writes d prefixed by its length, for readBytes.
+func writeBytes(bs *bytes.Buffer, d []byte) {
+	binary.Write(bs, binary.LittleEndian, uint32(len(d)))
+	bs.Write(d)
+}
+
+func readBytes(buf *bytes.Buffer) ([]byte, error) {
+	var l uint32
+	if err := binary.Read(buf, binary.LittleEndian, &l); err != nil || int(l) > buf.Len() {
+		return nil, errors.New("Truncated data")
+	}
+	return buf.Next(int(l)), nil
+}
@@ -0,0 +1,232 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+type OutPoint struct {
+	Transaction []byte
+	Index       uint32
+}
+
+func (o OutPoint) key() string {
+	bs := &bytes.Buffer{}
+	bs.Write(FitBytes(o.Transaction, 32))
+	binary.Write(bs, binary.LittleEndian, o.Index)
+	return bs.String()
+}
+
+type UnspentOutput struct {
+	OutPoint
+	TransactionOutput
+}
+
+// UTXOSet holds the outputs of the active chain that are not spent yet. It is
+// updated by the BlockChain goroutine and read by wallets, hence the lock.
+// height is the one of the last block connected.
+type UTXOSet struct {
+	lock    sync.RWMutex
+	outputs map[string]UnspentOutput
+	height  int
+}
+
+func NewUTXOSet() *UTXOSet {
+	return &UTXOSet{outputs: map[string]UnspentOutput{}, height: -1}
+}
+
+// Height is the one of the last block connected.
+func (u *UTXOSet) Height() int {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	return u.height
+}
+
+func (u *UTXOSet) Get(o OutPoint) (TransactionOutput, bool) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	uo, ok := u.outputs[o.key()]
+	return uo.TransactionOutput, ok
+}
+
+// Unspent lists the PayToKeyHash outputs locked to keyHash.
+func (u *UTXOSet) Unspent(keyHash []byte) []UnspentOutput {
+	return u.UnspentScript(PayToKeyHash(keyHash))
+}
+
+// UnspentScript lists the outputs locked with script.
+func (u *UTXOSet) UnspentScript(script []byte) []UnspentOutput {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	unspent := []UnspentOutput{}
+	for _, uo := range u.outputs {
+		if bytes.Equal(uo.Script, script) {
+			unspent = append(unspent, uo)
+		}
+	}
+	return unspent
+}
+
+func (u *UTXOSet) Balance(keyHash []byte) (balance uint64) {
+	for _, uo := range u.Unspent(keyHash) {
+		balance += uo.Amount
+	}
+	return
+}
+
+// CheckTransaction validates the inputs of t against the set, skipping outputs
+// listed in spent, and returns the fee it pays. t must be final in the next
+// block.
+func (u *UTXOSet) CheckTransaction(t Transaction, spent map[string]bool) (uint64, error) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	return u.checkTransaction(t, spent, u.height+1, uint32(time.Now().Unix()))
+}
+
+func (u *UTXOSet) checkTransaction(t Transaction, spent map[string]bool, height int, timestamp uint32) (uint64, error) {
+
+	if !t.IsFinal(height, timestamp) {
+		return 0, errors.New("Transaction is not final")
+	}
+
+	var in, out uint64
+	for _, o := range t.Outputs {
+		if o.Amount > math.MaxUint64-out {
+			return 0, errors.New("Output amount overflow")
+		}
+		out += o.Amount
+	}
+
+	if len(t.Inputs) == 0 {
+		if out > 0 {
+			return 0, errors.New("Transaction creates value")
+		}
+		return 0, nil
+	}
+
+	// Every input runs its script against the one of the output it spends
+	hash := t.Hash()
+	seen := map[string]bool{}
+	for _, i := range t.Inputs {
+		k := OutPoint{i.PrevTransaction, i.Index}.key()
+		if seen[k] || spent[k] {
+			return 0, errors.New("Output already spent")
+		}
+		seen[k] = true
+
+		uo, ok := u.outputs[k]
+		if !ok {
+			return 0, errors.New("Spending unknown output")
+		}
+		if err := VerifyScript(i.Script, uo.Script, &t, hash); err != nil {
+			return 0, errors.New("Input script fails: " + err.Error())
+		}
+		if uo.Amount > math.MaxUint64-in {
+			return 0, errors.New("Input amount overflow")
+		}
+		in += uo.Amount
+	}
+
+	if out > in {
+		return 0, errors.New("Outputs exceed inputs")
+	}
+	return in - out, nil
+}
+
+// ConnectBlock validates and applies the transactions of the block b at
+// height in order. It returns the outputs spent, needed to disconnect the
+// block later. Nothing is changed if a transaction fails.
+func (u *UTXOSet) ConnectBlock(b Block, height int) ([]UnspentOutput, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	ts := *b.TransactionSlice
+	if len(ts) == 0 || !ts[0].IsCoinbase() {
+		return nil, errors.New("Missing coinbase")
+	}
+	if !bytes.HasPrefix(ts[0].Payload, coinbasePayload(height)) || len(ts[0].Payload) > COINBASE_MAX_PAYLOAD {
+		return nil, errors.New("Wrong coinbase height")
+	}
+
+	undo := u.apply(ts[0])
+	fees := uint64(0)
+	for i := 1; i < len(ts); i++ {
+		fee, err := u.checkTransaction(ts[i], nil, height, b.Timestamp)
+		if err == nil && fee > math.MaxUint64-fees {
+			err = errors.New("Fee overflow")
+		}
+		if err != nil {
+			u.disconnect(ts[:i], undo)
+			return nil, err
+		}
+		fees += fee
+		undo = append(undo, u.apply(ts[i])...)
+	}
+
+	var reward uint64
+	for _, o := range ts[0].Outputs {
+		if o.Amount > math.MaxUint64-reward {
+			reward = math.MaxUint64
+			break
+		}
+		reward += o.Amount
+	}
+	if reward > BlockSubsidy(height)+fees {
+		u.disconnect(ts, undo)
+		return nil, errors.New("Coinbase pays too much")
+	}
+
+	u.height = height
+	return undo, nil
+}
+
+func coinbasePayload(height int) []byte {
+	bs := &bytes.Buffer{}
+	binary.Write(bs, binary.LittleEndian, uint32(height))
+	return bs.Bytes()
+}
+
+func (u *UTXOSet) apply(t Transaction) []UnspentOutput {
+	spent := []UnspentOutput{}
+	for _, i := range t.Inputs {
+		k := OutPoint{i.PrevTransaction, i.Index}.key()
+		spent = append(spent, u.outputs[k])
+		delete(u.outputs, k)
+	}
+
+	hash := t.Hash()
+	for i, o := range t.Outputs {
+		op := OutPoint{hash, uint32(i)}
+		u.outputs[op.key()] = UnspentOutput{op, o}
+	}
+	return spent
+}
+
+// DisconnectBlock reverts ConnectBlock given the outputs it returned.
+func (u *UTXOSet) DisconnectBlock(b Block, undo []UnspentOutput) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.disconnect(*b.TransactionSlice, undo)
+	u.height--
+}
+
+func (u *UTXOSet) disconnect(ts TransactionSlice, undo []UnspentOutput) {
+	for i := len(ts) - 1; i >= 0; i-- {
+		hash := ts[i].Hash()
+		for j := range ts[i].Outputs {
+			delete(u.outputs, OutPoint{hash, uint32(j)}.key())
+		}
+	}
+	for _, uo := range undo {
+		u.outputs[uo.key()] = uo
+	}
+}
@@ -0,0 +1,597 @@
+package bitcoin
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// walletEntry is a key as stored in the wallet file. Keys derived from the
+// seed only keep their derivation Path; imported keys have their private key
+// sealed with the passphrase derived key; watch-only keys have neither.
+type walletEntry struct {
+	Scheme uint32
+	Public []byte
+	Nonce  []byte
+	Sealed []byte
+	Path   string
+}
+
+// WalletKey describes a key of the wallet.
+type WalletKey struct {
+	Public    []byte
+	Path      string
+	WatchOnly bool
+}
+
+// Wallet is a file of keys whose secrets are encrypted with AES-GCM under a
+// key derived from a passphrase with scrypt. Most keys are derived from a
+// seed along WALLET_RECEIVE_PATH and WALLET_CHANGE_PATH; the extended public
+// keys of both chains are kept in clear so fresh addresses can be handed out
+// while the wallet is locked. Reading private keys needs it unlocked. The
+// first key is the identity of the node.
+type Wallet struct {
+	lock    sync.Mutex
+	path    string
+	salt    []byte
+	N, R, P uint32
+
+	seedNonce   []byte
+	seedSealed  []byte
+	receive     *ExtendedKey
+	change      *ExtendedKey
+	receiveNext uint32
+	changeNext  uint32
+
+	entries []walletEntry
+
+	key    []byte
+	relock *time.Timer
+}
+
+// CreateWallet writes a new wallet at path from a fresh mnemonic, which is
+// returned for backup. The wallet is returned unlocked.
+func CreateWallet(path, passphrase string) (*Wallet, string, error) {
+	mnemonic, err := NewMnemonic()
+	if err != nil {
+		return nil, "", err
+	}
+
+	w, err := RestoreWallet(path, passphrase, mnemonic, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	return w, mnemonic, nil
+}
+
+// RestoreWallet writes a wallet at path from mnemonic, deriving lookahead
+// receive and change keys beyond the identity so previous funds show up.
+// The wallet is returned unlocked.
+func RestoreWallet(path, passphrase, mnemonic string, lookahead int) (*Wallet, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, errors.New("Wallet already exists")
+	}
+
+	seed, err := MnemonicSeed(mnemonic)
+	if err != nil {
+		return nil, err
+	}
+	master, err := NewMasterKey(seed)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Wallet{path: path, salt: make([]byte, WALLET_SALT_SIZE), N: WALLET_SCRYPT_N, R: WALLET_SCRYPT_R, P: WALLET_SCRYPT_P}
+	if _, err := rand.Read(w.salt); err != nil {
+		return nil, err
+	}
+	if w.key, err = w.deriveKey(passphrase); err != nil {
+		return nil, err
+	}
+	if w.seedNonce, w.seedSealed, err = w.seal(seed, []byte("seed")); err != nil {
+		return nil, err
+	}
+
+	receive, err := master.Derive(WALLET_RECEIVE_PATH)
+	if err != nil {
+		return nil, err
+	}
+	change, err := master.Derive(WALLET_CHANGE_PATH)
+	if err != nil {
+		return nil, err
+	}
+	w.receive, w.change = receive.Neuter(), change.Neuter()
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for i := 0; i <= lookahead; i++ {
+		if _, err := w.nextKey(w.receive, WALLET_RECEIVE_PATH, &w.receiveNext); err != nil {
+			return nil, err
+		}
+	}
+	for i := 0; i < lookahead; i++ {
+		if _, err := w.nextKey(w.change, WALLET_CHANGE_PATH, &w.changeNext); err != nil {
+			return nil, err
+		}
+	}
+	return w, w.save()
+}
+
+// OpenWallet reads the wallet at path. It is returned locked.
+func OpenWallet(path string) (*Wallet, error) {
+	d, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Wallet{path: path}
+	if err := w.UnMarshalBinary(d); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Wallet) deriveKey(passphrase string) ([]byte, error) {
+	return Scrypt([]byte(passphrase), w.salt, int(w.N), int(w.R), int(w.P), 32)
+}
+
+func (w *Wallet) aead() (cipher.AEAD, error) {
+	if w.key == nil {
+		return nil, errors.New("Wallet is locked")
+	}
+
+	block, err := aes.NewCipher(w.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts secret, authenticating data along with it so sealed values
+// cannot be swapped.
+func (w *Wallet) seal(secret, data []byte) ([]byte, []byte, error) {
+	aead, err := w.aead()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, secret, data), nil
+}
+
+func (w *Wallet) open(nonce, sealed, data []byte) ([]byte, error) {
+	aead, err := w.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := aead.Open(nil, nonce, sealed, data)
+	if err != nil {
+		return nil, errors.New("Wrong passphrase")
+	}
+	return secret, nil
+}
+
+// keypair recovers the private key of e.
+func (w *Wallet) keypair(e walletEntry) (*Keypair, error) {
+	switch {
+	case e.Path != "":
+		seed, err := w.open(w.seedNonce, w.seedSealed, []byte("seed"))
+		if err != nil {
+			return nil, err
+		}
+		master, err := NewMasterKey(seed)
+		if err != nil {
+			return nil, err
+		}
+		key, err := master.Derive(e.Path)
+		if err != nil {
+			return nil, err
+		}
+		return key.Keypair()
+	case e.Sealed == nil:
+		return nil, errors.New("Watch-only key")
+	}
+
+	private, err := w.open(e.Nonce, e.Sealed, e.Public)
+	if err != nil {
+		return nil, err
+	}
+	return &Keypair{Scheme: e.Scheme, Public: e.Public, Private: private}, nil
+}
+
+// Unlock checks passphrase against the seed and every imported key and keeps
+// the derived key in memory for timeout, or until Lock when timeout is 0.
+func (w *Wallet) Unlock(passphrase string, timeout time.Duration) error {
+	key, err := w.deriveKey(passphrase)
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	previous := w.key
+	w.key = key
+	if w.seedSealed != nil {
+		if _, err := w.open(w.seedNonce, w.seedSealed, []byte("seed")); err != nil {
+			w.key = previous
+			return err
+		}
+	}
+	for _, e := range w.entries {
+		if e.Sealed == nil {
+			continue
+		}
+		if _, err := w.open(e.Nonce, e.Sealed, e.Public); err != nil {
+			w.key = previous
+			return err
+		}
+	}
+
+	if w.relock != nil {
+		w.relock.Stop()
+		w.relock = nil
+	}
+	if timeout > 0 {
+		w.relock = time.AfterFunc(timeout, w.Lock)
+	}
+	return nil
+}
+
+func (w *Wallet) Lock() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for i := range w.key {
+		w.key[i] = 0
+	}
+	w.key = nil
+	if w.relock != nil {
+		w.relock.Stop()
+		w.relock = nil
+	}
+}
+
+func (w *Wallet) Locked() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.key == nil
+}
+
+// Keys lists the public keys of the wallet, the identity first.
+func (w *Wallet) Keys() [][]byte {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	keys := make([][]byte, len(w.entries))
+	for i, e := range w.entries {
+		keys[i] = e.Public
+	}
+	return keys
+}
+
+func (w *Wallet) List() []WalletKey {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	keys := make([]WalletKey, len(w.entries))
+	for i, e := range w.entries {
+		keys[i] = WalletKey{e.Public, e.Path, e.Path == "" && e.Sealed == nil}
+	}
+	return keys
+}
+
+// Lookup returns the public key of the wallet hashing to keyHash, or nil.
+func (w *Wallet) Lookup(keyHash []byte) []byte {
+	for _, k := range w.Keys() {
+		if bytes.Equal(KeyHash(k), keyHash) {
+			return k
+		}
+	}
+	return nil
+}
+
+// Keypair recovers the Keypair of public.
+func (w *Wallet) Keypair(public []byte) (*Keypair, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for _, e := range w.entries {
+		if bytes.Equal(e.Public, public) {
+			return w.keypair(e)
+		}
+	}
+	return nil, errors.New("Key not in wallet")
+}
+
+// Identity recovers the Keypair the node signs its blocks with.
+func (w *Wallet) Identity() (*Keypair, error) {
+	keys := w.Keys()
+	if len(keys) == 0 {
+		return nil, errors.New("Wallet is empty")
+	}
+	return w.Keypair(keys[0])
+}
+
+// NewReceiveKey returns the public key of the next unused receive address.
+// Wallets without a seed create a random key instead, which needs the
+// wallet unlocked.
+func (w *Wallet) NewReceiveKey() ([]byte, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.receive == nil {
+		kp, err := w.importKey(GenerateNewKeypair().Private)
+		if err != nil {
+			return nil, err
+		}
+		return kp.Public, nil
+	}
+
+	public, err := w.nextKey(w.receive, WALLET_RECEIVE_PATH, &w.receiveNext)
+	if err != nil {
+		return nil, err
+	}
+	return public, w.save()
+}
+
+// NewChangeKey returns the public key of the next unused change address, or
+// nil for wallets without a seed.
+func (w *Wallet) NewChangeKey() ([]byte, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.change == nil {
+		return nil, nil
+	}
+
+	public, err := w.nextKey(w.change, WALLET_CHANGE_PATH, &w.changeNext)
+	if err != nil {
+		return nil, err
+	}
+	return public, w.save()
+}
+
+// nextKey derives the key of chain at *next, skipping the rare invalid
+// indexes, and adds it to the wallet.
+func (w *Wallet) nextKey(chain *ExtendedKey, path string, next *uint32) ([]byte, error) {
+	for *next < HD_HARDENED {
+		index := *next
+		*next++
+
+		child, err := chain.Child(index)
+		if err != nil {
+			continue
+		}
+		w.entries = append(w.entries, walletEntry{Scheme: SCHEME_SECP256K1, Public: child.Key, Path: fmt.Sprintf("%s/%d", path, index)})
+		return child.Key, nil
+	}
+	return nil, errors.New("Key chain exhausted")
+}
+
+// ReceiveExtendedKey is the extended public key of the receive addresses,
+// which lets another wallet watch them.
+func (w *Wallet) ReceiveExtendedKey() (*ExtendedKey, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.receive == nil {
+		return nil, errors.New("Wallet has no seed")
+	}
+	return w.receive, nil
+}
+
+// Watch adds the first count children of the extended public key xpub as
+// watch-only keys.
+func (w *Wallet) Watch(xpub *ExtendedKey, count int) ([][]byte, error) {
+	if xpub.Private {
+		return nil, errors.New("Expected an extended public key")
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	added := [][]byte{}
+	for i := uint32(0); i < uint32(count); i++ {
+		child, err := xpub.Child(i)
+		if err != nil || w.has(child.Key) {
+			continue
+		}
+		w.entries = append(w.entries, walletEntry{Scheme: SCHEME_SECP256K1, Public: child.Key})
+		added = append(added, child.Key)
+	}
+	return added, w.save()
+}
+
+func (w *Wallet) has(public []byte) bool {
+	for _, e := range w.entries {
+		if bytes.Equal(e.Public, public) {
+			return true
+		}
+	}
+	return false
+}
+
+// Import adds the key of private, of the scheme of CONSENSUS_VERSION, to the
+// wallet and saves it.
+func (w *Wallet) Import(private []byte) (*Keypair, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.importKey(private)
+}
+
+func (w *Wallet) importKey(private []byte) (*Keypair, error) {
+	kp, err := KeypairFromPrivate(CONSENSUS_VERSION, private)
+	if err != nil {
+		return nil, err
+	}
+	if w.has(kp.Public) {
+		return nil, errors.New("Key already in wallet")
+	}
+
+	e := walletEntry{Scheme: kp.Scheme, Public: kp.Public}
+	if e.Nonce, e.Sealed, err = w.seal(kp.Private, kp.Public); err != nil {
+		return nil, err
+	}
+
+	w.entries = append(w.entries, e)
+	if err := w.save(); err != nil {
+		w.entries = w.entries[:len(w.entries)-1]
+		return nil, err
+	}
+	return kp, nil
+}
+
+// save replaces the wallet file atomically so a crash never leaves it half
+// written.
+func (w *Wallet) save() error {
+	d, err := w.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	tmp := w.path + ".tmp"
+	if err := os.WriteFile(tmp, d, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.path)
+}
+
+func (w *Wallet) MarshalBinary() ([]byte, error) {
+	bs := &bytes.Buffer{}
+	binary.Write(bs, binary.LittleEndian, uint32(WALLET_MAGIC))
+	bs.Write(FitBytes(w.salt, WALLET_SALT_SIZE))
+	binary.Write(bs, binary.LittleEndian, w.N)
+	binary.Write(bs, binary.LittleEndian, w.R)
+	binary.Write(bs, binary.LittleEndian, w.P)
+
+	writeBytes(bs, w.seedNonce)
+	writeBytes(bs, w.seedSealed)
+	for _, chain := range []*ExtendedKey{w.receive, w.change} {
+		var d []byte
+		if chain != nil {
+			d, _ = chain.MarshalBinary()
+		}
+		writeBytes(bs, d)
+	}
+	binary.Write(bs, binary.LittleEndian, w.receiveNext)
+	binary.Write(bs, binary.LittleEndian, w.changeNext)
+
+	binary.Write(bs, binary.LittleEndian, uint32(len(w.entries)))
+	for _, e := range w.entries {
+		binary.Write(bs, binary.LittleEndian, e.Scheme)
+		writeBytes(bs, e.Public)
+		writeBytes(bs, e.Nonce)
+		writeBytes(bs, e.Sealed)
+		writeBytes(bs, []byte(e.Path))
+	}
+	return bs.Bytes(), nil
+}
+
+// checkScryptParams rejects the key derivation parameters of a wallet file
+// that are not valid or would cost more than WALLET_SCRYPT_MAX_MEMORY.
+func checkScryptParams(N, R, P uint32) error {
+	if N < 2 || N&(N-1) != 0 || N > WALLET_SCRYPT_MAX_N {
+		return errors.New("Wallet scrypt N is not a power of two within bounds")
+	}
+	if R == 0 || R > WALLET_SCRYPT_MAX_R || P == 0 || P > WALLET_SCRYPT_MAX_P {
+		return errors.New("Wallet scrypt R or P out of bounds")
+	}
+	if 128*uint64(N)*uint64(R) > WALLET_SCRYPT_MAX_MEMORY {
+		return errors.New("Wallet scrypt parameters use too much memory")
+	}
+	return nil
+}
+
+func (w *Wallet) UnMarshalBinary(d []byte) error {
+	buf := bytes.NewBuffer(d)
+
+	var magic, count uint32
+	binary.Read(buf, binary.LittleEndian, &magic)
+	if magic != WALLET_MAGIC {
+		return errors.New("Not a wallet file")
+	}
+
+	w.salt = make([]byte, WALLET_SALT_SIZE)
+	if _, err := io.ReadFull(buf, w.salt); err != nil {
+		return errors.New("Truncated wallet file")
+	}
+	binary.Read(buf, binary.LittleEndian, &w.N)
+	binary.Read(buf, binary.LittleEndian, &w.R)
+	binary.Read(buf, binary.LittleEndian, &w.P)
+	if err := checkScryptParams(w.N, w.R, w.P); err != nil {
+		return err
+	}
+
+	var err error
+	if w.seedNonce, err = readBytes(buf); err != nil {
+		return err
+	}
+	if w.seedSealed, err = readBytes(buf); err != nil {
+		return err
+	}
+	if len(w.seedSealed) == 0 {
+		w.seedNonce, w.seedSealed = nil, nil
+	}
+	for _, chain := range []**ExtendedKey{&w.receive, &w.change} {
+		d, err := readBytes(buf)
+		if err != nil {
+			return err
+		}
+		if len(d) == 0 {
+			continue
+		}
+		*chain = &ExtendedKey{}
+		if err := (*chain).UnMarshalBinary(d); err != nil {
+			return err
+		}
+	}
+	binary.Read(buf, binary.LittleEndian, &w.receiveNext)
+	binary.Read(buf, binary.LittleEndian, &w.changeNext)
+
+	if err := binary.Read(buf, binary.LittleEndian, &count); err != nil {
+		return errors.New("Truncated wallet file")
+	}
+
+	w.entries = []walletEntry{}
+	for i := uint32(0); i < count; i++ {
+		e := walletEntry{}
+		if err := binary.Read(buf, binary.LittleEndian, &e.Scheme); err != nil {
+			return errors.New("Truncated wallet file")
+		}
+		if e.Public, err = readBytes(buf); err != nil {
+			return err
+		}
+		if e.Nonce, err = readBytes(buf); err != nil {
+			return err
+		}
+		if e.Sealed, err = readBytes(buf); err != nil {
+			return err
+		}
+		if len(e.Sealed) == 0 {
+			e.Nonce, e.Sealed = nil, nil
+		}
+		path, err := readBytes(buf)
+		if err != nil {
+			return err
+		}
+		e.Path = string(path)
+		w.entries = append(w.entries, e)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package bitcoin
+
+import "testing"
+
+func TestWalletUnMarshalScryptParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		N, R, P uint32
+		ok      bool
+	}{
+		{"defaults", WALLET_SCRYPT_N, WALLET_SCRYPT_R, WALLET_SCRYPT_P, true},
+		{"largest", WALLET_SCRYPT_MAX_N, WALLET_SCRYPT_MAX_MEMORY / 128 / WALLET_SCRYPT_MAX_N, WALLET_SCRYPT_MAX_P, true},
+		{"N zero", 0, 8, 1, false},
+		{"N one", 1, 8, 1, false},
+		{"N not a power of two", 3 << 10, 8, 1, false},
+		{"N too big", WALLET_SCRYPT_MAX_N << 1, 1, 1, false},
+		{"N huge", 1 << 31, 8, 1, false},
+		{"R zero", 1 << 10, 0, 1, false},
+		{"R too big", 1 << 10, WALLET_SCRYPT_MAX_R + 1, 1, false},
+		{"P zero", 1 << 10, 8, 0, false},
+		{"P too big", 1 << 10, 8, WALLET_SCRYPT_MAX_P + 1, false},
+		{"too much memory", WALLET_SCRYPT_MAX_N, WALLET_SCRYPT_MAX_R, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := Wallet{salt: make([]byte, WALLET_SALT_SIZE), N: tt.N, R: tt.R, P: tt.P}
+			d, err := w.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = new(Wallet).UnMarshalBinary(d)
+			if tt.ok && err != nil {
+				t.Errorf("decoding fails: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("decoding succeeds")
+			}
+		})
+	}
+}
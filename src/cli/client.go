@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bitcoin"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	commands["send"] = command{"send <address> <amount> [fee]", clientCommand(2, 3, runSend)}
+	commands["sendscript"] = command{"sendscript <script> <amount> [fee]", clientCommand(2, 3, runSendScript)}
+	commands["decodescript"] = command{"decodescript <script>", clientCommand(1, 1, runDecodeScript)}
+	commands["validateaddress"] = command{"validateaddress <address>", clientCommand(1, 1, runValidateAddress)}
+	commands["message"] = command{"message <text>", clientCommand(1, -1, runMessage)}
+	commands["getblock"] = command{"getblock <hash|height>", clientCommand(1, 1, runGetBlock)}
+	commands["gettransaction"] = command{"gettransaction <hash>", clientCommand(1, 1, runGetTransaction)}
+	commands["peers"] = command{"peers", clientCommand(0, 0, runPeers)}
+	commands["addresses"] = command{"addresses", clientCommand(0, 0, runAddresses)}
+	commands["connect"] = command{"connect <address>", clientCommand(1, 1, runConnect)}
+	commands["mine"] = command{"mine start|stop", clientCommand(1, 1, runMine)}
+	commands["generate"] = command{"generate <blocks> [address]", clientCommand(1, 2, runGenerate)}
+	commands["info"] = command{"info", clientCommand(0, 0, runInfo)}
+}
+
+type client struct {
+	address string
+	dataDir string
+	json    bool
+}
+
+type rpcReply struct {
+	Result json.RawMessage   `json:"result"`
+	Error  *bitcoin.RPCError `json:"error"`
+}
+
+// clientCommand parses the flags shared by the client commands and checks
+// that between min and max arguments are left, max < 0 meaning no limit.
+func clientCommand(min, max int, run func(c *client, args []string) error) func([]string) error {
+	return func(args []string) error {
+		fs := flag.NewFlagSet(commandName, flag.ExitOnError)
+		c := &client{}
+		fs.StringVar(&c.address, "rpc", fmt.Sprintf("127.0.0.1:%d", bitcoin.Params.RPCPort), "node JSON-RPC address")
+		fs.StringVar(&c.dataDir, "datadir", defaultDataDir(bitcoin.Params.Port), "node data directory, holding the RPC cookie")
+		fs.BoolVar(&c.json, "json", false, "print raw JSON")
+		fs.Parse(args)
+
+		if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+			return errors.New("Usage: " + commands[commandName].usage)
+		}
+		return run(c, fs.Args())
+	}
+}
+
+// call invokes method on the node and returns its raw result.
+func (c *client) call(method string, params ...interface{}) (json.RawMessage, error) {
+	raw := make([]json.RawMessage, len(params))
+	for i, p := range params {
+		d, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		raw[i] = d
+	}
+
+	req, err := json.Marshal(bitcoin.RPCRequest{JSONRPC: "2.0", Method: method, Params: raw, ID: json.RawMessage("1")})
+	if err != nil {
+		return nil, err
+	}
+
+	user, password, err := bitcoin.ReadRPCCookie(c.dataDir)
+	if err != nil {
+		return nil, errors.New("Fail to read RPC cookie, check -datadir: " + err.Error())
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, "http://"+c.address, bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.SetBasicAuth(user, password)
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, errors.New(strings.TrimSpace(string(body)))
+	}
+
+	reply := rpcReply{}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != nil {
+		return nil, errors.New(reply.Error.Message)
+	}
+	return reply.Result, nil
+}
+
+// print writes the result of a call, either as indented JSON or as plain
+// "key: value" lines.
+func (c *client) print(result json.RawMessage) error {
+	if c.json {
+		out := &bytes.Buffer{}
+		if err := json.Indent(out, result, "", "  "); err != nil {
+			return err
+		}
+		fmt.Println(out.String())
+		return nil
+	}
+
+	if string(result) == "null" {
+		return nil
+	}
+
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(result))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return err
+	}
+	printValue(v, "")
+	return nil
+}
+
+func printValue(v interface{}, indent string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			switch e := v[k].(type) {
+			case map[string]interface{}, []interface{}:
+				fmt.Printf("%s%s:\n", indent, k)
+				printValue(e, indent+"  ")
+			default:
+				fmt.Printf("%s%s: %s\n", indent, k, formatScalar(e))
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			switch e.(type) {
+			case map[string]interface{}, []interface{}:
+				if i > 0 {
+					fmt.Println()
+				}
+				printValue(e, indent)
+			default:
+				fmt.Printf("%s%s\n", indent, formatScalar(e))
+			}
+		}
+	default:
+		fmt.Printf("%s%s\n", indent, formatScalar(v))
+	}
+}
+
+func formatScalar(v interface{}) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprint(v)
+}
+
+func (c *client) run(method string, params ...interface{}) error {
+	result, err := c.call(method, params...)
+	if err != nil {
+		return err
+	}
+	return c.print(result)
+}
+
+func runSend(c *client, args []string) error {
+	// Catch typos before the node builds the payment
+	if _, err := bitcoin.DecodeAddress(args[0]); err != nil {
+		return err
+	}
+
+	amount, fee, err := parseAmounts(args[1:])
+	if err != nil {
+		return err
+	}
+	return c.run("sendpayment", args[0], amount, fee)
+}
+
+// runSendScript takes a script in hex or written as for decodescript, quoted
+// as one argument.
+func runSendScript(c *client, args []string) error {
+	amount, fee, err := parseAmounts(args[1:])
+	if err != nil {
+		return err
+	}
+	return c.run("sendtoscript", args[0], amount, fee)
+}
+
+// parseAmounts reads an amount and an optional fee.
+func parseAmounts(args []string) (amount, fee uint64, err error) {
+	amount, err = strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return
+	}
+	if len(args) > 1 {
+		fee, err = strconv.ParseUint(args[1], 10, 64)
+	}
+	return
+}
+
+func runDecodeScript(c *client, args []string) error {
+	return c.run("decodescript", args[0])
+}
+
+func runMessage(c *client, args []string) error {
+	return c.run("sendmessage", strings.Join(args, " "))
+}
+
+func runValidateAddress(c *client, args []string) error {
+	return c.run("validateaddress", args[0])
+}
+
+func runGetBlock(c *client, args []string) error {
+	if height, err := strconv.Atoi(args[0]); err == nil {
+		return c.run("getblock", height)
+	}
+	return c.run("getblock", args[0])
+}
+
+func runGetTransaction(c *client, args []string) error {
+	return c.run("gettransaction", args[0])
+}
+
+func runPeers(c *client, args []string) error {
+	return c.run("getpeerinfo")
+}
+
+func runAddresses(c *client, args []string) error {
+	return c.run("getnodeaddresses")
+}
+
+func runConnect(c *client, args []string) error {
+	return c.run("addnode", args[0])
+}
+
+func runMine(c *client, args []string) error {
+	switch args[0] {
+	case "start":
+		return c.run("setmining", true)
+	case "stop":
+		return c.run("setmining", false)
+	}
+	return errors.New("Usage: " + commands["mine"].usage)
+}
+
+func runGenerate(c *client, args []string) error {
+	n, err := strconv.Atoi(args[0])
+	if err != nil {
+		return errors.New("Usage: " + commands["generate"].usage)
+	}
+	if len(args) > 1 {
+		return c.run("generate", n, args[1])
+	}
+	return c.run("generate", n)
+}
+
+func runInfo(c *client, args []string) error {
+	return c.run("getmininginfo")
+}
@@ -2,67 +2,64 @@ package main
 
 import (
 	"bitcoin"
-	"bufio"
 	"flag"
+	"fmt"
 	"log"
-	"net"
 	"os"
-	"regexp"
+	"path/filepath"
+	"strconv"
 )
 
-var port int
-var slow bool
-
-func init() {
-	flag.IntVar(&port, "port", bitcoin.BLOCKCHAIN_DEFAULT_PORT, "blockchain port")
-	flag.BoolVar(&slow, "slow", false, "POW speed")
+type command struct {
+	usage string
+	run   func(args []string) error
 }
 
+var commands = map[string]command{}
+
+// commandName is the command being run, for usage messages.
+var commandName string
+
+var commandOrder = []string{"node", "send", "sendscript", "decodescript", "multisig", "listunspent", "psbt", "validateaddress", "message", "getblock", "gettransaction", "peers", "addresses", "connect", "mine", "generate", "wallet", "info"}
+
 func usage() {
-	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "Usage: %s [-network mainnet|testnet|regtest] <command> [options] [arguments]\n\nCommands:\n", os.Args[0])
+	for _, name := range commandOrder {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nClient commands accept -rpc <address>, -datadir <node data directory> and -json.\n")
 }
 
 func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	network := flag.String("network", bitcoin.MainNetParams.Name, "network to use: mainnet, testnet or regtest")
 	flag.Usage = usage
 	flag.Parse()
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	bitcoin.Start(getIPAddress(), port)
-	for {
-		input := <-readStdin()
-		if addr := findIPAddress(input); addr != "" {
-			bitcoin.Core.Network.ConnectionQueue <- addr
-		} else {
-			bitcoin.Core.BlockChain.TransactionChannel <- bitcoin.CreateTransaction(input)
-		}
-	}
-}
-
-func readStdin() chan string {
-	cb := make(chan string)
-	input := bufio.NewScanner(os.Stdin)
-	go func() {
-		if input.Scan() {
-			cb <- input.Text()
-		}
-	}()
-
-	return cb
-}
 
-func getIPAddress() string {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		log.Fatal(err)
+	if err := bitcoin.SelectParams(*network); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(2)
+	}
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
 	}
-	defer conn.Close()
 
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
+	commandName = flag.Arg(0)
+	cmd, ok := commands[commandName]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
 
-	return localAddr.IP.String()
+	if err := cmd.run(flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
 }
 
-func findIPAddress(input string) string {
-	validIpAddressRegex := "([0-9]{1,3}.[0-9]{1,3}.[0-9]{1,3}.[0-9]{1,3})"
-	re := regexp.MustCompile(validIpAddressRegex)
-	return re.FindString(input)
+// defaultDataDir is where the node listening on port keeps its data, apart
+// for every network.
+func defaultDataDir(port int) string {
+	return filepath.Join(bitcoin.BLOCKCHAIN_DEFAULT_DATA_DIR, bitcoin.Params.DataDir, strconv.Itoa(port))
 }
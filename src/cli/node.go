@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bitcoin"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+)
+
+func init() {
+	commands["node"] = command{"node [-port n] [-datadir dir] [-wallet file] [-workers n] [-rpcport n] [-explorerport n]", runNode}
+}
+
+// runNode starts the daemon and never returns.
+func runNode(args []string) error {
+	fs := flag.NewFlagSet("node", flag.ExitOnError)
+	port := fs.Int("port", bitcoin.Params.Port, "blockchain port")
+	dataDir := fs.String("datadir", "", "blockchain data directory")
+	workers := fs.Int("workers", 0, "mining goroutines, one per CPU when 0")
+	rpcPort := fs.Int("rpcport", bitcoin.Params.RPCPort, "JSON-RPC port, disabled when 0")
+	explorerPort := fs.Int("explorerport", bitcoin.Params.ExplorerPort, "block explorer port, disabled when 0")
+	walletPath := fs.String("wallet", "", "wallet file, <datadir>/"+bitcoin.WALLET_FILE+" when empty")
+	fs.Parse(args)
+
+	if *dataDir == "" {
+		*dataDir = defaultDataDir(*port)
+	}
+	if *walletPath == "" {
+		*walletPath = filepath.Join(*dataDir, bitcoin.WALLET_FILE)
+	}
+
+	wallet, err := loadWallet(*walletPath)
+	if err != nil {
+		return err
+	}
+	if err := bitcoin.Start(getIPAddress(), *port, *dataDir, *workers, wallet); err != nil {
+		return err
+	}
+	if *rpcPort != 0 {
+		if err := bitcoin.StartRPC(fmt.Sprintf("127.0.0.1:%d", *rpcPort), *dataDir); err != nil {
+			return err
+		}
+	}
+	if *explorerPort != 0 {
+		bitcoin.StartExplorer(fmt.Sprintf("127.0.0.1:%d", *explorerPort))
+	}
+	log.Println("Network:", bitcoin.Params.Name)
+	log.Println("Public key:", hex.EncodeToString(bitcoin.Core.Keypair.Public))
+
+	select {}
+}
+
+func getIPAddress() string {
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	localAddr := conn.LocalAddr().(*net.UDPAddr)
+
+	return localAddr.IP.String()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+func init() {
+	commands["multisig"] = command{"multisig <m> <public key|address>...", clientCommand(2, -1, runMultiSig)}
+	commands["listunspent"] = command{"listunspent <script>", clientCommand(1, 1, runListUnspent)}
+	commands["psbt"] = command{"psbt create <script> <address|script> <amount> [fee]|decode|sign|finalize|send <psbt>|combine <psbt>...", clientCommand(2, -1, runPSBT)}
+}
+
+func runMultiSig(c *client, args []string) error {
+	m, err := strconv.Atoi(args[0])
+	if err != nil {
+		return errors.New("Usage: " + commands["multisig"].usage)
+	}
+	return c.run("createmultisig", m, args[1:])
+}
+
+func runListUnspent(c *client, args []string) error {
+	return c.run("listunspent", args[0])
+}
+
+// runPSBT drives the partially signed transaction workflow: create, pass the
+// hex around for sign, combine the copies, then send.
+func runPSBT(c *client, args []string) error {
+	usage := errors.New("Usage: " + commands["psbt"].usage)
+
+	switch args[0] {
+	case "create":
+		if len(args) < 4 || len(args) > 5 {
+			return usage
+		}
+		amount, fee, err := parseAmounts(args[3:])
+		if err != nil {
+			return err
+		}
+		return c.run("createpsbt", args[1], args[2], amount, fee)
+	case "combine":
+		return c.run("combinepsbt", args[1:])
+	}
+
+	if len(args) != 2 {
+		return usage
+	}
+	switch args[0] {
+	case "decode":
+		return c.run("decodepsbt", args[1])
+	case "sign":
+		return c.run("signpsbt", args[1])
+	case "finalize":
+		return c.run("finalizepsbt", args[1])
+	case "send":
+		result, err := c.call("finalizepsbt", args[1])
+		if err != nil {
+			return err
+		}
+		var t string
+		if err := json.Unmarshal(result, &t); err != nil {
+			return err
+		}
+		return c.run("sendtransaction", t)
+	}
+	return usage
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bitcoin"
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const passphraseEnv = "BITCOIN_WALLET_PASSPHRASE"
+
+func init() {
+	commands["wallet"] = command{"wallet create|restore|info|list|new|unlock [seconds]|lock|import <private key>|export <address>|xpub|watch <xpub> [count]", runWallet}
+}
+
+var stdin = bufio.NewReader(os.Stdin)
+
+func readLine(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readPassphrase takes the passphrase from the environment, or asks for it.
+func readPassphrase(prompt string) (string, error) {
+	if p, ok := os.LookupEnv(passphraseEnv); ok {
+		return p, nil
+	}
+	return readLine(prompt)
+}
+
+// createWallet writes a new wallet at path and shows its recovery phrase,
+// or restores it from the phrase when restore is set.
+func createWallet(path string, restore bool) (*bitcoin.Wallet, error) {
+	mnemonic := ""
+	if restore {
+		m, err := readLine("Recovery phrase: ")
+		if err != nil {
+			return nil, err
+		}
+		mnemonic = m
+	}
+
+	passphrase, err := readPassphrase("New wallet passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := os.LookupEnv(passphraseEnv); !ok {
+		again, err := readPassphrase("Repeat passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if again != passphrase {
+			return nil, errors.New("Passphrases do not match")
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if restore {
+		return bitcoin.RestoreWallet(path, passphrase, mnemonic, bitcoin.WALLET_GAP_LIMIT)
+	}
+
+	wallet, mnemonic, err := bitcoin.CreateWallet(path, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(os.Stderr, "Write down the recovery phrase of the wallet:")
+	fmt.Fprintln(os.Stderr, mnemonic)
+	return wallet, nil
+}
+
+// loadWallet unlocks the wallet at path, creating it when missing.
+func loadWallet(path string) (*bitcoin.Wallet, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "Creating wallet", path)
+		return createWallet(path, false)
+	}
+
+	wallet, err := bitcoin.OpenWallet(path)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := readPassphrase("Wallet passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	return wallet, wallet.Unlock(passphrase, 0)
+}
+
+func runWallet(args []string) error {
+	if len(args) > 0 && (args[0] == "create" || args[0] == "restore") {
+		return runWalletCreate(args[0] == "restore", args[1:])
+	}
+	return clientCommand(1, 3, runWalletClient)(args)
+}
+
+// runWalletCreate writes a wallet file without a running node.
+func runWalletCreate(restore bool, args []string) error {
+	fs := flag.NewFlagSet("wallet", flag.ExitOnError)
+	port := fs.Int("port", bitcoin.Params.Port, "blockchain port of the node")
+	dataDir := fs.String("datadir", "", "blockchain data directory")
+	path := fs.String("wallet", "", "wallet file, <datadir>/"+bitcoin.WALLET_FILE+" when empty")
+	fs.Parse(args)
+
+	if *dataDir == "" {
+		*dataDir = defaultDataDir(*port)
+	}
+	if *path == "" {
+		*path = filepath.Join(*dataDir, bitcoin.WALLET_FILE)
+	}
+
+	wallet, err := createWallet(*path, restore)
+	if err != nil {
+		return err
+	}
+	defer wallet.Lock()
+
+	fmt.Println(*path)
+	return nil
+}
+
+func runWalletClient(c *client, args []string) error {
+	usage := errors.New("Usage: " + commands["wallet"].usage)
+
+	switch args[0] {
+	case "info":
+		return c.run("getwalletinfo")
+	case "list":
+		return c.run("listkeys")
+	case "new":
+		return c.run("getnewaddress")
+	case "xpub":
+		return c.run("getxpub")
+	case "watch":
+		if len(args) < 2 {
+			return usage
+		}
+		if len(args) > 2 {
+			count, err := strconv.Atoi(args[2])
+			if err != nil {
+				return usage
+			}
+			return c.run("watchxpub", args[1], count)
+		}
+		return c.run("watchxpub", args[1])
+	case "lock":
+		return c.run("walletlock")
+	case "unlock":
+		seconds := 0
+		if len(args) > 1 {
+			s, err := strconv.Atoi(args[1])
+			if err != nil {
+				return usage
+			}
+			seconds = s
+		}
+		passphrase, err := readPassphrase("Wallet passphrase: ")
+		if err != nil {
+			return err
+		}
+		return c.run("walletunlock", passphrase, seconds)
+	case "import":
+		if len(args) < 2 {
+			return usage
+		}
+		return c.run("importkey", args[1])
+	case "export":
+		if len(args) < 2 {
+			return usage
+		}
+		return c.run("exportkey", args[1])
+	}
+	return usage
+}